@@ -16,33 +16,113 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	yaml "gopkg.in/yaml.v2"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/neumayer/ocidiscover/oci"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
 	"github.com/prometheus/prometheus/documentation/examples/custom-sd/adapter"
 )
 
 var (
-	a                     = kingpin.New("sd adapter usage", "Tool to generate file_sd target files for unimplemented SD mechanisms.")
-	outputFile            = a.Flag("output.file", "Output file for file_sd compatible file.").Default("custom_sd.json").String()
-	rootCompartmentID     = a.Flag("sd.root_compartment_id", "The ocid of the root compartment for service discovery.").String()
-	compartmentID         = a.Flag("sd.compartment_id", "The ocid of the compartment for service discovery.").String()
-	port                  = a.Flag("sd.port", "Port for service discovery.").Int()
-	displayName           = a.Flag("sd.display_name", "Display name for service discovery.").String()
-	useInstancePrincipals = a.Flag("sd.use_instance_principals", "Whether or not to use instance principals for service discovery.").Bool()
-	logger                log.Logger
+	a                           = kingpin.New("sd adapter usage", "Tool to generate file_sd target files for unimplemented SD mechanisms.")
+	outputFile                  = a.Flag("output.file", "Output file for file_sd compatible file.").Default("custom_sd.json").String()
+	outputStdout                = a.Flag("output.stdout", "Whether or not to write the file_sd compatible targets to standard output instead of the output file, once per refresh. Logs go to standard error then.").Bool()
+	outputMode                  = a.Flag("output.mode", "Permissions of the output file when writing it in oneshot mode (octal).").Default("0644").String()
+	oneshot                     = a.Flag("oneshot", "Write the output file once and exit instead of refreshing periodically.").Bool()
+	rootCompartmentID           = a.Flag("sd.root_compartment_id", "The ocid of the root compartment for service discovery.").String()
+	compartmentID               = a.Flag("sd.compartment_id", "The ocid of the compartment for service discovery.").String()
+	compartmentIDsFile          = a.Flag("sd.compartment_ids_file", "File listing the ocids of the compartments for service discovery, one per line. It is read again on every refresh.").String()
+	port                        = a.Flag("sd.port", "Port for service discovery.").Int()
+	displayName                 = a.Flag("sd.display_name", "Display name for service discovery.").String()
+	useInstancePrincipals       = a.Flag("sd.use_instance_principals", "Whether or not to use instance principals for service discovery.").Bool()
+	compartmentAccessLevel      = a.Flag("sd.compartment_access_level", "Access level used when listing compartments below the root compartment (ANY or ACCESSIBLE).").Default("ACCESSIBLE").Enum("ANY", "ACCESSIBLE")
+	definedTagFilters           = a.Flag("sd.defined_tag_filter", "Only discover instances carrying the defined tag, given as namespace.key=value. A value of * only requires the tag to exist. May be repeated.").Strings()
+	includeSecondaryIPs         = a.Flag("sd.include_secondary_ips", "Whether or not to emit a target for each secondary private IP of an instance.").Bool()
+	roleTag                     = a.Flag("sd.role_tag", "Freeform tag whose value is exposed as the role of an instance.").String()
+	availabilityDomain          = a.Flag("sd.availability_domain", "Only discover instances in this availability domain.").String()
+	skipVNICErrors              = a.Flag("sd.skip_vnic_errors", "Whether or not to skip instances whose VNICs cannot be resolved instead of failing the refresh.").Bool()
+	regionalSource              = a.Flag("sd.regional_source", "Whether or not to include the region in target group sources. Changing this replaces all targets in Prometheus.").Bool()
+	instanceSortBy              = a.Flag("sd.instance_sort_by", "Field to sort listed instances by (TIMECREATED or DISPLAYNAME).").Enum("TIMECREATED", "DISPLAYNAME")
+	instanceSortOrder           = a.Flag("sd.instance_sort_order", "Order to sort listed instances in (ASC or DESC).").Enum("ASC", "DESC")
+	instancePageLimit           = a.Flag("sd.instance_page_limit", "Maximum number of instances to request per page, 0 leaves it to the API.").Int()
+	includeInactiveCompartments = a.Flag("sd.include_inactive_compartments", "Whether or not to discover instances in compartments that are not ACTIVE.").Bool()
+	recurseCompartments         = a.Flag("sd.recurse_compartments", "Whether or not to discover instances in the whole compartment tree below the root compartment instead of only in its direct children.").Bool()
+	displayNameFilterLabel      = a.Flag("sd.display_name_filter_label", "Whether or not to expose the display name filter as a label on every target.").Bool()
+	addressPreference           = a.Flag("sd.address_preference", "Kind of IP to scrape (private or public), falling back to the next one given if an instance has none. May be repeated.").Enums("private", "public")
+	scrapeHintTag               = a.Flag("sd.scrape_hint_tag", "Freeform tag through which instances override the scheme, port and metrics path to scrape, given as [scheme:]port[/path].").String()
+	emitVNICErrors              = a.Flag("sd.emit_vnic_errors", "Whether or not to keep instances whose VNICs cannot be resolved as targets labeled with the error, with sd.skip_vnic_errors.").Bool()
+	listenAddress               = a.Flag("web.listen_address", "Address to serve the readiness endpoint /-/ready on, none if empty. It responds with 503 until the first refresh succeeded.").String()
+	includeRootCompartment      = a.Flag("sd.include_root_compartment", "Whether or not to discover instances placed directly in the root compartment.").Default("true").Bool()
+	maxTargets                  = a.Flag("sd.max_targets", "Maximum number of targets to discover, 0 means no limit. Targets beyond it are dropped.").Int()
+	failOnMaxTargets            = a.Flag("sd.fail_on_max_targets", "Whether or not to fail refreshes finding more than the maximum number of targets instead of dropping the excess.").Bool()
+	homeRegion                  = a.Flag("sd.home_region", "Home region of the tenancy to send identity requests to, defaults to the configured region.").String()
+	portFromDefinedTag          = a.Flag("sd.port_from_defined_tag", "Defined tag, given as namespace.key, holding the port to scrape an instance on.").String()
+	emitCompartmentTags         = a.Flag("sd.emit_compartment_tags", "Whether or not to add the freeform tags of a compartment as labels to its instances.").Bool()
+	compartmentTagFilters       = a.Flag("sd.compartment_tag_filter", "Only discover instances in compartments carrying the freeform tag, given as key=value. May be repeated.").StringMap()
+	portOptional                = a.Flag("sd.port_optional", "Whether or not to leave the port out of target addresses unless set by an instance's tags, for relabeling to add it.").Bool()
+	searchQuery                 = a.Flag("sd.search_query", "Structured resource search query to find instances with instead of walking compartments.").String()
+	compartmentConcurrency      = a.Flag("sd.compartment_concurrency", "Number of compartments to list instances of at the same time.").Default("4").Int()
+	instanceConcurrency         = a.Flag("sd.instance_concurrency", "Number of instances to look up VNICs of at the same time.").Default("8").Int()
+	cacheFile                   = a.Flag("cache.file", "File to persist discovered targets in, served at startup until the first refresh succeeds.").String()
+	cacheMaxAge                 = a.Flag("cache.max_age", "Maximum age of cached targets to serve at startup, 0 means no limit.").Default("1h").Duration()
+	validateCredentials         = a.Flag("sd.validate_credentials_on_startup", "Whether or not to exit at startup if the configured compartments can't be read with the configured credentials.").Bool()
+	emitNamespace               = a.Flag("sd.emit_namespace", "Whether or not to add the object storage namespace of the tenancy as a label to all targets.").Bool()
+	groupBy                     = a.Flag("sd.group_by", "Whether to return a target group per instance or per availability domain (instance or availability_domain).").Default("instance").Enum("instance", "availability_domain")
+	maxIdleConns                = a.Flag("sd.max_idle_conns", "Maximum number of idle connections to the OCI APIs, 0 keeps the default of 100.").Int()
+	maxIdleConnsPerHost         = a.Flag("sd.max_idle_conns_per_host", "Maximum number of idle connections per OCI API host, 0 keeps the default of 2.").Int()
+	refreshTimeout              = a.Flag("sd.refresh_timeout", "Maximum duration of a single refresh, 0 means no limit.").Default("0s").Duration()
+	retryOnEmpty                = a.Flag("sd.retry_on_empty", "Number of times to retry a refresh finding no targets when the previous one found some.").Int()
+	retryOnEmptyDelay           = a.Flag("sd.retry_on_empty_delay", "Delay between retries of refreshes finding no targets.").Default("5s").Duration()
+	labelNameMode               = a.Flag("sd.label_name_mode", "Whether to sanitize tag keys into classic label names or keep them as UTF-8 label names (sanitize or utf8).").Default("sanitize").Enum("sanitize", "utf8")
+	scopeFile                   = a.Flag("scope.file", "YAML file describing the compartments and filters to discover, overriding the corresponding flags.").String()
+	rootChildNames              = a.Flag("sd.root_child_name", "Only walk the child of the root compartment with this name and the compartments below it. May be repeated.").Strings()
+	emitBootVolumeID            = a.Flag("sd.emit_boot_volume_id", "Whether or not to label targets with the boot volume of their instance, costing an API call per instance.").Bool()
+	metadataOnlyStates          = a.Flag("sd.metadata_only_state", "Instance lifecycle state besides RUNNING to discover instances in, labeled as not scrapeable. May be repeated.").Strings()
+	metadataOnlyOmitAddress     = a.Flag("sd.metadata_only_omit_address", "Whether or not to omit the address of instances discovered in metadata only states.").Bool()
+	realm                       = a.Flag("sd.realm", "Second-level domain of the OCI endpoints, e.g. oraclegovcloud.com. Defaults to the commercial realm.").String()
+	rotateADs                   = a.Flag("sd.rotate_availability_domains", "Whether or not to discover a single availability domain per refresh, rotating through them. Full coverage takes a refresh per availability domain.").Bool()
+	targetRemovalGracePeriod    = a.Flag("sd.target_removal_grace_period", "How long to keep targets that disappear from a refresh, labeled as stale. 0 removes them right away.").Default("0s").Duration()
+	ipFilterCIDRs               = a.Flag("sd.ip_filter_cidr", "Only discover targets whose address is an IP in this CIDR. May be repeated.").Strings()
+	preferredSubnetID           = a.Flag("sd.preferred_subnet_id", "Subnet whose VNIC addresses to scrape on instances with several VNICs.").String()
+	maxConcurrentRequests       = a.Flag("sd.max_concurrent_requests", "Maximum number of OCI API requests in flight across compartments and instances, 0 means no limit.").Int()
+	failOnNoCompartments        = a.Flag("sd.fail_on_no_compartments", "Whether or not to fail refreshes finding no compartments below the root compartment instead of finding no targets.").Bool()
+	emitConsoleURL              = a.Flag("sd.emit_console_url", "Whether or not to label targets with the URL of their instance in the OCI console.").Bool()
+	allSubscribedRegions        = a.Flag("sd.all_subscribed_regions", "Whether or not to discover instances in all regions the tenancy is subscribed to.").Bool()
+	regionAllowlist             = a.Flag("sd.region_allowlist", "Only discover this subscribed region, given by name such as us-ashburn-1. May be repeated.").Strings()
+	principalBootstrapTimeout   = a.Flag("sd.principal_bootstrap_timeout", "Maximum duration of each attempt at fetching instance principal credentials, 0 means no limit.").Default("0s").Duration()
+	principalBootstrapRetries   = a.Flag("sd.principal_bootstrap_retries", "Number of times to retry fetching instance principal credentials.").Default("0").Int()
+	shards                      = a.Flag("sd.shards", "Number of shards to label targets with, by a hash of their instance id. 0 means no shard label.").Default("0").Int()
+	dedupKey                    = a.Flag("sd.dedup_key", "Attribute to drop targets with the same values of, one of instance_id, address, private_ip, public_ip or tag:<key>. May be repeated.").Strings()
+	sanitizedTagKeyPrefix       = a.Flag("sd.sanitized_tag_key_prefix", "Prefix to put in front of tag keys that start with a digit or an underscore once sanitized.").String()
+	sortTargets                 = a.Flag("sd.sort_targets", "Whether or not to sort targets by tenancy, region, compartment and instance id for stable output.").Bool()
+	usePrometheusTagNamespace   = a.Flag("sd.use_prometheus_tag_namespace", "Whether or not to read the port, scheme, path and whether to scrape an instance from its defined tags in the prometheus namespace.").Bool()
+	unresolvedAddress           = a.Flag("sd.unresolved_address_placeholder", "Address of targets for instances without a usable IP, which are skipped if empty.").String()
+	emitSubnetPublic            = a.Flag("sd.emit_subnet_public", "Whether or not to label targets with whether their subnet is public.").Bool()
+	emitTenancyName             = a.Flag("sd.emit_tenancy_name", "Whether or not to label targets with the name of their tenancy.").Bool()
+	compartmentFailures         = a.Flag("sd.compartment_failure_threshold", "Number of consecutive refreshes a compartment may fail before it is skipped for the compartment cooldown, 0 never skips compartments.").Default("0").Int()
+	compartmentCooldown         = a.Flag("sd.compartment_cooldown", "How long to skip compartments that keep failing.").Default("10m").Duration()
+	emitRootName                = a.Flag("sd.emit_root_compartment_name", "Whether or not to label targets with the name of the root compartment.").Bool()
+	lowercaseTagValues          = a.Flag("sd.lowercase_tag_values", "Whether or not to lowercase the values of tag labels.").Bool()
+	scrapeableStates            = a.Flag("sd.scrapeable_state", "Instance lifecycle state whose instances get an address, RUNNING if not set. Instances in other discovered states are labeled as not scrapeable. May be repeated.").Strings()
+	emitCompartmentSize         = a.Flag("sd.emit_compartment_target_count", "Whether or not to label targets with the number of targets in their compartment.").Bool()
+	costCenterTag               = a.Flag("sd.cost_center_tag", "Defined tag, given as namespace.key, whose value labels targets as their cost center.").String()
+	configPrint                 = a.Flag("config.print", "Print the configuration resolved from flags and the scope file as YAML and exit.").Bool()
+	logFormat                   = a.Flag("log.format", "Output format of log messages (logfmt or json).").Default("logfmt").Enum("logfmt", "json")
+	logLevel                    = a.Flag("log.level", "Only log messages with the given severity or above (debug, info, warn or error).").Default("info").Enum("debug", "info", "warn", "error")
+	logger                      log.Logger
 )
 
-func parseConfig() oci.SDConfig {
-	if *rootCompartmentID == "" && *compartmentID == "" || *rootCompartmentID != "" && *compartmentID != "" {
-		fmt.Println("OCI SD configuration requires either a specific compartment id or the root compartment id (not both)")
-		os.Exit(1)
-	}
+func parseConfig() (oci.SDConfig, error) {
 	cfg := oci.SDConfig{}
 	if *port != 0 {
 		cfg.Port = *port
@@ -56,9 +136,156 @@ func parseConfig() oci.SDConfig {
 	if *compartmentID != "" {
 		cfg.CompartmentID = *compartmentID
 	}
+	cfg.CompartmentIDsFile = *compartmentIDsFile
 	cfg.RefreshInterval = model.Duration(60 * time.Second)
 	cfg.UseInstancePrincipals = *useInstancePrincipals
-	return cfg
+	cfg.CompartmentAccessLevel = *compartmentAccessLevel
+	cfg.DefinedTagFilters = *definedTagFilters
+	cfg.IncludeSecondaryIPs = *includeSecondaryIPs
+	cfg.RoleTag = *roleTag
+	cfg.AvailabilityDomain = *availabilityDomain
+	cfg.SkipVNICErrors = *skipVNICErrors
+	cfg.EmitVNICErrors = *emitVNICErrors
+	cfg.RegionalSource = *regionalSource
+	cfg.InstanceSortBy = *instanceSortBy
+	cfg.InstanceSortOrder = *instanceSortOrder
+	cfg.InstancePageLimit = *instancePageLimit
+	cfg.IncludeInactiveCompartments = *includeInactiveCompartments
+	cfg.RecurseCompartments = *recurseCompartments
+	cfg.DisplayNameFilterLabel = *displayNameFilterLabel
+	cfg.AddressPreference = *addressPreference
+	cfg.ScrapeHintTag = *scrapeHintTag
+	cfg.IncludeRootCompartment = *includeRootCompartment
+	cfg.MaxTargets = *maxTargets
+	cfg.FailOnMaxTargets = *failOnMaxTargets
+	cfg.HomeRegion = *homeRegion
+	cfg.PortFromDefinedTag = *portFromDefinedTag
+	cfg.EmitCompartmentTags = *emitCompartmentTags
+	cfg.CompartmentTagFilters = *compartmentTagFilters
+	cfg.PortOptional = *portOptional
+	cfg.SearchQuery = *searchQuery
+	cfg.CompartmentConcurrency = *compartmentConcurrency
+	cfg.InstanceConcurrency = *instanceConcurrency
+	cfg.CacheFile = *cacheFile
+	cfg.CacheMaxAge = model.Duration(*cacheMaxAge)
+	cfg.ValidateCredentialsOnStartup = *validateCredentials
+	cfg.EmitNamespace = *emitNamespace
+	cfg.GroupBy = *groupBy
+	cfg.MaxIdleConns = *maxIdleConns
+	cfg.MaxIdleConnsPerHost = *maxIdleConnsPerHost
+	cfg.RefreshTimeout = model.Duration(*refreshTimeout)
+	cfg.RetryOnEmpty = *retryOnEmpty
+	cfg.RetryOnEmptyDelay = model.Duration(*retryOnEmptyDelay)
+	cfg.LabelNameMode = *labelNameMode
+	cfg.RootChildNames = *rootChildNames
+	cfg.EmitBootVolumeID = *emitBootVolumeID
+	cfg.MetadataOnlyStates = *metadataOnlyStates
+	cfg.ScrapeableStates = *scrapeableStates
+	cfg.EmitCompartmentTargetCount = *emitCompartmentSize
+	cfg.CostCenterTag = *costCenterTag
+	cfg.MetadataOnlyOmitAddress = *metadataOnlyOmitAddress
+	cfg.Realm = *realm
+	cfg.RotateAvailabilityDomains = *rotateADs
+	cfg.TargetRemovalGracePeriod = model.Duration(*targetRemovalGracePeriod)
+	cfg.IPFilterCIDRs = *ipFilterCIDRs
+	cfg.PreferredSubnetID = *preferredSubnetID
+	cfg.MaxConcurrentRequests = *maxConcurrentRequests
+	cfg.FailOnNoCompartments = *failOnNoCompartments
+	cfg.EmitConsoleURL = *emitConsoleURL
+	cfg.AllSubscribedRegions = *allSubscribedRegions
+	cfg.RegionAllowlist = *regionAllowlist
+	cfg.PrincipalBootstrapTimeout = model.Duration(*principalBootstrapTimeout)
+	cfg.PrincipalBootstrapRetries = *principalBootstrapRetries
+	cfg.Shards = *shards
+	cfg.DedupKey = *dedupKey
+	cfg.SanitizedTagKeyPrefix = *sanitizedTagKeyPrefix
+	cfg.SortTargets = *sortTargets
+	cfg.UsePrometheusTagNamespace = *usePrometheusTagNamespace
+	cfg.UnresolvedAddressPlaceholder = *unresolvedAddress
+	cfg.EmitSubnetPublic = *emitSubnetPublic
+	cfg.EmitTenancyName = *emitTenancyName
+	cfg.EmitRootCompartmentName = *emitRootName
+	cfg.LowercaseTagValues = *lowercaseTagValues
+	cfg.CompartmentFailureThreshold = *compartmentFailures
+	cfg.CompartmentCooldown = model.Duration(*compartmentCooldown)
+	if *scopeFile != "" {
+		scope, err := oci.LoadScope(*scopeFile)
+		if err != nil {
+			return oci.SDConfig{}, err
+		}
+		scope.Apply(&cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		return oci.SDConfig{}, err
+	}
+	return cfg, nil
+}
+
+// webHandler serves the readiness of disc on /-/ready.
+func webHandler(disc *oci.Discovery) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/-/ready", disc.ReadinessHandler())
+	return mux
+}
+
+// printConfig writes cfg to w as YAML. The configuration only refers to
+// credentials by the files holding them, so there is nothing to redact.
+func printConfig(w io.Writer, cfg oci.SDConfig) error {
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// writeTargets writes the targets of every update of disc to w until ctx is
+// done.
+func writeTargets(ctx context.Context, w io.Writer, disc *oci.Discovery) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := make(chan []*targetgroup.Group)
+	go disc.Run(ctx, ch)
+	for {
+		select {
+		case tgs := <-ch:
+			if err := oci.EncodeFileSD(w, tgs); err != nil {
+				level.Error(logger).Log("msg", "Writing targets failed", "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newLogger returns a logger writing to w in the given format that drops
+// messages below the given level.
+func newLogger(w io.Writer, format, lvl string) (log.Logger, error) {
+	var l log.Logger
+	switch format {
+	case "logfmt":
+		l = log.NewLogfmtLogger(w)
+	case "json":
+		l = log.NewJSONLogger(w)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	var allowed level.Option
+	switch lvl {
+	case "debug":
+		allowed = level.AllowDebug()
+	case "info":
+		allowed = level.AllowInfo()
+	case "warn":
+		allowed = level.AllowWarn()
+	case "error":
+		allowed = level.AllowError()
+	default:
+		return nil, fmt.Errorf("unknown log level %q", lvl)
+	}
+	l = log.NewSyncLogger(l)
+	l = level.NewFilter(l, allowed)
+	return log.With(l, "ts", log.DefaultTimestampUTC, "caller", log.DefaultCaller), nil
 }
 
 func main() {
@@ -69,17 +296,72 @@ func main() {
 		fmt.Println("err: ", err)
 		return
 	}
-	parseConfig()
-	logger = log.NewSyncLogger(log.NewLogfmtLogger(os.Stdout))
-	logger = log.With(logger, "ts", log.DefaultTimestampUTC, "caller", log.DefaultCaller)
+	logOutput := os.Stdout
+	if *outputStdout {
+		// Keep standard output to the targets.
+		logOutput = os.Stderr
+	}
+	logger, err = newLogger(logOutput, *logFormat, *logLevel)
+	if err != nil {
+		fmt.Println("err: ", err)
+		os.Exit(1)
+	}
+
+	cfg, err := parseConfig()
+	if err != nil {
+		level.Error(logger).Log("msg", "Invalid configuration", "err", err)
+		os.Exit(1)
+	}
 
 	ctx := context.Background()
 
-	cfg := parseConfig()
+	if *configPrint {
+		if err := printConfig(os.Stdout, cfg); err != nil {
+			fmt.Println("err: ", err)
+			os.Exit(1)
+		}
+		return
+	}
 	disc, err := oci.NewDiscovery(cfg, logger)
 
 	if err != nil {
 		fmt.Println("err: ", err)
+		os.Exit(1)
+	}
+
+	if *oneshot {
+		mode, err := strconv.ParseUint(*outputMode, 8, 32)
+		if err != nil {
+			fmt.Println("err: invalid output mode: ", err)
+			os.Exit(1)
+		}
+		tgs, err := disc.Refresh()
+		if err != nil {
+			fmt.Println("err: ", err)
+			os.Exit(1)
+		}
+		if *outputStdout {
+			err = oci.EncodeFileSD(os.Stdout, tgs)
+		} else {
+			err = oci.WriteFileSD(*outputFile, os.FileMode(mode), tgs)
+		}
+		if err != nil {
+			fmt.Println("err: ", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *listenAddress != "" {
+		go func() {
+			if err := http.ListenAndServe(*listenAddress, webHandler(disc)); err != nil {
+				level.Error(logger).Log("msg", "Serving readiness failed", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+	if *outputStdout {
+		writeTargets(ctx, os.Stdout, disc)
+		return
 	}
 	sdAdapter := adapter.NewAdapter(ctx, *outputFile, "exampleSD", disc, logger)
 	sdAdapter.Run()
@@ -0,0 +1,108 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/neumayer/ocidiscover/oci"
+	"github.com/neumayer/ocidiscover/oci/ocitest"
+	"github.com/prometheus/prometheus/util/testutil"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestNewLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "json", "info")
+	testutil.Ok(t, err)
+
+	level.Debug(logger).Log("msg", "hidden")
+	level.Info(logger).Log("msg", "shown", "count", 2)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	testutil.Equals(t, 1, len(lines))
+	var entry map[string]interface{}
+	testutil.Ok(t, json.Unmarshal([]byte(lines[0]), &entry))
+	testutil.Equals(t, "shown", entry["msg"])
+	testutil.Equals(t, "info", entry["level"])
+	testutil.Equals(t, float64(2), entry["count"])
+}
+
+func TestNewLoggerInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := newLogger(&buf, "xml", "info")
+	testutil.NotOk(t, err, "expected invalid logger configuration to fail")
+	_, err = newLogger(&buf, "json", "trace")
+	testutil.NotOk(t, err, "expected invalid logger configuration to fail")
+}
+
+func TestPrintConfig(t *testing.T) {
+	_, err := a.Parse([]string{"--sd.port=9100", "--sd.display_name=db", "--scope.file=oci/testdata/scope.yml"})
+	testutil.Ok(t, err)
+
+	cfg, err := parseConfig()
+	testutil.Ok(t, err)
+	var buf bytes.Buffer
+	testutil.Ok(t, printConfig(&buf, cfg))
+	var printed oci.SDConfig
+	testutil.Ok(t, yaml.Unmarshal(buf.Bytes(), &printed))
+	// The port comes from the flags, the rest from the scope file overriding
+	// them.
+	testutil.Equals(t, 9100, printed.Port)
+	testutil.Equals(t, "web", printed.DisplayName)
+	testutil.Equals(t, "ocid1.compartment.oc1..prod", printed.RootCompartmentID)
+	testutil.Equals(t, []string{"prod"}, printed.RootChildNames)
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	_, err := a.Parse([]string{"--sd.compartment_id=compartment_id1", "--sd.root_compartment_id=root_compartment_id"})
+	testutil.Ok(t, err)
+	_, err = parseConfig()
+	testutil.NotOk(t, err, "expected a compartment and a root compartment to be rejected")
+
+	_, err = a.Parse([]string{"--sd.compartment_id=compartment_id1", "--sd.search_query=query instance resources"})
+	testutil.Ok(t, err)
+	_, err = parseConfig()
+	testutil.NotOk(t, err, "expected a search query with a compartment to be rejected")
+
+	_, err = a.Parse([]string{"--scope.file=oci/testdata/missing.yml"})
+	testutil.Ok(t, err)
+	_, err = parseConfig()
+	testutil.NotOk(t, err, "expected a missing scope file to be rejected")
+}
+
+func TestWebHandlerReadiness(t *testing.T) {
+	conf := oci.DefaultSDConfig
+	conf.CompartmentID = "compartment_id1"
+	conf.Port = 9100
+	disc, err := oci.NewDiscovery(conf, nil, oci.WithClient(ocitest.SingleCompartment("compartment_id1", 1)))
+	testutil.Ok(t, err)
+	handler := webHandler(disc)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/-/ready", nil))
+	testutil.Equals(t, http.StatusServiceUnavailable, rec.Code)
+
+	_, err = disc.Refresh()
+	testutil.Ok(t, err)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/-/ready", nil))
+	testutil.Equals(t, http.StatusOK, rec.Code)
+}
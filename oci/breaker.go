@@ -0,0 +1,48 @@
+package oci
+
+import (
+	"sync"
+	"time"
+)
+
+// compartmentBreaker skips compartments that keep failing for a cooldown
+// period, so that a compartment that can't be read, e.g. for lack of
+// permissions, doesn't burn the API budget on every refresh. Compartments are
+// identified by tenancy and compartment id.
+type compartmentBreaker struct {
+	mtx       sync.Mutex
+	failures  map[string]int
+	openUntil map[string]time.Time
+}
+
+// allow reports whether the compartment is to be refreshed at now. Once its
+// cooldown is over a compartment is tried again, and a single further failure
+// opens the breaker again.
+func (b *compartmentBreaker) allow(key string, now time.Time) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return !now.Before(b.openUntil[key])
+}
+
+// record records the outcome of refreshing the compartment at now, opening
+// the breaker for cooldown once threshold consecutive refreshes failed. It
+// reports whether the breaker was opened.
+func (b *compartmentBreaker) record(key string, err error, threshold int, cooldown time.Duration, now time.Time) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if err == nil {
+		delete(b.failures, key)
+		delete(b.openUntil, key)
+		return false
+	}
+	if b.failures == nil {
+		b.failures = map[string]int{}
+		b.openUntil = map[string]time.Time{}
+	}
+	b.failures[key]++
+	if b.failures[key] < threshold {
+		return false
+	}
+	b.openUntil[key] = now.Add(cooldown)
+	return true
+}
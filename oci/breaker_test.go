@@ -0,0 +1,97 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+// brokenCompartmentOciClientWrapper fails listing the instances of the
+// compartments in broken.
+type brokenCompartmentOciClientWrapper struct {
+	treeOciClientWrapper
+	broken map[string]bool
+}
+
+func (w brokenCompartmentOciClientWrapper) ListInstances(ctx context.Context, compartmentID *string, filter instanceFilter) (*instanceResponse, error) {
+	if w.broken[*compartmentID] {
+		return nil, errors.New("not authorized")
+	}
+	return w.treeOciClientWrapper.ListInstances(ctx, compartmentID, filter)
+}
+
+func TestCompartmentBreaker(t *testing.T) {
+	var b compartmentBreaker
+	now := time.Now()
+	err := errors.New("not authorized")
+	testutil.Assert(t, !b.record("a", err, 2, time.Minute, now), "expected the breaker to stay closed")
+	testutil.Assert(t, b.allow("a", now), "expected the compartment to be allowed")
+	testutil.Assert(t, b.record("a", err, 2, time.Minute, now), "expected the breaker to open")
+	testutil.Assert(t, !b.allow("a", now.Add(time.Second)), "expected the compartment to be skipped")
+	testutil.Assert(t, b.allow("b", now), "expected other compartments to be allowed")
+	testutil.Assert(t, b.allow("a", now.Add(time.Minute)), "expected the compartment to be allowed after the cooldown")
+	testutil.Assert(t, b.record("a", err, 2, time.Minute, now.Add(time.Minute)), "expected the breaker to open again")
+
+	b.record("a", nil, 2, time.Minute, now.Add(2*time.Minute))
+	testutil.Assert(t, b.allow("a", now.Add(2*time.Minute)), "expected the compartment to be allowed")
+	testutil.Assert(t, !b.record("a", err, 2, time.Minute, now.Add(2*time.Minute)), "expected a success to reset the failures")
+}
+
+func TestRefreshCompartmentBreaker(t *testing.T) {
+	clientWrapper := brokenCompartmentOciClientWrapper{
+		treeOciClientWrapper: treeOciClientWrapper{
+			compartmentIDs: []string{"a", "b"},
+			instances: map[string][]Instance{
+				"a": {{ID: "instance_id1", CompartmentID: "a", PrivateIP: "10.0.0.1"}},
+				"b": {{ID: "instance_id2", CompartmentID: "b", PrivateIP: "10.0.0.2"}},
+			},
+		},
+		broken: map[string]bool{"b": true},
+	}
+	discovery := Discovery{
+		settings: settings{
+			rootCompartmentID: "root_compartment_id1",
+			port:              testInstancePort,
+			logger:            log.NewNopLogger(),
+			ociClientWrapper:  clientWrapper,
+			breakerThreshold:  2,
+			breakerCooldown:   time.Hour,
+		},
+	}
+	skipped := promtestutil.ToFloat64(ociSDCompartmentsSkippedCount)
+	failures := promtestutil.ToFloat64(ociSDCompartmentFailuresCount)
+	// The healthy compartment keeps its targets while the broken one's
+	// failures add up.
+	for i := 0; i < 2; i++ {
+		testutil.Equals(t, i, discovery.breaker.failures["/b"])
+		tgs, err := discovery.refresh()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(tgs))
+		testutil.Equals(t, model.LabelValue("instance_id1"), tgs[0].Labels[ociInstanceID])
+	}
+	testutil.Equals(t, failures+2, promtestutil.ToFloat64(ociSDCompartmentFailuresCount))
+
+	// The broken compartment is skipped for the cooldown.
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(tgs))
+	testutil.Equals(t, model.LabelValue("instance_id1"), tgs[0].Labels[ociInstanceID])
+	testutil.Equals(t, skipped+1, promtestutil.ToFloat64(ociSDCompartmentsSkippedCount))
+
+	// After the cooldown it is tried again, and found fixed.
+	testutil.Equals(t, 1, len(discovery.breaker.openUntil))
+	for key := range discovery.breaker.openUntil {
+		discovery.breaker.openUntil[key] = time.Now()
+	}
+	delete(clientWrapper.broken, "b")
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+	testutil.Equals(t, 0, len(discovery.breaker.failures))
+}
@@ -0,0 +1,103 @@
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+)
+
+// cacheContent is what the warm-start cache file holds: the target groups of
+// the last successful refresh and when it happened.
+type cacheContent struct {
+	Time   time.Time    `json:"time"`
+	Groups []cacheGroup `json:"groups"`
+}
+
+// cacheGroup is the cached representation of a target group. Unlike the
+// file_sd format it keeps the source, so cached groups replace each other the
+// same way live ones do, and the labels of individual targets.
+type cacheGroup struct {
+	Source       string              `json:"source"`
+	Targets      []string            `json:"targets"`
+	TargetLabels []map[string]string `json:"target_labels,omitempty"`
+	Labels       map[string]string   `json:"labels,omitempty"`
+}
+
+// saveCache writes the target groups of a refresh finished at now to filename.
+func saveCache(filename string, now time.Time, tgs []*targetgroup.Group) error {
+	content := cacheContent{Time: now, Groups: make([]cacheGroup, 0, len(tgs))}
+	for _, tg := range tgs {
+		group := cacheGroup{
+			Source:  tg.Source,
+			Targets: make([]string, 0, len(tg.Targets)),
+			Labels:  make(map[string]string, len(tg.Labels)),
+		}
+		targetLabels := make([]map[string]string, 0, len(tg.Targets))
+		hasTargetLabels := false
+		for _, target := range tg.Targets {
+			group.Targets = append(group.Targets, string(target[model.AddressLabel]))
+			labels := map[string]string{}
+			for name, value := range target {
+				if name != model.AddressLabel {
+					labels[string(name)] = string(value)
+				}
+			}
+			targetLabels = append(targetLabels, labels)
+			hasTargetLabels = hasTargetLabels || len(labels) > 0
+		}
+		if hasTargetLabels {
+			group.TargetLabels = targetLabels
+		}
+		for name, value := range tg.Labels {
+			group.Labels[string(name)] = string(value)
+		}
+		content.Groups = append(content.Groups, group)
+	}
+	b, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, 0644, b)
+}
+
+// loadCache reads the target groups cached in filename. Caches older than
+// maxAge at now are rejected, a maxAge of 0 accepts caches of any age.
+func loadCache(filename string, maxAge time.Duration, now time.Time) ([]*targetgroup.Group, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var content cacheContent
+	if err := json.Unmarshal(b, &content); err != nil {
+		return nil, fmt.Errorf("error parsing cache file %s: %s", filename, err)
+	}
+	if age := now.Sub(content.Time); maxAge > 0 && age > maxAge {
+		return nil, fmt.Errorf("cache file %s is %s old, more than the maximum of %s", filename, age, maxAge)
+	}
+	tgs := make([]*targetgroup.Group, 0, len(content.Groups))
+	for _, group := range content.Groups {
+		tg := &targetgroup.Group{
+			Source:  group.Source,
+			Targets: make([]model.LabelSet, 0, len(group.Targets)),
+			Labels:  make(model.LabelSet, len(group.Labels)),
+		}
+		for i, target := range group.Targets {
+			labels := model.LabelSet{model.AddressLabel: model.LabelValue(target)}
+			if i < len(group.TargetLabels) {
+				for name, value := range group.TargetLabels[i] {
+					labels[model.LabelName(name)] = model.LabelValue(value)
+				}
+			}
+			tg.Targets = append(tg.Targets, labels)
+		}
+		for name, value := range group.Labels {
+			tg.Labels[model.LabelName(name)] = model.LabelValue(value)
+		}
+		tgs = append(tgs, tg)
+	}
+	return tgs, nil
+}
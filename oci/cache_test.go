@@ -0,0 +1,109 @@
+package oci
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestCacheSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ocidiscover")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "cache.json")
+
+	tgs := []*targetgroup.Group{{
+		Source:  "instance_id1",
+		Targets: []model.LabelSet{{model.AddressLabel: "10.0.0.1:9100"}},
+		Labels:  model.LabelSet{ociInstanceID: "instance_id1"},
+	}}
+	now := time.Now()
+	testutil.Ok(t, saveCache(filename, now, tgs))
+
+	loaded, err := loadCache(filename, time.Hour, now.Add(time.Minute))
+	testutil.Ok(t, err)
+	testutil.Equals(t, tgs, loaded)
+
+	_, err = loadCache(filename, time.Hour, now.Add(2*time.Hour))
+	testutil.NotOk(t, err, "expected a stale cache to be rejected")
+
+	loaded, err = loadCache(filename, 0, now.Add(2*time.Hour))
+	testutil.Ok(t, err)
+	testutil.Equals(t, tgs, loaded)
+
+	grouped := []*targetgroup.Group{{
+		Source: "OCI_AD_AD-1",
+		Targets: []model.LabelSet{
+			{model.AddressLabel: "10.0.0.1:9100", ociInstanceID: "instance_id1"},
+			{model.AddressLabel: "10.0.0.2:9100", ociInstanceID: "instance_id2"},
+		},
+		Labels: model.LabelSet{ociAvailabilityDomain: "AD-1"},
+	}}
+	testutil.Ok(t, saveCache(filename, now, grouped))
+	loaded, err = loadCache(filename, time.Hour, now)
+	testutil.Ok(t, err)
+	testutil.Equals(t, grouped, loaded)
+
+	_, err = loadCache(filepath.Join(dir, "missing.json"), time.Hour, now)
+	testutil.Assert(t, os.IsNotExist(err), "expected a missing cache file to be reported as such, got %v", err)
+}
+
+func TestRunServesCachedTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ocidiscover")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "cache.json")
+
+	cached := []*targetgroup.Group{{
+		Source:  "cached_instance_id",
+		Targets: []model.LabelSet{{model.AddressLabel: "10.0.0.2:9100"}},
+		Labels:  model.LabelSet{ociInstanceID: "cached_instance_id"},
+	}}
+	testutil.Ok(t, saveCache(filename, time.Now(), cached))
+
+	discovery1 := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			interval:         10 * time.Millisecond,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: &failingOciClientWrapper{fail: true},
+			cacheFile:        filename,
+			cacheMaxAge:      time.Hour,
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan []*targetgroup.Group)
+	go discovery1.Run(ctx, ch)
+	testutil.Equals(t, cached, <-ch)
+	cancel()
+
+	discovery2 := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			interval:         time.Hour,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: &testOciClientWrapper{},
+			cacheFile:        filename,
+			cacheMaxAge:      time.Hour,
+		},
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go discovery2.Run(ctx, ch)
+	testutil.Equals(t, cached, <-ch)
+	checkTarget(t, <-ch)
+
+	loaded, err := loadCache(filename, time.Hour, time.Now())
+	testutil.Ok(t, err)
+	checkTarget(t, loaded)
+}
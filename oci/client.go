@@ -0,0 +1,129 @@
+package oci
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-kit/kit/log"
+)
+
+// Client is the part of the OCI APIs discovery needs, for tests and
+// embedders to discover instances without an OCI account, e.g. with the mock
+// in package ocitest.
+type Client interface {
+	// ListCompartments returns the compartments below the given root
+	// compartment, with their depth below it.
+	ListCompartments(ctx context.Context, rootCompartmentID string) ([]Compartment, error)
+	// GetCompartment returns the details of the given compartment.
+	GetCompartment(ctx context.Context, compartmentID string) (Compartment, error)
+	// ListInstances returns a page of the instances in the given compartment
+	// matching the filter, along with the token of the next page. The token
+	// is empty on the last page.
+	ListInstances(ctx context.Context, compartmentID string, filter InstanceFilter) ([]Instance, string, error)
+}
+
+// Compartment describes a compartment.
+type Compartment struct {
+	ID           string
+	Name         string
+	ParentID     string
+	FreeformTags map[string]string
+	// Depth is the depth of the compartment below the root compartment it
+	// was listed from, 1 for its children.
+	Depth int
+}
+
+// InstanceFilter holds the filters to list instances with. Empty fields
+// don't filter.
+type InstanceFilter struct {
+	DisplayName        string
+	AvailabilityDomain string
+	// Page is the token of the page to list, empty for the first page.
+	Page string
+}
+
+// NewDiscoveryWithClient returns a new Discovery which discovers instances
+// through client instead of the OCI APIs.
+//
+// Deprecated: use NewDiscovery with WithClient.
+func NewDiscoveryWithClient(conf SDConfig, logger log.Logger, client Client) (*Discovery, error) {
+	return NewDiscovery(conf, logger, WithClient(client))
+}
+
+// setClient makes d discover instances through client. Settings needing
+// other APIs, such as tenancies, search queries or namespaces, fail.
+func (d *Discovery) setClient(conf SDConfig, client Client) error {
+	if len(conf.Tenancies) > 0 || conf.AllSubscribedRegions {
+		return fmt.Errorf("OCI SD tenancies and subscribed regions need the OCI APIs")
+	}
+	d.ociClientWrapper = clientAdapter{client: client, recurse: conf.RecurseCompartments}
+	return nil
+}
+
+// clientAdapter discovers instances through a Client.
+type clientAdapter struct {
+	client Client
+	// recurse keeps the compartments below the children of the root
+	// compartment.
+	recurse bool
+}
+
+func (a clientAdapter) GetCompartmentIDs(ctx context.Context, rootCompartmentID *string) ([]compartmentRef, error) {
+	compartments, err := a.client.ListCompartments(ctx, stringValue(rootCompartmentID))
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]compartmentRef, 0, len(compartments))
+	for _, c := range compartments {
+		if c.Depth > 1 && !a.recurse {
+			continue
+		}
+		id := c.ID
+		refs = append(refs, compartmentRef{id: &id, depth: c.Depth})
+	}
+	return refs, nil
+}
+
+func (a clientAdapter) GetCompartment(ctx context.Context, compartmentID *string) (compartment, error) {
+	c, err := a.client.GetCompartment(ctx, stringValue(compartmentID))
+	if err != nil {
+		return compartment{}, err
+	}
+	return compartment{name: c.Name, freeformTags: c.FreeformTags, parentID: c.ParentID}, nil
+}
+
+func (a clientAdapter) ListInstances(ctx context.Context, compartmentID *string, filter instanceFilter) (*instanceResponse, error) {
+	instances, next, err := a.client.ListInstances(ctx, stringValue(compartmentID), InstanceFilter{
+		DisplayName:        stringValue(filter.displayName),
+		AvailabilityDomain: stringValue(filter.availabilityDomain),
+		Page:               stringValue(filter.page),
+	})
+	if err != nil {
+		return nil, err
+	}
+	response := &instanceResponse{Page: filter.page, instances: instances}
+	if next != "" {
+		response.OpcNextPage = &next
+	}
+	return response, nil
+}
+
+func (a clientAdapter) SearchInstances(ctx context.Context, query string) ([]Instance, error) {
+	return nil, fmt.Errorf("searching instances is not supported by %T", a.client)
+}
+
+func (a clientAdapter) GetNamespace(ctx context.Context) (string, error) {
+	return "", fmt.Errorf("looking up the namespace is not supported by %T", a.client)
+}
+
+func (a clientAdapter) GetTenancyName(ctx context.Context) (string, error) {
+	return "", fmt.Errorf("looking up the tenancy name is not supported by %T", a.client)
+}
+
+func (a clientAdapter) ListAvailabilityDomains(ctx context.Context, compartmentID *string) ([]string, error) {
+	return nil, fmt.Errorf("listing availability domains is not supported by %T", a.client)
+}
+
+func (a clientAdapter) ListRegionSubscriptions(ctx context.Context) ([]string, error) {
+	return nil, fmt.Errorf("listing region subscriptions is not supported by %T", a.client)
+}
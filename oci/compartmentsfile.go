@@ -0,0 +1,62 @@
+package oci
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// compartmentsFile holds the compartment ids last read from the file of
+// CompartmentIDsFile, which serve until it can be read again.
+type compartmentsFile struct {
+	mtx      sync.Mutex
+	filename string
+	ids      []string
+}
+
+// parseCompartmentIDs returns the compartment ids listed one per line in b.
+// Blank lines and lines starting with # are skipped.
+func parseCompartmentIDs(b []byte) []string {
+	ids := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ids = append(ids, line)
+	}
+	return ids
+}
+
+// fileCompartments reads the compartments to discover from the compartment
+// ids file. If the file can't be read, the compartments last read from it
+// are returned, and it is an error only if it was never read.
+func (d *Discovery) fileCompartments() ([]compartmentRef, error) {
+	file := &d.state().compartmentsFile
+	file.mtx.Lock()
+	defer file.mtx.Unlock()
+	if file.filename != d.compartmentIDsFile {
+		file.filename = d.compartmentIDsFile
+		file.ids = nil
+	}
+	b, err := ioutil.ReadFile(d.compartmentIDsFile)
+	if err == nil {
+		file.ids = parseCompartmentIDs(b)
+	} else if file.ids == nil {
+		return nil, fmt.Errorf("error reading compartment ids file: %s", err)
+	} else {
+		level.Warn(d.logger).Log("msg", "Error reading compartment ids file, keeping the compartments last read", "file", d.compartmentIDsFile, "err", err)
+	}
+	compartments := make([]compartmentRef, len(file.ids))
+	for i := range file.ids {
+		id := file.ids[i]
+		compartments[i] = compartmentRef{id: &id}
+	}
+	return compartments, nil
+}
@@ -0,0 +1,66 @@
+package oci
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestParseCompartmentIDs(t *testing.T) {
+	ids := parseCompartmentIDs([]byte("a\n\n  b  \n# c\nd"))
+	testutil.Equals(t, []string{"a", "b", "d"}, ids)
+	testutil.Equals(t, []string{}, parseCompartmentIDs(nil))
+}
+
+func TestRefreshCompartmentIDsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ocidiscover")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "compartments")
+
+	clientWrapper := treeOciClientWrapper{
+		instances: map[string][]Instance{
+			"a": {{ID: "instance_id1", CompartmentID: "a", PrivateIP: "10.0.0.1"}},
+			"b": {{ID: "instance_id2", CompartmentID: "b", PrivateIP: "10.0.0.2"}},
+		},
+	}
+	discovery := Discovery{
+		settings: settings{
+			compartmentIDsFile: filename,
+			port:               testInstancePort,
+			logger:             log.NewNopLogger(),
+			ociClientWrapper:   clientWrapper,
+		},
+	}
+	_, err = discovery.refresh()
+	testutil.NotOk(t, err, "expected the refresh to fail without the file")
+
+	testutil.Ok(t, ioutil.WriteFile(filename, []byte("a\n"), 0644))
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(tgs))
+	testutil.Equals(t, model.LabelValue("instance_id1"), tgs[0].Labels[ociInstanceID])
+
+	testutil.Ok(t, ioutil.WriteFile(filename, []byte("a\nb\n"), 0644))
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+
+	testutil.Ok(t, ioutil.WriteFile(filename, []byte("b\n"), 0644))
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(tgs))
+	testutil.Equals(t, model.LabelValue("instance_id2"), tgs[0].Labels[ociInstanceID])
+
+	// The compartments last read serve while the file can't be read.
+	testutil.Ok(t, os.Remove(filename))
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(tgs))
+	testutil.Equals(t, model.LabelValue("instance_id2"), tgs[0].Labels[ociInstanceID])
+}
@@ -0,0 +1,102 @@
+package oci
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+)
+
+const (
+	dedupKeyInstanceID = "instance_id"
+	dedupKeyAddress    = "address"
+	dedupKeyPrivateIP  = "private_ip"
+	dedupKeyPublicIP   = "public_ip"
+	// dedupKeyTagPrefix selects the value of a freeform tag, e.g.
+	// tag:hostname.
+	dedupKeyTagPrefix = "tag:"
+)
+
+// validateDedupKey checks that every attribute of a deduplication key is
+// known and given once.
+func validateDedupKey(key []string) error {
+	seen := map[string]bool{}
+	for _, attr := range key {
+		switch {
+		case attr == dedupKeyInstanceID, attr == dedupKeyAddress, attr == dedupKeyPrivateIP, attr == dedupKeyPublicIP:
+		case strings.HasPrefix(attr, dedupKeyTagPrefix) && len(attr) > len(dedupKeyTagPrefix):
+		default:
+			return fmt.Errorf("OCI SD dedup key attributes must be one of %s, %s, %s, %s or %s<key>, got %q", dedupKeyInstanceID, dedupKeyAddress, dedupKeyPrivateIP, dedupKeyPublicIP, dedupKeyTagPrefix, attr)
+		}
+		if seen[attr] {
+			return fmt.Errorf("OCI SD dedup key attribute %q given more than once", attr)
+		}
+		seen[attr] = true
+	}
+	return nil
+}
+
+// dedupLabel returns the label holding the value of a deduplication key
+// attribute.
+func (d *Discovery) dedupLabel(attr string) model.LabelName {
+	switch attr {
+	case dedupKeyInstanceID:
+		return ociInstanceID
+	case dedupKeyAddress:
+		return model.AddressLabel
+	case dedupKeyPrivateIP:
+		return ociPrivateIP
+	case dedupKeyPublicIP:
+		return ociPublicIP
+	}
+	key := strings.TrimPrefix(attr, dedupKeyTagPrefix)
+	if d.labelNameMode == labelNameModeUTF8 {
+		return ociTagLabel + model.LabelName(key)
+	}
+	return ociTagLabel + model.LabelName(d.sanitizeTagKey(key))
+}
+
+// dedup drops the target groups whose values of the deduplication key equal
+// those of an earlier group. Groups missing any of the attributes, including
+// groups with a placeholder address when deduplicating by address, are kept,
+// as there is nothing to tell them apart by.
+func (d *Discovery) dedup(tgs []*targetgroup.Group) []*targetgroup.Group {
+	if len(d.dedupKey) == 0 {
+		return tgs
+	}
+	seen := make(map[string]bool, len(tgs))
+	deduped := tgs[:0]
+	for _, tg := range tgs {
+		if key, ok := d.dedupValue(tg); ok {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		deduped = append(deduped, tg)
+	}
+	return deduped
+}
+
+// dedupValue joins the values of the deduplication key attributes of a
+// target group, reporting whether it has all of them.
+func (d *Discovery) dedupValue(tg *targetgroup.Group) (string, bool) {
+	values := make([]string, 0, len(d.dedupKey))
+	for _, attr := range d.dedupKey {
+		name := d.dedupLabel(attr)
+		value, ok := tg.Labels[name]
+		if !ok && len(tg.Targets) > 0 {
+			value, ok = tg.Targets[0][name]
+		}
+		if !ok || value == "" {
+			return "", false
+		}
+		if name == model.AddressLabel && tg.Labels[ociAddressResolved] == "false" {
+			// Placeholder addresses don't identify anything.
+			return "", false
+		}
+		values = append(values, string(value))
+	}
+	return strings.Join(values, "\x00"), true
+}
@@ -0,0 +1,77 @@
+package oci
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestRefreshDedup(t *testing.T) {
+	// The same instance shows up twice behind different hostnames, while
+	// another instance shares a hostname with it.
+	clientWrapper := &testOciClientWrapper{instances: []Instance{
+		{ID: "instance_id1", DisplayName: "web", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1", FreeformTags: map[string]string{"host-name": "web"}},
+		{ID: "instance_id1", DisplayName: "api", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1", FreeformTags: map[string]string{"host-name": "api"}},
+		{ID: "instance_id2", DisplayName: "web", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.2"},
+	}}
+	for _, tc := range []struct {
+		name     string
+		key      []string
+		expected []model.LabelValue
+	}{
+		{
+			name:     "none",
+			expected: []model.LabelValue{"web.example.com:9100", "api.example.com:9100", "web.example.com:9100"},
+		},
+		{
+			name:     "instance id",
+			key:      []string{dedupKeyInstanceID},
+			expected: []model.LabelValue{"web.example.com:9100", "web.example.com:9100"},
+		},
+		{
+			name:     "hostname",
+			key:      []string{dedupKeyAddress},
+			expected: []model.LabelValue{"web.example.com:9100", "api.example.com:9100"},
+		},
+		{
+			name:     "instance id and private ip",
+			key:      []string{dedupKeyInstanceID, dedupKeyPrivateIP},
+			expected: []model.LabelValue{"web.example.com:9100", "web.example.com:9100"},
+		},
+		{
+			// The last instance has no such tag and is kept.
+			name:     "tag",
+			key:      []string{"tag:host-name"},
+			expected: []model.LabelValue{"web.example.com:9100", "api.example.com:9100", "web.example.com:9100"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			discovery := Discovery{
+				settings: settings{
+					compartmentID:    testCompartmentID,
+					port:             testInstancePort,
+					logger:           log.NewNopLogger(),
+					ociClientWrapper: clientWrapper,
+					dedupKey:         tc.key,
+				},
+			}
+			discovery.addressBuilder = hostnameAddressBuilder{domain: "example.com"}
+			tgs, err := discovery.refresh()
+			testutil.Ok(t, err)
+			var addresses []model.LabelValue
+			for _, tg := range tgs {
+				addresses = append(addresses, tg.Targets[0][model.AddressLabel])
+			}
+			testutil.Equals(t, tc.expected, addresses)
+		})
+	}
+}
+
+func TestValidateDedupKey(t *testing.T) {
+	testutil.Ok(t, validateDedupKey([]string{dedupKeyInstanceID, dedupKeyAddress, "tag:hostname"}))
+	testutil.NotOk(t, validateDedupKey([]string{"hostname"}), "expected unknown attributes to be rejected")
+	testutil.NotOk(t, validateDedupKey([]string{"tag:"}), "expected tags without key to be rejected")
+	testutil.NotOk(t, validateDedupKey([]string{dedupKeyAddress, dedupKeyAddress}), "expected repeated attributes to be rejected")
+}
@@ -0,0 +1,44 @@
+package oci
+
+import "time"
+
+// RefreshEvent describes the outcome of a single refresh, e.g. for an audit
+// trail of discovery runs.
+type RefreshEvent struct {
+	// Time is when the refresh started.
+	Time     time.Time
+	Duration time.Duration
+	// Compartments and Instances count what the refresh looked at before
+	// any filtering, Targets the target groups it found. With retries on
+	// empty refreshes they describe the last attempt.
+	Compartments int
+	Instances    int
+	Targets      int
+	// Err is the error the refresh failed with, if any.
+	Err error
+}
+
+// SetRefreshEventHandler registers a function called with an event after
+// every refresh. It is called synchronously from the refresh, so it should
+// hand slow work off. It must be set before Run is called.
+//
+// Deprecated: use NewDiscovery with WithRefreshEventHandler.
+func (d *Discovery) SetRefreshEventHandler(f func(RefreshEvent)) {
+	d.refreshEvent = f
+}
+
+// emitRefreshEvent passes the outcome of a refresh to the refresh event
+// handler, if one is set.
+func (d *Discovery) emitRefreshEvent(start time.Time, stats refreshStats, targets int, err error) {
+	if d.refreshEvent == nil {
+		return
+	}
+	d.refreshEvent(RefreshEvent{
+		Time:         start,
+		Duration:     time.Since(start),
+		Compartments: stats.compartments,
+		Instances:    stats.instances,
+		Targets:      targets,
+		Err:          err,
+	})
+}
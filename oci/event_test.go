@@ -0,0 +1,59 @@
+package oci
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestRefreshEvent(t *testing.T) {
+	clientWrapper := treeOciClientWrapper{
+		compartmentIDs: []string{"a", "b"},
+		instances: map[string][]Instance{
+			"a": {
+				{ID: "instance_id1", CompartmentID: "a", PrivateIP: "10.0.0.1"},
+				{ID: "instance_id2", CompartmentID: "a", PrivateIP: "10.0.0.2"},
+			},
+			"b": {{ID: "instance_id3", CompartmentID: "b", PrivateIP: "10.0.0.3"}},
+		},
+	}
+	discovery := Discovery{
+		settings: settings{
+			rootCompartmentID: "root_compartment_id1",
+			port:              testInstancePort,
+			logger:            log.NewNopLogger(),
+			ociClientWrapper:  clientWrapper,
+		},
+	}
+	var events []RefreshEvent
+	discovery.refreshEvent = func(e RefreshEvent) {
+		events = append(events, e)
+	}
+
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(events))
+	testutil.Equals(t, 2, events[0].Compartments)
+	testutil.Equals(t, 3, events[0].Instances)
+	testutil.Equals(t, len(tgs), events[0].Targets)
+	testutil.Ok(t, events[0].Err)
+	testutil.Assert(t, !events[0].Time.IsZero(), "expected the refresh start time")
+
+	failing := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: &failingOciClientWrapper{fail: true},
+		},
+	}
+	failing.refreshEvent = func(e RefreshEvent) {
+		events = append(events, e)
+	}
+	_, err = failing.refresh()
+	testutil.NotOk(t, err, "expected the refresh to fail")
+	testutil.Equals(t, 2, len(events))
+	testutil.Equals(t, err, events[1].Err)
+	testutil.Equals(t, 0, events[1].Targets)
+}
@@ -0,0 +1,113 @@
+package oci
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+)
+
+// fileSDGroup is the file_sd representation of a target group.
+type fileSDGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// Refresh performs a single discovery run and returns its target groups.
+func (d *Discovery) Refresh() ([]*targetgroup.Group, error) {
+	return d.refresh()
+}
+
+// WriteFileSD writes the target groups to filename in the file_sd format.
+// The content is written to a temporary file in the same directory first and
+// then renamed into place, so Prometheus never reads a partially written file.
+// If the file already holds exactly the same content with the same mode it is
+// left untouched.
+func WriteFileSD(filename string, mode os.FileMode, tgs []*targetgroup.Group) error {
+	b, err := marshalFileSD(tgs)
+	if err != nil {
+		return err
+	}
+	if unchanged(filename, mode, b) {
+		ociSDSkippedUpdatesCount.Inc()
+		return nil
+	}
+	return writeFileAtomic(filename, mode, b)
+}
+
+// EncodeFileSD writes the target groups to w in the file_sd format, followed
+// by a newline, so that successive calls form a stream of JSON documents.
+func EncodeFileSD(w io.Writer, tgs []*targetgroup.Group) error {
+	b, err := marshalFileSD(tgs)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// unchanged reports whether filename exists with the given mode and content.
+func unchanged(filename string, mode os.FileMode, b []byte) bool {
+	info, err := os.Stat(filename)
+	if err != nil || info.Mode().Perm() != mode.Perm() {
+		return false
+	}
+	current, err := ioutil.ReadFile(filename)
+	return err == nil && bytes.Equal(current, b)
+}
+
+// marshalFileSD serializes the target groups in the file_sd format. Labels are
+// kept in maps, which encoding/json writes with sorted keys, so identical
+// target groups always serialize to identical bytes.
+func marshalFileSD(tgs []*targetgroup.Group) ([]byte, error) {
+	groups := make([]fileSDGroup, 0, len(tgs))
+	for _, tg := range tgs {
+		group := fileSDGroup{
+			Targets: make([]string, 0, len(tg.Targets)),
+			Labels:  make(map[string]string, len(tg.Labels)),
+		}
+		for _, target := range tg.Targets {
+			group.Targets = append(group.Targets, string(target[model.AddressLabel]))
+		}
+		for name, value := range tg.Labels {
+			group.Labels[string(name)] = string(value)
+		}
+		groups = append(groups, group)
+	}
+	return json.MarshalIndent(groups, "", "    ")
+}
+
+func writeFileAtomic(filename string, mode os.FileMode, b []byte) (err error) {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = f.Write(b); err != nil {
+		return err
+	}
+	if err = f.Chmod(mode); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
@@ -0,0 +1,140 @@
+package oci
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestWriteFileSD(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ocidiscover")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "custom_sd.json")
+
+	testutil.Ok(t, WriteFileSD(filename, 0640, []*targetgroup.Group{expectedTargetGroup}))
+	info, err := os.Stat(filename)
+	testutil.Ok(t, err)
+	testutil.Equals(t, os.FileMode(0640), info.Mode().Perm())
+
+	var groups []fileSDGroup
+	b, err := ioutil.ReadFile(filename)
+	testutil.Ok(t, err)
+	testutil.Ok(t, json.Unmarshal(b, &groups))
+	testutil.Equals(t, 1, len(groups))
+	testutil.Equals(t, []string{"127.0.0.1:9100"}, groups[0].Targets)
+	testutil.Equals(t, testInstanceID, groups[0].Labels[ociInstanceID])
+
+	// A reader holding the old file keeps seeing complete old content while
+	// the new file is swapped in.
+	old, err := os.Open(filename)
+	testutil.Ok(t, err)
+	defer old.Close()
+	testutil.Ok(t, WriteFileSD(filename, 0644, []*targetgroup.Group{}))
+
+	oldContent, err := ioutil.ReadAll(old)
+	testutil.Ok(t, err)
+	testutil.Equals(t, b, oldContent)
+	b, err = ioutil.ReadFile(filename)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "[]", string(b))
+	info, err = os.Stat(filename)
+	testutil.Ok(t, err)
+	testutil.Equals(t, os.FileMode(0644), info.Mode().Perm())
+
+	files, err := ioutil.ReadDir(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(files))
+}
+
+func TestEncodeFileSD(t *testing.T) {
+	var stdout bytes.Buffer
+	testutil.Ok(t, EncodeFileSD(&stdout, []*targetgroup.Group{expectedTargetGroup}))
+	testutil.Ok(t, EncodeFileSD(&stdout, []*targetgroup.Group{}))
+
+	// Every refresh is a JSON document of its own.
+	decoder := json.NewDecoder(&stdout)
+	var groups []fileSDGroup
+	testutil.Ok(t, decoder.Decode(&groups))
+	testutil.Equals(t, 1, len(groups))
+	testutil.Equals(t, []string{"127.0.0.1:9100"}, groups[0].Targets)
+	testutil.Ok(t, decoder.Decode(&groups))
+	testutil.Equals(t, 0, len(groups))
+	testutil.Assert(t, !decoder.More(), "expected no further documents")
+}
+
+func TestWriteFileSDUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ocidiscover")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "custom_sd.json")
+	tgs := []*targetgroup.Group{expectedTargetGroup}
+
+	skipped := promtestutil.ToFloat64(ociSDSkippedUpdatesCount)
+	testutil.Ok(t, WriteFileSD(filename, 0644, tgs))
+	first, err := os.Stat(filename)
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, WriteFileSD(filename, 0644, tgs))
+	second, err := os.Stat(filename)
+	testutil.Ok(t, err)
+	if !os.SameFile(first, second) {
+		t.Error("expected unchanged targets not to replace the output file")
+	}
+	testutil.Equals(t, skipped+1, promtestutil.ToFloat64(ociSDSkippedUpdatesCount))
+
+	// A different mode is a change that has to be written.
+	testutil.Ok(t, WriteFileSD(filename, 0600, tgs))
+	third, err := os.Stat(filename)
+	testutil.Ok(t, err)
+	testutil.Equals(t, os.FileMode(0600), third.Mode().Perm())
+	testutil.Equals(t, skipped+1, promtestutil.ToFloat64(ociSDSkippedUpdatesCount))
+}
+
+func TestMarshalFileSDStable(t *testing.T) {
+	discovery := &Discovery{
+		settings: settings{
+			compartmentID: testCompartmentID,
+			port:          testInstancePort,
+			logger:        log.NewNopLogger(),
+			ociClientWrapper: &testOciClientWrapper{instances: []Instance{{
+				ID:            testInstanceID,
+				DisplayName:   testInstanceDisplayName,
+				CompartmentID: testCompartmentID,
+				PrivateIP:     testInstancePrivateIP,
+				FreeformTags:  map[string]string{"zone": "a", "app": "web", "team": "sre", "env": "prod"},
+			}}},
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	first, err := marshalFileSD(tgs)
+	testutil.Ok(t, err)
+	for i := 0; i < 10; i++ {
+		tgs, err := discovery.refresh()
+		testutil.Ok(t, err)
+		b, err := marshalFileSD(tgs)
+		testutil.Ok(t, err)
+		testutil.Equals(t, string(first), string(b))
+	}
+
+	// Label names appear in sorted order.
+	var names []string
+	for _, line := range strings.Split(string(first), "\n") {
+		if i := strings.Index(line, `"__`); i >= 0 {
+			names = append(names, line[i:strings.Index(line, `":`)])
+		}
+	}
+	testutil.Equals(t, true, len(names) > 1)
+	testutil.Equals(t, true, sort.StringsAreSorted(names))
+}
@@ -0,0 +1,61 @@
+package oci
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+)
+
+// removalGrace keeps target groups that disappear from a refresh around for a
+// grace period, so instances briefly missing from listings don't flap.
+type removalGrace struct {
+	mtx  sync.Mutex
+	seen map[string]seenGroup
+}
+
+// seenGroup is a target group along with when a refresh last found it.
+type seenGroup struct {
+	group    *targetgroup.Group
+	lastSeen time.Time
+}
+
+// apply records the target groups found by a refresh at now and returns them
+// along with copies of the groups last found less than period ago, labeled as
+// stale. Groups are identified by their source.
+func (g *removalGrace) apply(tgs []*targetgroup.Group, period time.Duration, now time.Time) []*targetgroup.Group {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if g.seen == nil {
+		g.seen = map[string]seenGroup{}
+	}
+	found := make(map[string]bool, len(tgs))
+	for _, tg := range tgs {
+		found[tg.Source] = true
+		g.seen[tg.Source] = seenGroup{group: tg, lastSeen: now}
+	}
+	var stale []string
+	for source, s := range g.seen {
+		if found[source] {
+			continue
+		}
+		if now.Sub(s.lastSeen) >= period {
+			delete(g.seen, source)
+			continue
+		}
+		stale = append(stale, source)
+	}
+	sort.Strings(stale)
+	for _, source := range stale {
+		s := g.seen[source]
+		tg := &targetgroup.Group{
+			Source:  source,
+			Targets: s.group.Targets,
+			Labels:  s.group.Labels.Clone(),
+		}
+		tg.Labels[ociStale] = "true"
+		tgs = append(tgs, tg)
+	}
+	return tgs
+}
@@ -0,0 +1,79 @@
+package oci
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestRemovalGrace(t *testing.T) {
+	group := func(source string) *targetgroup.Group {
+		return &targetgroup.Group{
+			Source:  source,
+			Targets: []model.LabelSet{{model.AddressLabel: model.LabelValue(source + ":9100")}},
+			Labels:  model.LabelSet{ociInstanceID: model.LabelValue(source)},
+		}
+	}
+	sources := func(tgs []*targetgroup.Group) []string {
+		var s []string
+		for _, tg := range tgs {
+			s = append(s, tg.Source)
+		}
+		return s
+	}
+	var g removalGrace
+	now := time.Now()
+	period := time.Minute
+
+	tgs := g.apply([]*targetgroup.Group{group("a"), group("b")}, period, now)
+	testutil.Equals(t, []string{"a", "b"}, sources(tgs))
+
+	// A disappeared group is kept within the grace period, labeled as stale.
+	tgs = g.apply([]*targetgroup.Group{group("a")}, period, now.Add(30*time.Second))
+	testutil.Equals(t, []string{"a", "b"}, sources(tgs))
+	_, ok := tgs[0].Labels[ociStale]
+	testutil.Assert(t, !ok, "expected found groups not to be stale")
+	testutil.Equals(t, model.LabelValue("true"), tgs[1].Labels[ociStale])
+	testutil.Equals(t, model.LabelValue("b"), tgs[1].Labels[ociInstanceID])
+	testutil.Equals(t, group("b").Targets, tgs[1].Targets)
+
+	// It is removed once the grace period since it was last found is over.
+	tgs = g.apply([]*targetgroup.Group{group("a")}, period, now.Add(time.Minute))
+	testutil.Equals(t, []string{"a"}, sources(tgs))
+
+	// Reappearing groups are no longer stale.
+	g.apply([]*targetgroup.Group{group("a")}, period, now.Add(2*time.Minute))
+	tgs = g.apply([]*targetgroup.Group{group("a"), group("b")}, period, now.Add(3*time.Minute))
+	testutil.Equals(t, []string{"a", "b"}, sources(tgs))
+	_, ok = tgs[1].Labels[ociStale]
+	testutil.Assert(t, !ok, "expected reappeared groups not to be stale")
+}
+
+func TestRefreshTargetRemovalGracePeriod(t *testing.T) {
+	clientWrapper := &testOciClientWrapper{instances: []Instance{
+		{ID: "instance_id1", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1"},
+		{ID: "instance_id2", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.2"},
+	}}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:            testCompartmentID,
+			port:                     testInstancePort,
+			logger:                   log.NewNopLogger(),
+			ociClientWrapper:         clientWrapper,
+			targetRemovalGracePeriod: time.Hour,
+		},
+	}
+	_, err := discovery.refresh()
+	testutil.Ok(t, err)
+
+	clientWrapper.instances = clientWrapper.instances[:1]
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+	testutil.Equals(t, model.LabelValue("instance_id2"), tgs[1].Labels[ociInstanceID])
+	testutil.Equals(t, model.LabelValue("true"), tgs[1].Labels[ociStale])
+}
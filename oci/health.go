@@ -0,0 +1,78 @@
+package oci
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// HealthState describes whether a discovery is serving up to date targets.
+type HealthState int
+
+const (
+	// HealthUnready means no refresh has succeeded yet.
+	HealthUnready HealthState = iota
+	// HealthDegraded means the latest refreshes failed, but targets of an
+	// earlier successful refresh are still being served.
+	HealthDegraded
+	// HealthReady means the latest refresh succeeded.
+	HealthReady
+)
+
+func (s HealthState) String() string {
+	switch s {
+	case HealthUnready:
+		return "unready"
+	case HealthDegraded:
+		return "degraded"
+	case HealthReady:
+		return "ready"
+	}
+	return fmt.Sprintf("HealthState(%d)", int(s))
+}
+
+// health tracks the outcome of refreshes.
+type health struct {
+	mtx                 sync.Mutex
+	succeeded           bool
+	consecutiveFailures int
+}
+
+func (h *health) record(err error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if err != nil {
+		h.consecutiveFailures++
+		return
+	}
+	h.succeeded = true
+	h.consecutiveFailures = 0
+}
+
+// Health returns the health state of the discovery along with the number of
+// refreshes that failed since the last successful one.
+func (d *Discovery) Health() (HealthState, int) {
+	d.health.mtx.Lock()
+	defer d.health.mtx.Unlock()
+	switch {
+	case !d.health.succeeded:
+		return HealthUnready, d.health.consecutiveFailures
+	case d.health.consecutiveFailures > 0:
+		return HealthDegraded, d.health.consecutiveFailures
+	}
+	return HealthReady, 0
+}
+
+// ReadinessHandler returns an HTTP handler reporting the health state. It
+// responds with 503 Service Unavailable until a refresh has succeeded, and
+// with 200 OK afterwards, also while degraded so that orchestrators don't
+// restart a discovery that is merely serving stale targets.
+func (d *Discovery) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state, failures := d.Health()
+		if state == HealthUnready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprintf(w, "%s, %d consecutive refresh failures\n", state, failures)
+	})
+}
@@ -0,0 +1,68 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+// failingOciClientWrapper fails listing instances while fail is set.
+type failingOciClientWrapper struct {
+	testOciClientWrapper
+	fail bool
+}
+
+func (w *failingOciClientWrapper) ListInstances(ctx context.Context, compartmentID *string, filter instanceFilter) (*instanceResponse, error) {
+	if w.fail {
+		return nil, errors.New("list instances failed")
+	}
+	return w.testOciClientWrapper.ListInstances(ctx, compartmentID, filter)
+}
+
+func TestHealth(t *testing.T) {
+	clientWrapper := &failingOciClientWrapper{fail: true}
+	discovery := &Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	checkHealth := func(expectedState HealthState, expectedFailures, expectedStatus int) {
+		t.Helper()
+		state, failures := discovery.Health()
+		testutil.Equals(t, expectedState, state)
+		testutil.Equals(t, expectedFailures, failures)
+		rec := httptest.NewRecorder()
+		discovery.ReadinessHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/-/ready", nil))
+		testutil.Equals(t, expectedStatus, rec.Code)
+	}
+
+	checkHealth(HealthUnready, 0, http.StatusServiceUnavailable)
+	_, err := discovery.refresh()
+	testutil.NotOk(t, err, "expected refresh to fail")
+	checkHealth(HealthUnready, 1, http.StatusServiceUnavailable)
+
+	clientWrapper.fail = false
+	_, err = discovery.refresh()
+	testutil.Ok(t, err)
+	checkHealth(HealthReady, 0, http.StatusOK)
+
+	clientWrapper.fail = true
+	for i := 1; i <= 2; i++ {
+		_, err = discovery.refresh()
+		testutil.NotOk(t, err, "expected refresh to fail")
+		checkHealth(HealthDegraded, i, http.StatusOK)
+	}
+
+	clientWrapper.fail = false
+	_, err = discovery.refresh()
+	testutil.Ok(t, err)
+	checkHealth(HealthReady, 0, http.StatusOK)
+}
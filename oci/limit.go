@@ -0,0 +1,188 @@
+package oci
+
+import (
+	"context"
+
+	"github.com/oracle/oci-go-sdk/core"
+	"github.com/oracle/oci-go-sdk/identity"
+	"github.com/oracle/oci-go-sdk/objectstorage"
+	"github.com/oracle/oci-go-sdk/resourcesearch"
+)
+
+// requestLimiter bounds the number of OCI API requests in flight. Slots are
+// taken per request rather than per compartment or instance, so nested
+// compartment and instance fan-out sharing a limiter can't starve each
+// other.
+type requestLimiter chan struct{}
+
+func newRequestLimiter(limit int) requestLimiter {
+	if limit < 1 {
+		return nil
+	}
+	return make(requestLimiter, limit)
+}
+
+// acquire waits for a free slot. It fails if ctx is done first.
+func (l requestLimiter) acquire(ctx context.Context) error {
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l requestLimiter) release() {
+	<-l
+}
+
+// withRequestLimiter returns a copy of the client wrapper whose API requests
+// take a slot of l. A nil limiter leaves the requests unbounded.
+func (o remoteOciClientWrapper) withRequestLimiter(l requestLimiter) remoteOciClientWrapper {
+	if l == nil {
+		return o
+	}
+	o.ociIdentityClient = limitedIdentityClient{o.ociIdentityClient, l}
+	o.ociResourceSearchClient = limitedResourceSearchClient{o.ociResourceSearchClient, l}
+	o.ociComputeClient = limitedComputeClient{o.ociComputeClient, l}
+	o.ociVirtualNetworkClient = limitedVirtualNetworkClient{o.ociVirtualNetworkClient, l}
+	o.ociObjectStorageClient = limitedObjectStorageClient{o.ociObjectStorageClient, l}
+	return o
+}
+
+type limitedIdentityClient struct {
+	client  identityClient
+	limiter requestLimiter
+}
+
+func (c limitedIdentityClient) ListCompartments(ctx context.Context, request identity.ListCompartmentsRequest) (identity.ListCompartmentsResponse, error) {
+	if err := c.limiter.acquire(ctx); err != nil {
+		return identity.ListCompartmentsResponse{}, err
+	}
+	defer c.limiter.release()
+	return c.client.ListCompartments(ctx, request)
+}
+
+func (c limitedIdentityClient) GetCompartment(ctx context.Context, request identity.GetCompartmentRequest) (identity.GetCompartmentResponse, error) {
+	if err := c.limiter.acquire(ctx); err != nil {
+		return identity.GetCompartmentResponse{}, err
+	}
+	defer c.limiter.release()
+	return c.client.GetCompartment(ctx, request)
+}
+
+func (c limitedIdentityClient) ListAvailabilityDomains(ctx context.Context, request identity.ListAvailabilityDomainsRequest) (identity.ListAvailabilityDomainsResponse, error) {
+	if err := c.limiter.acquire(ctx); err != nil {
+		return identity.ListAvailabilityDomainsResponse{}, err
+	}
+	defer c.limiter.release()
+	return c.client.ListAvailabilityDomains(ctx, request)
+}
+
+func (c limitedIdentityClient) ListRegionSubscriptions(ctx context.Context, request identity.ListRegionSubscriptionsRequest) (identity.ListRegionSubscriptionsResponse, error) {
+	if err := c.limiter.acquire(ctx); err != nil {
+		return identity.ListRegionSubscriptionsResponse{}, err
+	}
+	defer c.limiter.release()
+	return c.client.ListRegionSubscriptions(ctx, request)
+}
+
+func (c limitedIdentityClient) GetTenancy(ctx context.Context, request identity.GetTenancyRequest) (identity.GetTenancyResponse, error) {
+	if err := c.limiter.acquire(ctx); err != nil {
+		return identity.GetTenancyResponse{}, err
+	}
+	defer c.limiter.release()
+	return c.client.GetTenancy(ctx, request)
+}
+
+type limitedComputeClient struct {
+	client  computeClient
+	limiter requestLimiter
+}
+
+func (c limitedComputeClient) ListInstances(ctx context.Context, request core.ListInstancesRequest) (core.ListInstancesResponse, error) {
+	if err := c.limiter.acquire(ctx); err != nil {
+		return core.ListInstancesResponse{}, err
+	}
+	defer c.limiter.release()
+	return c.client.ListInstances(ctx, request)
+}
+
+func (c limitedComputeClient) ListVnicAttachments(ctx context.Context, request core.ListVnicAttachmentsRequest) (core.ListVnicAttachmentsResponse, error) {
+	if err := c.limiter.acquire(ctx); err != nil {
+		return core.ListVnicAttachmentsResponse{}, err
+	}
+	defer c.limiter.release()
+	return c.client.ListVnicAttachments(ctx, request)
+}
+
+func (c limitedComputeClient) GetInstance(ctx context.Context, request core.GetInstanceRequest) (core.GetInstanceResponse, error) {
+	if err := c.limiter.acquire(ctx); err != nil {
+		return core.GetInstanceResponse{}, err
+	}
+	defer c.limiter.release()
+	return c.client.GetInstance(ctx, request)
+}
+
+func (c limitedComputeClient) ListBootVolumeAttachments(ctx context.Context, request core.ListBootVolumeAttachmentsRequest) (core.ListBootVolumeAttachmentsResponse, error) {
+	if err := c.limiter.acquire(ctx); err != nil {
+		return core.ListBootVolumeAttachmentsResponse{}, err
+	}
+	defer c.limiter.release()
+	return c.client.ListBootVolumeAttachments(ctx, request)
+}
+
+type limitedResourceSearchClient struct {
+	client  resourceSearchClient
+	limiter requestLimiter
+}
+
+func (c limitedResourceSearchClient) SearchResources(ctx context.Context, request resourcesearch.SearchResourcesRequest) (resourcesearch.SearchResourcesResponse, error) {
+	if err := c.limiter.acquire(ctx); err != nil {
+		return resourcesearch.SearchResourcesResponse{}, err
+	}
+	defer c.limiter.release()
+	return c.client.SearchResources(ctx, request)
+}
+
+type limitedObjectStorageClient struct {
+	client  objectStorageClient
+	limiter requestLimiter
+}
+
+func (c limitedObjectStorageClient) GetNamespace(ctx context.Context, request objectstorage.GetNamespaceRequest) (objectstorage.GetNamespaceResponse, error) {
+	if err := c.limiter.acquire(ctx); err != nil {
+		return objectstorage.GetNamespaceResponse{}, err
+	}
+	defer c.limiter.release()
+	return c.client.GetNamespace(ctx, request)
+}
+
+type limitedVirtualNetworkClient struct {
+	client  virtualNetworkClient
+	limiter requestLimiter
+}
+
+func (c limitedVirtualNetworkClient) GetVnic(ctx context.Context, request core.GetVnicRequest) (core.GetVnicResponse, error) {
+	if err := c.limiter.acquire(ctx); err != nil {
+		return core.GetVnicResponse{}, err
+	}
+	defer c.limiter.release()
+	return c.client.GetVnic(ctx, request)
+}
+
+func (c limitedVirtualNetworkClient) ListPrivateIps(ctx context.Context, request core.ListPrivateIpsRequest) (core.ListPrivateIpsResponse, error) {
+	if err := c.limiter.acquire(ctx); err != nil {
+		return core.ListPrivateIpsResponse{}, err
+	}
+	defer c.limiter.release()
+	return c.client.ListPrivateIps(ctx, request)
+}
+
+func (c limitedVirtualNetworkClient) GetSubnet(ctx context.Context, request core.GetSubnetRequest) (core.GetSubnetResponse, error) {
+	if err := c.limiter.acquire(ctx); err != nil {
+		return core.GetSubnetResponse{}, err
+	}
+	defer c.limiter.release()
+	return c.client.GetSubnet(ctx, request)
+}
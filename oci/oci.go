@@ -3,14 +3,27 @@ package oci
 import (
 	"context"
 	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/oracle/oci-go-sdk/common"
-	"github.com/oracle/oci-go-sdk/common/auth"
 	"github.com/oracle/oci-go-sdk/core"
 	"github.com/oracle/oci-go-sdk/identity"
+	"github.com/oracle/oci-go-sdk/objectstorage"
+	"github.com/oracle/oci-go-sdk/resourcesearch"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 
@@ -19,12 +32,69 @@ import (
 )
 
 const (
-	ociLabel           = model.MetaLabelPrefix + "oci_"
-	ociInstanceID      = ociLabel + "instance_id"
-	ociDisplayName     = ociLabel + "display_name"
-	ociCompartmentID   = ociLabel + "compartment_id"
-	ociCompartmentName = ociLabel + "compartment_name"
-	ociTagLabel        = ociLabel + "tag_"
+	defaultProfile = "DEFAULT"
+
+	// searchResourceTypeInstance is the resource type of compute instances
+	// in resource search results.
+	searchResourceTypeInstance = "Instance"
+
+	// principalRefreshRetryDelay is the base delay before retrying a call
+	// with refreshed instance principals. Up to the same amount of jitter is
+	// added so adapters sharing a rotation don't retry in lockstep.
+	principalRefreshRetryDelay = time.Second
+
+	// clientTimeout matches the OCI SDK's default request timeout.
+	clientTimeout = 60 * time.Second
+
+	// commercialRealm is the second-level domain the SDK resolves all
+	// endpoints in.
+	commercialRealm = "oraclecloud.com"
+
+	ociLabel              = model.MetaLabelPrefix + "oci_"
+	ociInstanceID         = ociLabel + "instance_id"
+	ociDisplayName        = ociLabel + "display_name"
+	ociCompartmentID      = ociLabel + "compartment_id"
+	ociCompartmentName    = ociLabel + "compartment_name"
+	ociTenancyID          = ociLabel + "tenancy_id"
+	ociFingerprint        = ociLabel + "fingerprint"
+	ociIsPrimaryIP        = ociLabel + "is_primary_ip"
+	ociRole               = ociLabel + "role"
+	ociDisplayNameFilter  = ociLabel + "display_name_filter"
+	ociVNICError          = ociLabel + "vnic_error"
+	ociPrivateIP          = ociLabel + "private_ip"
+	ociPublicIP           = ociLabel + "public_ip"
+	ociVNICCount          = ociLabel + "vnic_count"
+	ociNamespace          = ociLabel + "namespace"
+	ociAvailabilityDomain = ociLabel + "availability_domain"
+	ociIsHomeRegion       = ociLabel + "is_home_region"
+	ociCompartmentDepth   = ociLabel + "compartment_depth"
+	ociBootVolumeID       = ociLabel + "boot_volume_id"
+	ociScrapeable         = ociLabel + "scrapeable"
+	ociInstanceState      = ociLabel + "instance_state"
+	ociStale              = ociLabel + "stale"
+	ociParentCompartment  = ociLabel + "parent_compartment_id"
+	ociConsoleURL         = ociLabel + "console_url"
+	ociShard              = ociLabel + "shard"
+	ociShape              = ociLabel + "shape"
+	ociShapeFamily        = ociLabel + "shape_family"
+	ociAddressResolved    = ociLabel + "address_resolved"
+	ociSubnetPublic       = ociLabel + "subnet_public"
+	ociTenancyName        = ociLabel + "tenancy_name"
+	ociRootName           = ociLabel + "root_compartment_name"
+	ociCompartmentSize    = ociLabel + "compartment_target_count"
+	ociCostCenter         = ociLabel + "cost_center"
+	ociRebootDue          = ociLabel + "time_maintenance_reboot_due"
+
+	labelNameModeSanitize = "sanitize"
+	labelNameModeUTF8     = "utf8"
+
+	groupByInstance           = "instance"
+	groupByAvailabilityDomain = "availability_domain"
+
+	addressPrivate         = "private"
+	addressPublic          = "public"
+	ociTagLabel            = ociLabel + "tag_"
+	ociCompartmentTagLabel = ociLabel + "compartment_tag_"
 )
 
 var (
@@ -38,27 +108,333 @@ var (
 			Name: "prometheus_sd_oci_refresh_duration",
 			Help: "The duration of a OCI-SD refresh in seconds.",
 		})
+	ociSDCompartments = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "prometheus_sd_oci_compartments",
+			Help: "The number of compartments found below the root compartment of a tenancy in the last OCI-SD refresh.",
+		},
+		[]string{"tenancy"})
+	ociSDCompartmentDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "prometheus_sd_oci_compartment_depth",
+			Help: "The maximum depth below the root compartment of a tenancy reached in the last OCI-SD refresh.",
+		},
+		[]string{"tenancy"})
+	ociSDCompartmentsSkippedCount = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "prometheus_sd_oci_compartments_skipped_total",
+			Help: "The number of times OCI-SD skipped a compartment that kept failing.",
+		})
+	ociSDCompartmentFailuresCount = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "prometheus_sd_oci_compartment_failures_total",
+			Help: "The number of times OCI-SD failed to refresh a compartment and kept the targets of the others.",
+		})
+	ociSDTargetsOverLimit = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "prometheus_sd_oci_targets_over_limit",
+			Help: "The number of targets the last OCI-SD refresh found beyond the configured maximum.",
+		})
+	ociSDSkippedUpdatesCount = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "prometheus_sd_oci_skipped_updates_total",
+			Help: "The number of OCI-SD updates that were not sent or written because the targets were unchanged.",
+		})
+	ociSDVNICResolutionDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "prometheus_sd_oci_vnic_resolution_duration_seconds",
+			Help:    "The duration of resolving the VNICs of a single instance in OCI-SD.",
+			Buckets: prometheus.DefBuckets,
+		})
 	// DefaultSDConfig is the default OCI SD configuration.
 	DefaultSDConfig = SDConfig{
-		Port:                  80,
-		RefreshInterval:       model.Duration(60 * time.Second),
-		UseInstancePrincipals: true,
+		Port:                   80,
+		RefreshInterval:        model.Duration(60 * time.Second),
+		UseInstancePrincipals:  true,
+		CompartmentAccessLevel: string(identity.ListCompartmentsAccessLevelAccessible),
+		IncludeRootCompartment: true,
+		CompartmentConcurrency: 4,
+		InstanceConcurrency:    8,
+		CacheMaxAge:            model.Duration(time.Hour),
+		RetryOnEmptyDelay:      model.Duration(5 * time.Second),
 	}
 )
 
+// ociSDMetrics are the metrics of all discoveries.
+var ociSDMetrics = []prometheus.Collector{
+	ociSDRefreshFailuresCount,
+	ociSDRefreshDuration,
+	ociSDSkippedUpdatesCount,
+	ociSDCompartments,
+	ociSDCompartmentDepth,
+	ociSDTargetsOverLimit,
+	ociSDCompartmentsSkippedCount,
+	ociSDCompartmentFailuresCount,
+	ociSDVNICResolutionDuration,
+}
+
 func init() {
-	prometheus.MustRegister(ociSDRefreshFailuresCount)
-	prometheus.MustRegister(ociSDRefreshDuration)
+	prometheus.MustRegister(ociSDMetrics...)
 }
 
 // SDConfig is the configuration for OCI based service discovery.
 type SDConfig struct {
-	CompartmentID         string         `yaml:"compartment_id"`
-	RootCompartmentID     string         `yaml:"root_compartment_id"`
-	DisplayName           string         `yaml:"display_name"`
-	RefreshInterval       model.Duration `yaml:"refresh_interval,omitempty"`
-	Port                  int            `yaml:"port"`
-	UseInstancePrincipals bool           `yaml:"use_instance_principals,omitempty"`
+	CompartmentID          string          `yaml:"compartment_id"`
+	RootCompartmentID      string          `yaml:"root_compartment_id"`
+	DisplayName            string          `yaml:"display_name"`
+	RefreshInterval        model.Duration  `yaml:"refresh_interval,omitempty"`
+	Port                   int             `yaml:"port"`
+	UseInstancePrincipals  bool            `yaml:"use_instance_principals,omitempty"`
+	Tenancies              []TenancyConfig `yaml:"tenancies,omitempty"`
+	CompartmentAccessLevel string          `yaml:"compartment_access_level,omitempty"`
+	DefinedTagFilters      []string        `yaml:"defined_tag_filters,omitempty"`
+	IncludeSecondaryIPs    bool            `yaml:"include_secondary_ips,omitempty"`
+	RoleTag                string          `yaml:"role_tag,omitempty"`
+	AvailabilityDomain     string          `yaml:"availability_domain,omitempty"`
+	SkipVNICErrors         bool            `yaml:"skip_vnic_errors,omitempty"`
+	RegionalSource         bool            `yaml:"regional_source,omitempty"`
+	InstanceSortBy         string          `yaml:"instance_sort_by,omitempty"`
+	InstanceSortOrder      string          `yaml:"instance_sort_order,omitempty"`
+	InstancePageLimit      int             `yaml:"instance_page_limit,omitempty"`
+	// CompartmentIDsFile names a file listing the ids of the compartments
+	// to discover, one per line, instead of CompartmentID or
+	// RootCompartmentID. It is read again on every refresh, so compartments
+	// can be added and removed without a restart.
+	CompartmentIDsFile string `yaml:"compartment_ids_file,omitempty"`
+	// IncludeInactiveCompartments also discovers instances in compartments
+	// below the root compartment that are not ACTIVE.
+	IncludeInactiveCompartments bool `yaml:"include_inactive_compartments,omitempty"`
+	// RecurseCompartments discovers instances in the whole compartment tree
+	// below the root compartment instead of only in its direct children.
+	RecurseCompartments bool `yaml:"recurse_compartments,omitempty"`
+	// DisplayNameFilterLabel exposes the configured display name filter as
+	// a label on every target.
+	DisplayNameFilterLabel bool `yaml:"display_name_filter_label,omitempty"`
+	// AddressPreference lists the kinds of IP ("private" or "public") to
+	// scrape in order of preference, falling back to the next kind if an
+	// instance has no such IP. Defaults to the private IP.
+	AddressPreference []string `yaml:"address_preference,omitempty"`
+	// ScrapeHintTag is a freeform tag through which instances override the
+	// scheme, port and metrics path to scrape, given as
+	// [scheme:]port[/path], e.g. https:9443/metrics.
+	ScrapeHintTag string `yaml:"scrape_hint_tag,omitempty"`
+	// IncludeRootCompartment also discovers instances placed directly in
+	// the root compartment, e.g. the tenancy, rather than only in the
+	// compartments below it.
+	IncludeRootCompartment bool `yaml:"include_root_compartment"`
+	// MaxTargets caps the number of targets of a refresh, 0 means no limit.
+	// Targets beyond the limit are dropped, or fail the refresh if
+	// FailOnMaxTargets is set.
+	MaxTargets       int  `yaml:"max_targets,omitempty"`
+	FailOnMaxTargets bool `yaml:"fail_on_max_targets,omitempty"`
+	// HomeRegion is the home region of the tenancy. Identity calls are sent
+	// there, while instances are discovered in the configured region. When
+	// set, targets are labeled with whether their instance runs in it.
+	HomeRegion string `yaml:"home_region,omitempty"`
+	// PortFromDefinedTag names a defined tag, as namespace.key, holding the
+	// port to scrape an instance on instead of Port.
+	PortFromDefinedTag string `yaml:"port_from_defined_tag,omitempty"`
+	// CostCenterTag names a defined tag, as namespace.key, whose value
+	// labels targets as their cost center. Instances without the tag have no
+	// such label.
+	CostCenterTag string `yaml:"cost_center_tag,omitempty"`
+	// EmitCompartmentTags adds the freeform tags of a compartment as labels
+	// to all instances in it.
+	EmitCompartmentTags bool `yaml:"emit_compartment_tags,omitempty"`
+	// CompartmentTagFilters restricts discovery to compartments carrying all
+	// of the given freeform tags. The compartment tree is still walked below
+	// compartments that don't match.
+	CompartmentTagFilters map[string]string `yaml:"compartment_tag_filters,omitempty"`
+	// PortOptional leaves the port out of addresses, unless an instance sets
+	// one through its tags, so that relabeling can add it.
+	PortOptional bool `yaml:"port_optional,omitempty"`
+	// SearchQuery is a structured resource search query, e.g. "query
+	// instance resources where definedTags.namespace = 'ops'". If set,
+	// instances are found through the search service instead of by walking
+	// compartments, and no compartments may be configured.
+	SearchQuery string `yaml:"search_query,omitempty"`
+	// CompartmentConcurrency is the number of compartments whose instances
+	// are listed at the same time, InstanceConcurrency the number of
+	// instances whose VNICs are looked up at the same time per listing.
+	// Values below 1 mean one at a time.
+	CompartmentConcurrency int `yaml:"compartment_concurrency,omitempty"`
+	InstanceConcurrency    int `yaml:"instance_concurrency,omitempty"`
+	// CacheFile, if set, persists the targets of every successful refresh.
+	// They are loaded at startup and served until the first refresh
+	// succeeds, unless they are older than CacheMaxAge. A CacheMaxAge of 0
+	// serves cached targets of any age.
+	CacheFile   string         `yaml:"cache_file,omitempty"`
+	CacheMaxAge model.Duration `yaml:"cache_max_age,omitempty"`
+	// ValidateCredentialsOnStartup makes NewDiscovery fail if the configured
+	// compartments can't be read with the configured credentials.
+	ValidateCredentialsOnStartup bool `yaml:"validate_credentials_on_startup,omitempty"`
+	// EmitNamespace adds the object storage namespace of the tenancy as a
+	// label to all targets. It is looked up once per tenancy.
+	EmitNamespace bool `yaml:"emit_namespace,omitempty"`
+	// GroupBy is either instance, the default, to return a target group per
+	// target, or availability_domain to return a target group per
+	// availability domain. Grouped targets keep the labels that vary between
+	// them on the target, which the file_sd format can't represent, so file
+	// output only keeps the labels of the group.
+	GroupBy string `yaml:"group_by,omitempty"`
+	// MaxIdleConns and MaxIdleConnsPerHost limit the idle connections kept
+	// open to the OCI APIs, per tenancy. Zero keeps the limits of
+	// http.DefaultTransport.
+	MaxIdleConns        int `yaml:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost int `yaml:"max_idle_conns_per_host,omitempty"`
+	// RefreshTimeout bounds each refresh, in addition to the context passed
+	// to Run. Zero leaves refreshes bounded by that context only.
+	RefreshTimeout model.Duration `yaml:"refresh_timeout,omitempty"`
+	// RetryOnEmpty is the number of times a refresh finding no targets is
+	// retried, RetryOnEmptyDelay apart, before its result is accepted. Only
+	// refreshes following one that found targets are retried, so empty
+	// compartments cost a single retry at most.
+	RetryOnEmpty      int            `yaml:"retry_on_empty,omitempty"`
+	RetryOnEmptyDelay model.Duration `yaml:"retry_on_empty_delay,omitempty"`
+	// LabelNameMode controls how tag keys become label names. The default,
+	// sanitize, replaces characters not allowed in classic Prometheus label
+	// names with underscores. utf8 keeps tag keys as they are, for Prometheus
+	// versions supporting UTF-8 label names.
+	LabelNameMode string `yaml:"label_name_mode,omitempty"`
+	// RootChildNames limits the compartments walked below the root
+	// compartment to the direct children of the root with these names and
+	// the compartments below them.
+	RootChildNames []string `yaml:"root_child_names,omitempty"`
+	// EmitBootVolumeID labels targets with the boot volume of their
+	// instance, at the cost of an additional API call per instance.
+	EmitBootVolumeID bool `yaml:"emit_boot_volume_id,omitempty"`
+	// MetadataOnlyStates are the instance lifecycle states besides RUNNING
+	// to discover instances in, e.g. STOPPED for inventories. Once set, all
+	// targets are labeled with whether they can be scraped, so relabeling
+	// can drop the others. With MetadataOnlyOmitAddress their targets carry
+	// no address at all, which Prometheus drops unless relabeling sets one.
+	MetadataOnlyStates      []string `yaml:"metadata_only_states,omitempty"`
+	MetadataOnlyOmitAddress bool     `yaml:"metadata_only_omit_address,omitempty"`
+	// ScrapeableStates are the instance lifecycle states whose instances
+	// can be scraped, RUNNING if empty. Once set, instances are discovered
+	// in these states as well as in RUNNING and MetadataOnlyStates, and
+	// those in a state that isn't scrapeable are labeled as such and carry
+	// no address.
+	ScrapeableStates []string `yaml:"scrapeable_states,omitempty"`
+	// Realm is the second-level domain of the OCI endpoints, e.g.
+	// oraclegovcloud.com for government regions. The SDK only knows the
+	// commercial realm, so it has to be set for regions of other realms.
+	Realm string `yaml:"realm,omitempty"`
+	// RotateAvailabilityDomains discovers a single availability domain of
+	// each tenancy per refresh, rotating through them to spread API load.
+	// The targets of the other availability domains are those found by
+	// their last refresh, so it takes as many refreshes as there are
+	// availability domains until all changes show.
+	RotateAvailabilityDomains bool `yaml:"rotate_availability_domains,omitempty"`
+	// TargetRemovalGracePeriod keeps targets that disappear from a refresh
+	// for this long after they were last found, labeled as stale. This
+	// avoids flapping targets on transient API inconsistencies.
+	TargetRemovalGracePeriod model.Duration `yaml:"target_removal_grace_period,omitempty"`
+	// IPFilterCIDRs only keeps targets whose address is an IP in one of the
+	// given CIDRs, e.g. 10.0.1.0/24. Targets without an address are matched
+	// by their private IP.
+	IPFilterCIDRs []string `yaml:"ip_filter_cidrs,omitempty"`
+	// PreferredSubnetID picks the addresses of the VNIC on this subnet for
+	// instances with several VNICs, e.g. a management subnet. Instances
+	// without a VNIC on it keep their default addresses.
+	PreferredSubnetID string `yaml:"preferred_subnet_id,omitempty"`
+	// MaxConcurrentRequests caps the OCI API requests in flight across all
+	// compartments, instances and tenancies, for a predictable rate budget.
+	// Compartment and instance concurrency still bound the fan-out below
+	// it. 0 means no cap.
+	MaxConcurrentRequests int `yaml:"max_concurrent_requests,omitempty"`
+	// FailOnNoCompartments fails refreshes that find no compartments below
+	// the root compartment, which usually means missing permissions or a
+	// wrong root compartment id, instead of finding no targets.
+	FailOnNoCompartments bool `yaml:"fail_on_no_compartments,omitempty"`
+	// EmitConsoleURL labels targets with the URL of their instance in the
+	// OCI console, e.g. for links in alerts.
+	EmitConsoleURL bool `yaml:"emit_console_url,omitempty"`
+	// AllSubscribedRegions discovers instances in every region the tenancy
+	// is subscribed to instead of a single one, limited to the region names
+	// in RegionAllowlist, e.g. us-ashburn-1, if given.
+	AllSubscribedRegions bool     `yaml:"all_subscribed_regions,omitempty"`
+	RegionAllowlist      []string `yaml:"region_allowlist,omitempty"`
+	// PrincipalBootstrapTimeout bounds each attempt at fetching instance
+	// principal credentials from the instance metadata service, which can
+	// be slow on a freshly started instance. Failed attempts are retried
+	// PrincipalBootstrapRetries times. A timeout of 0 means no limit.
+	PrincipalBootstrapTimeout model.Duration `yaml:"principal_bootstrap_timeout,omitempty"`
+	PrincipalBootstrapRetries int            `yaml:"principal_bootstrap_retries,omitempty"`
+	// Shards, if set, labels targets with a shard between 0 and Shards-1
+	// derived from a hash of their instance id, for Prometheus replicas to
+	// keep their share of targets through relabeling. The hash doesn't
+	// depend on the process, so all replicas agree on it.
+	Shards int `yaml:"shards,omitempty"`
+	// DedupKey drops targets whose values of these attributes equal those
+	// of a target found before, e.g. instances reachable through several
+	// tenancies or compartments. Attributes are instance_id, address,
+	// private_ip, public_ip and tag:<key> for a freeform tag. Targets
+	// missing any of them are kept. Empty means no deduplication.
+	DedupKey []string `yaml:"dedup_key,omitempty"`
+	// SanitizedTagKeyPrefix is put in front of tag keys that start with a
+	// digit or an underscore once sanitized, such as keys starting with a
+	// character not allowed in label names, e.g. oci_ turns tag key 1foo
+	// into label __meta_oci_tag_oci_1foo rather than __meta_oci_tag_1foo.
+	// It doesn't apply in utf8 label name mode.
+	SanitizedTagKeyPrefix string `yaml:"sanitized_tag_key_prefix,omitempty"`
+	// LowercaseTagValues lowercases the values of the labels of instance and
+	// compartment freeform tags, saving relabel rules where tag values are
+	// expected to be lowercase.
+	LowercaseTagValues bool `yaml:"lowercase_tag_values,omitempty"`
+	// SortTargets sorts the targets of every refresh by tenancy, region,
+	// compartment and instance id, so that the output doesn't depend on the
+	// order concurrent listings complete in. Targets are otherwise kept in
+	// the order the APIs list them, which is cheaper for large fleets.
+	SortTargets bool `yaml:"sort_targets,omitempty"`
+	// EmitCompartmentTargetCount labels every target with the number of
+	// targets of a refresh in its compartment.
+	EmitCompartmentTargetCount bool `yaml:"emit_compartment_target_count,omitempty"`
+	// UsePrometheusTagNamespace reads how to scrape each instance from its
+	// defined tags in the prometheus namespace: port, scheme, path and
+	// enabled, which drops the instance if false. Invalid values keep the
+	// configured defaults. The scrape hint tag takes precedence.
+	UsePrometheusTagNamespace bool `yaml:"use_prometheus_tag_namespace,omitempty"`
+	// UnresolvedAddressPlaceholder is the address of targets for instances
+	// without a usable IP, which are skipped otherwise, so they show up as
+	// down targets. Once set, all targets are labeled with whether their
+	// address was resolved.
+	UnresolvedAddressPlaceholder string `yaml:"unresolved_address_placeholder,omitempty"`
+	// EmitSubnetPublic labels targets with whether the subnet of their
+	// address is public, i.e. allows public IPs on its VNICs. Each subnet is
+	// looked up once.
+	EmitSubnetPublic bool `yaml:"emit_subnet_public,omitempty"`
+	// EmitTenancyName adds the name of the tenancy the credentials belong
+	// to as a label to all targets. It is looked up once per tenancy.
+	EmitTenancyName bool `yaml:"emit_tenancy_name,omitempty"`
+	// EmitRootCompartmentName adds the name of the compartment discovery is
+	// scoped to, the root compartment if set, as a label to all targets. It
+	// is looked up once per tenancy.
+	EmitRootCompartmentName bool `yaml:"emit_root_compartment_name,omitempty"`
+	// CompartmentFailureThreshold is the number of consecutive refreshes a
+	// compartment below the root compartment may fail before it is skipped
+	// for CompartmentCooldown. After the cooldown it is tried again. If set,
+	// a failing compartment loses its targets instead of failing the
+	// refresh. 0 never skips compartments.
+	CompartmentFailureThreshold int            `yaml:"compartment_failure_threshold,omitempty"`
+	CompartmentCooldown         model.Duration `yaml:"compartment_cooldown,omitempty"`
+	// EmitVNICErrors keeps instances whose VNICs could not be resolved, with
+	// SkipVNICErrors, as targets labeled with the error. They get the
+	// unresolved address placeholder, or no address at all.
+	EmitVNICErrors bool `yaml:"emit_vnic_errors,omitempty"`
+}
+
+// TenancyConfig is the configuration for discovering instances in one of
+// several tenancies. Each tenancy brings its own credentials and region.
+type TenancyConfig struct {
+	TenancyID             string `yaml:"tenancy_id"`
+	CompartmentID         string `yaml:"compartment_id"`
+	RootCompartmentID     string `yaml:"root_compartment_id"`
+	Region                string `yaml:"region,omitempty"`
+	ConfigFile            string `yaml:"config_file,omitempty"`
+	Profile               string `yaml:"profile,omitempty"`
+	UseInstancePrincipals bool   `yaml:"use_instance_principals,omitempty"`
+	HomeRegion            string `yaml:"home_region,omitempty"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
@@ -69,8 +445,198 @@ func (c *SDConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err != nil {
 		return err
 	}
-	if c.RootCompartmentID == "" && c.CompartmentID == "" || c.RootCompartmentID != "" && c.CompartmentID != "" {
-		return fmt.Errorf("OCI SD configuration requires either a specific compartment id or the root compartment id (not both)")
+	return c.Validate()
+}
+
+// validMetadataOnlyState reports whether state is an instance lifecycle state
+// other than RUNNING.
+func validMetadataOnlyState(state string) bool {
+	return validInstanceState(state) && state != string(core.InstanceLifecycleStateRunning)
+}
+
+// validInstanceState reports whether state is an instance lifecycle state.
+func validInstanceState(state string) bool {
+	for _, s := range core.GetInstanceLifecycleStateEnumValues() {
+		if string(s) == state {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate returns an error if c isn't a valid configuration. A
+// configuration read from YAML is validated already.
+func (c *SDConfig) Validate() error {
+	switch identity.ListCompartmentsAccessLevelEnum(c.CompartmentAccessLevel) {
+	case "", identity.ListCompartmentsAccessLevelAny, identity.ListCompartmentsAccessLevelAccessible:
+	default:
+		return fmt.Errorf("OCI SD compartment access level must be one of %s or %s, got %q", identity.ListCompartmentsAccessLevelAny, identity.ListCompartmentsAccessLevelAccessible, c.CompartmentAccessLevel)
+	}
+	switch core.ListInstancesSortByEnum(c.InstanceSortBy) {
+	case "", core.ListInstancesSortByTimecreated, core.ListInstancesSortByDisplayname:
+	default:
+		return fmt.Errorf("OCI SD instance sort by must be one of %s or %s, got %q", core.ListInstancesSortByTimecreated, core.ListInstancesSortByDisplayname, c.InstanceSortBy)
+	}
+	switch core.ListInstancesSortOrderEnum(c.InstanceSortOrder) {
+	case "", core.ListInstancesSortOrderAsc, core.ListInstancesSortOrderDesc:
+	default:
+		return fmt.Errorf("OCI SD instance sort order must be one of %s or %s, got %q", core.ListInstancesSortOrderAsc, core.ListInstancesSortOrderDesc, c.InstanceSortOrder)
+	}
+	if c.CompartmentConcurrency < 0 || c.InstanceConcurrency < 0 {
+		return fmt.Errorf("OCI SD concurrency must not be negative")
+	}
+	if c.MaxIdleConns < 0 || c.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("OCI SD idle connection limits must not be negative")
+	}
+	if c.RetryOnEmpty < 0 || c.RetryOnEmptyDelay < 0 {
+		return fmt.Errorf("OCI SD retries on empty results must not be negative")
+	}
+	if c.MaxConcurrentRequests < 0 {
+		return fmt.Errorf("OCI SD max concurrent requests must not be negative, got %d", c.MaxConcurrentRequests)
+	}
+	if strutil.SanitizeLabelName(c.SanitizedTagKeyPrefix) != c.SanitizedTagKeyPrefix {
+		return fmt.Errorf("OCI SD sanitized tag key prefix must only contain letters, digits and underscores, got %q", c.SanitizedTagKeyPrefix)
+	}
+	if err := validateDedupKey(c.DedupKey); err != nil {
+		return err
+	}
+	if c.CompartmentFailureThreshold < 0 || c.CompartmentCooldown < 0 {
+		return fmt.Errorf("OCI SD compartment failure threshold and cooldown must not be negative")
+	}
+	if c.CompartmentFailureThreshold > 0 && c.CompartmentCooldown == 0 {
+		return fmt.Errorf("OCI SD compartment failure threshold requires a compartment cooldown")
+	}
+	if c.Shards < 0 {
+		return fmt.Errorf("OCI SD shards must not be negative, got %d", c.Shards)
+	}
+	if c.PrincipalBootstrapTimeout < 0 {
+		return fmt.Errorf("OCI SD principal bootstrap timeout must not be negative, got %s", c.PrincipalBootstrapTimeout)
+	}
+	if c.PrincipalBootstrapRetries < 0 {
+		return fmt.Errorf("OCI SD principal bootstrap retries must not be negative, got %d", c.PrincipalBootstrapRetries)
+	}
+	if c.TargetRemovalGracePeriod < 0 {
+		return fmt.Errorf("OCI SD target removal grace period must not be negative, got %s", c.TargetRemovalGracePeriod)
+	}
+	if c.RefreshTimeout < 0 {
+		return fmt.Errorf("OCI SD refresh timeout must not be negative, got %s", c.RefreshTimeout)
+	}
+	if c.CacheMaxAge < 0 {
+		return fmt.Errorf("OCI SD cache max age must not be negative, got %s", c.CacheMaxAge)
+	}
+	if len(c.RootChildNames) > 0 && c.RootCompartmentID == "" && len(c.Tenancies) == 0 {
+		return fmt.Errorf("OCI SD root child names require a root compartment id")
+	}
+	if len(c.RegionAllowlist) > 0 && !c.AllSubscribedRegions {
+		return fmt.Errorf("OCI SD region allowlist requires discovering all subscribed regions")
+	}
+	if c.AllSubscribedRegions && c.RotateAvailabilityDomains {
+		return fmt.Errorf("OCI SD availability domain rotation can't be combined with discovering all subscribed regions")
+	}
+	if c.RotateAvailabilityDomains && c.AvailabilityDomain != "" {
+		return fmt.Errorf("OCI SD availability domain rotation can't be combined with an availability domain filter")
+	}
+	for _, state := range c.MetadataOnlyStates {
+		if !validMetadataOnlyState(state) {
+			return fmt.Errorf("OCI SD configuration has invalid metadata only state %q", state)
+		}
+	}
+	metadataOnlyStates := stringSet(c.MetadataOnlyStates)
+	for _, state := range c.ScrapeableStates {
+		if !validInstanceState(state) {
+			return fmt.Errorf("OCI SD configuration has invalid scrapeable state %q", state)
+		}
+		if metadataOnlyStates[state] {
+			return fmt.Errorf("OCI SD state %s can't be both scrapeable and metadata only", state)
+		}
+	}
+	switch c.LabelNameMode {
+	case "", labelNameModeSanitize, labelNameModeUTF8:
+	default:
+		return fmt.Errorf("OCI SD configuration has invalid label_name_mode %q, must be %s or %s", c.LabelNameMode, labelNameModeSanitize, labelNameModeUTF8)
+	}
+	switch c.GroupBy {
+	case "", groupByInstance, groupByAvailabilityDomain:
+	default:
+		return fmt.Errorf("OCI SD configuration has invalid group_by %q, must be %s or %s", c.GroupBy, groupByInstance, groupByAvailabilityDomain)
+	}
+	if c.MaxTargets < 0 {
+		return fmt.Errorf("OCI SD max targets must not be negative, got %d", c.MaxTargets)
+	}
+	if c.InstancePageLimit < 0 {
+		return fmt.Errorf("OCI SD instance page limit must not be negative, got %d", c.InstancePageLimit)
+	}
+	preferred := map[string]bool{}
+	for _, kind := range c.AddressPreference {
+		if kind != addressPrivate && kind != addressPublic {
+			return fmt.Errorf("OCI SD address preference must only contain %q or %q, got %q", addressPrivate, addressPublic, kind)
+		}
+		if preferred[kind] {
+			return fmt.Errorf("OCI SD address preference contains %q more than once", kind)
+		}
+		preferred[kind] = true
+	}
+	for _, f := range c.DefinedTagFilters {
+		if _, err := parseDefinedTagFilter(f); err != nil {
+			return err
+		}
+	}
+	if c.EmitVNICErrors && !c.SkipVNICErrors {
+		return fmt.Errorf("OCI SD VNIC error labels require skipping VNIC errors")
+	}
+	if c.PortFromDefinedTag != "" {
+		if _, err := parseDefinedTagKey(c.PortFromDefinedTag); err != nil {
+			return err
+		}
+	}
+	if c.CostCenterTag != "" {
+		if _, err := parseDefinedTagKey(c.CostCenterTag); err != nil {
+			return err
+		}
+	}
+	if _, err := parseCIDRs(c.IPFilterCIDRs); err != nil {
+		return err
+	}
+	if c.SearchQuery != "" {
+		if c.RootCompartmentID != "" || c.CompartmentID != "" || c.CompartmentIDsFile != "" {
+			return fmt.Errorf("OCI SD search query can't be combined with compartment ids")
+		}
+		for _, t := range c.Tenancies {
+			if t.RootCompartmentID != "" || t.CompartmentID != "" {
+				return fmt.Errorf("OCI SD search query can't be combined with compartment ids of tenancy %s", t.TenancyID)
+			}
+		}
+	}
+	if len(c.Tenancies) == 0 {
+		if c.SearchQuery != "" {
+			return nil
+		}
+		if c.CompartmentIDsFile != "" {
+			if c.RootCompartmentID != "" || c.CompartmentID != "" {
+				return fmt.Errorf("OCI SD compartment ids file can't be combined with compartment ids")
+			}
+			return nil
+		}
+		if c.RootCompartmentID == "" && c.CompartmentID == "" || c.RootCompartmentID != "" && c.CompartmentID != "" {
+			return fmt.Errorf("OCI SD configuration requires either a specific compartment id or the root compartment id (not both)")
+		}
+		return nil
+	}
+	if c.RootCompartmentID != "" || c.CompartmentID != "" || c.CompartmentIDsFile != "" {
+		return fmt.Errorf("OCI SD configuration requires compartment ids to be set per tenancy when tenancies are configured")
+	}
+	seen := map[string]bool{}
+	for _, t := range c.Tenancies {
+		if t.TenancyID == "" {
+			return fmt.Errorf("OCI SD tenancy configuration requires a tenancy id")
+		}
+		if seen[t.TenancyID] {
+			return fmt.Errorf("OCI SD tenancy %s is configured more than once", t.TenancyID)
+		}
+		seen[t.TenancyID] = true
+		if c.SearchQuery == "" && (t.RootCompartmentID == "" && t.CompartmentID == "" || t.RootCompartmentID != "" && t.CompartmentID != "") {
+			return fmt.Errorf("OCI SD tenancy %s requires either a specific compartment id or the root compartment id (not both)", t.TenancyID)
+		}
 	}
 	return nil
 }
@@ -78,277 +644,2542 @@ func (c *SDConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 // Discovery periodically performs OCI-SD requests. It implements
 // the Discoverer interface.
 type Discovery struct {
+	// settings are what a refresh runs with, replaced as a whole by
+	// UpdateConfig.
+	settings
+	// compartmentsFile keeps the compartments last read from
+	// compartmentIDsFile.
+	compartmentsFile compartmentsFile
+	// rotation outlives configuration updates, rotateAvailabilityDomains
+	// is what turns it on.
+	rotation     adRotation
+	removalGrace removalGrace
+	// breaker outlives configuration updates, breakerThreshold is what
+	// turns it on.
+	breaker compartmentBreaker
+	// namespaces caches the object storage namespace of each tenancy by
+	// tenancy id for the lifetime of the discovery.
+	namespaces   map[string]string
+	namespaceMtx sync.Mutex
+	// lastTargets is the number of targets found by the last successful
+	// refresh.
+	lastTargets    int
+	lastTargetsMtx sync.Mutex
+	// compartmentNames maps the ids of the compartments looked at by the
+	// last successful refresh to their names.
+	compartmentNames    map[string]string
+	compartmentNamesMtx sync.Mutex
+	// tenancyNames caches the name of each tenancy by tenancy id for the
+	// lifetime of the discovery.
+	tenancyNames   map[string]string
+	tenancyNameMtx sync.Mutex
+	// rootNames caches the name of the compartment each tenancy is scoped
+	// to by tenancy and compartment id for the lifetime of the discovery.
+	rootNames   map[string]string
+	rootNameMtx sync.Mutex
+	// conf is the configuration the discovery currently runs with.
+	conf SDConfig
+	// mtx guards the settings replaced by UpdateConfig.
+	mtx          sync.RWMutex
+	health       health
+	refreshEvent func(RefreshEvent)
+
+	// base is the discovery a refresh snapshot was taken of, which holds
+	// the state that outlives refreshes.
+	base *Discovery
+
+	closeOnce sync.Once
+	closedMtx sync.Mutex
+	closed    chan struct{}
+}
+
+// settings are the settings of a Discovery that a refresh runs with.
+type settings struct {
+	compartmentID     string
+	rootCompartmentID string
+	// compartmentIDsFile names the file listing the compartments to
+	// discover.
+	compartmentIDsFile string
+	displayName        string
+	interval           time.Duration
+	port               int
+	logger             log.Logger
+	ociClientWrapper   ociClientWrapper
+	tenancies          []tenancy
+	definedTagFilters  []definedTagFilter
+	addressBuilder     AddressBuilder
+	// includeSecondaryIPs emits a target for each of an instance's
+	// secondary private IPs in addition to its primary one.
+	includeSecondaryIPs bool
+	roleTag             string
+	availabilityDomain  string
+	regionalSource      bool
+	// displayNameFilterLabel exposes displayName as a label on targets.
+	displayNameFilterLabel bool
+	addressPreference      []string
+	scrapeHintTag          string
+	includeRootCompartment bool
+	maxTargets             int
+	failOnMaxTargets       bool
+	// portDefinedTag is the defined tag to read the scrape port from, if
+	// its namespace is set.
+	portDefinedTag      definedTagKey
+	emitCompartmentTags bool
+	// costCenterTag is the defined tag to label the cost center with, if
+	// its namespace is set.
+	costCenterTag definedTagKey
+	// compartmentTagFilters are the freeform tags a compartment must carry
+	// for its instances to be discovered.
+	compartmentTagFilters map[string]string
+	portOptional          bool
+	// searchQuery replaces listing instances compartment by compartment
+	// with a resource search, if set.
+	searchQuery            string
+	compartmentConcurrency int
+	cacheFile              string
+	cacheMaxAge            time.Duration
+	emitNamespace          bool
+	emitTenancyName        bool
+	emitRootName           bool
+	groupBy                string
+	homeRegion             string
+	refreshTimeout         time.Duration
+	retryOnEmpty           int
+	labelNameMode          string
+	sanitizedTagKeyPrefix  string
+	lowercaseTagValues     bool
+	retryOnEmptyDelay      time.Duration
+	// metadataOnly is set if instances that aren't running are discovered.
+	metadataOnly            bool
+	metadataOnlyOmitAddress bool
+	// scrapeableStates are the lifecycle states whose instances get an
+	// address, RUNNING if empty.
+	scrapeableStates          map[string]bool
+	rotateAvailabilityDomains bool
+	targetRemovalGracePeriod  time.Duration
+	ipFilterNets              []*net.IPNet
+	failOnNoCompartments      bool
+	emitConsoleURL            bool
+	shards                    int
+	dedupKey                  []string
+	sortTargets               bool
+	emitCompartmentSize       bool
+	usePrometheusTagNamespace bool
+	unresolvedAddress         string
+	breakerThreshold          int
+	breakerCooldown           time.Duration
+	// regions is set if all subscribed regions of the implicit tenancy are
+	// discovered.
+	regions *regionalClients
+	// postProcessor, if set, gets to change the targets of every
+	// successful refresh.
+	postProcessor func([]*targetgroup.Group) []*targetgroup.Group
+	// emitVNICErrors keeps instances with unresolvable VNICs as targets.
+	emitVNICErrors bool
+}
+
+// snapshot returns a copy of the settings of the discovery for a refresh to
+// run with, so that UpdateConfig doesn't wait for refreshes to finish. State
+// that outlives refreshes, such as caches, stays with d.
+func (d *Discovery) snapshot() *Discovery {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	return &Discovery{
+		settings: d.settings,
+		base:     d.state(),
+	}
+}
+
+// state returns the discovery holding the state that outlives refreshes.
+func (d *Discovery) state() *Discovery {
+	if d.base != nil {
+		return d.base
+	}
+	return d
+}
+
+// SetAddressBuilder replaces the way scrape addresses are built for
+// discovered instances, e.g. for hostname based or NAT mapped addressing.
+//
+// Deprecated: use NewDiscovery with WithAddressBuilder.
+func (d *Discovery) SetAddressBuilder(b AddressBuilder) {
+	d.addressBuilder = b
+}
+
+// tenancy bundles a client wrapper with the compartments to discover in it.
+// An empty id denotes the single, implicitly configured tenancy.
+type tenancy struct {
+	id                string
 	compartmentID     string
 	rootCompartmentID string
-	displayName       string
-	interval          time.Duration
-	port              int
-	logger            log.Logger
 	ociClientWrapper  ociClientWrapper
+	homeRegion        string
+	// namespace is the object storage namespace of the tenancy, if it is
+	// emitted as a label, name the name of the tenancy likewise.
+	namespace string
+	name      string
+	// rootName is the name of the compartment discovery is scoped to, if it
+	// is emitted as a label.
+	rootName string
+	// availabilityDomain restricts a refresh to the availability domain
+	// whose turn it is when rotating through them.
+	availabilityDomain string
+	// regions is set if all subscribed regions of the tenancy are
+	// discovered.
+	regions *regionalClients
 }
 
 type ociClientWrapper interface {
-	// GetCompartmentIDs returns a slice of compartment ids for a given root compartment. Will return an empty slice if the given compartment id does not belong to a root compartment.
-	GetCompartmentIDs(ctx context.Context, rootCompartmentID *string) ([]*string, error)
-	// GetCompartmentName returns the name of the given compartment
-	GetCompartmentName(ctx context.Context, compartmentID *string) (string, error)
-	// ListInstances returns a slice of instance structs for instances matching compartmentID and displayName
-	ListInstances(ctx context.Context, compartmentID *string, displayName *string) (*instanceResponse, error)
+	// GetCompartmentIDs returns the compartments below a given root compartment along with their depth. Will return an empty slice if the given compartment id does not belong to a root compartment.
+	GetCompartmentIDs(ctx context.Context, rootCompartmentID *string) ([]compartmentRef, error)
+	// GetCompartment returns the details of the given compartment
+	GetCompartment(ctx context.Context, compartmentID *string) (compartment, error)
+	// ListInstances returns a slice of instance structs for instances in compartmentID matching the filter
+	ListInstances(ctx context.Context, compartmentID *string, filter instanceFilter) (*instanceResponse, error)
+	// SearchInstances returns the running instances found by a structured resource search query
+	SearchInstances(ctx context.Context, query string) ([]Instance, error)
+	// GetNamespace returns the object storage namespace of the tenancy
+	GetNamespace(ctx context.Context) (string, error)
+	// GetTenancyName returns the name of the tenancy
+	GetTenancyName(ctx context.Context) (string, error)
+	// ListAvailabilityDomains returns the names of the availability domains visible from compartmentID
+	ListAvailabilityDomains(ctx context.Context, compartmentID *string) ([]string, error)
+	// ListRegionSubscriptions returns the names of the regions the tenancy is subscribed to
+	ListRegionSubscriptions(ctx context.Context) ([]string, error)
+}
+
+// compartmentRef is a compartment found below a root compartment, along with
+// its depth in the compartment tree. The root has depth 0, its children depth
+// 1 and so on.
+type compartmentRef struct {
+	id    *string
+	depth int
+}
+
+// compartment holds the details of a compartment relevant for discovery.
+type compartment struct {
+	name         string
+	freeformTags map[string]string
+	// parentID is empty for the root compartment of a tenancy.
+	parentID string
+	// depth is the depth of the compartment below the root compartment
+	// discovery starts from, or -1 if unknown.
+	depth int
+}
+
+// instanceFilter holds the filters applied server side when listing
+// instances, along with the page of results to return.
+type instanceFilter struct {
+	displayName        *string
+	availabilityDomain *string
+	page               *string
+}
+
+// identityClient is the subset of identity.IdentityClient used for discovery.
+type identityClient interface {
+	ListCompartments(ctx context.Context, request identity.ListCompartmentsRequest) (identity.ListCompartmentsResponse, error)
+	GetCompartment(ctx context.Context, request identity.GetCompartmentRequest) (identity.GetCompartmentResponse, error)
+	ListAvailabilityDomains(ctx context.Context, request identity.ListAvailabilityDomainsRequest) (identity.ListAvailabilityDomainsResponse, error)
+	ListRegionSubscriptions(ctx context.Context, request identity.ListRegionSubscriptionsRequest) (identity.ListRegionSubscriptionsResponse, error)
+	GetTenancy(ctx context.Context, request identity.GetTenancyRequest) (identity.GetTenancyResponse, error)
+}
+
+// computeClient is the subset of core.ComputeClient used for discovery.
+type computeClient interface {
+	ListInstances(ctx context.Context, request core.ListInstancesRequest) (core.ListInstancesResponse, error)
+	ListVnicAttachments(ctx context.Context, request core.ListVnicAttachmentsRequest) (core.ListVnicAttachmentsResponse, error)
+	GetInstance(ctx context.Context, request core.GetInstanceRequest) (core.GetInstanceResponse, error)
+	ListBootVolumeAttachments(ctx context.Context, request core.ListBootVolumeAttachmentsRequest) (core.ListBootVolumeAttachmentsResponse, error)
+}
+
+// resourceSearchClient is the subset of resourcesearch.ResourceSearchClient used for discovery.
+type resourceSearchClient interface {
+	SearchResources(ctx context.Context, request resourcesearch.SearchResourcesRequest) (resourcesearch.SearchResourcesResponse, error)
+}
+
+// objectStorageClient is the subset of objectstorage.ObjectStorageClient used for discovery.
+type objectStorageClient interface {
+	GetNamespace(ctx context.Context, request objectstorage.GetNamespaceRequest) (objectstorage.GetNamespaceResponse, error)
+}
+
+// virtualNetworkClient is the subset of core.VirtualNetworkClient used for discovery.
+type virtualNetworkClient interface {
+	GetVnic(ctx context.Context, request core.GetVnicRequest) (core.GetVnicResponse, error)
+	ListPrivateIps(ctx context.Context, request core.ListPrivateIpsRequest) (core.ListPrivateIpsResponse, error)
+	GetSubnet(ctx context.Context, request core.GetSubnetRequest) (core.GetSubnetResponse, error)
 }
 
 type remoteOciClientWrapper struct {
-	ociIdentityClient       *identity.IdentityClient
-	ociComputeClient        *core.ComputeClient
-	ociVirtualNetworkClient *core.VirtualNetworkClient
+	ociIdentityClient       identityClient
+	ociResourceSearchClient resourceSearchClient
+	ociComputeClient        computeClient
+	ociVirtualNetworkClient virtualNetworkClient
+	ociObjectStorageClient  objectStorageClient
+	compartmentAccessLevel  identity.ListCompartmentsAccessLevelEnum
+	includeSecondaryIPs     bool
+	skipVNICErrors          bool
+	// includeInactiveCompartments keeps compartments that are not ACTIVE,
+	// e.g. ones being deleted, when listing compartments.
+	includeInactiveCompartments bool
+	// recurseCompartments walks the whole tree below the root compartment
+	// instead of only listing its children.
+	recurseCompartments bool
+	instanceSortBy      core.ListInstancesSortByEnum
+	instanceSortOrder   core.ListInstancesSortOrderEnum
+	instancePageLimit   int
+	instanceConcurrency int
+	rootChildNames      map[string]bool
+	emitBootVolumeID    bool
+	metadataOnlyStates  map[string]bool
+	scrapeableStates    map[string]bool
+	preferredSubnetID   string
+	emitSubnetPublic    bool
+	subnets             *subnetCache
+	// tenancyID is the tenancy the credentials belong to.
+	tenancyID string
+	transport *http.Transport
 }
 
-func (o remoteOciClientWrapper) GetCompartmentIDs(ctx context.Context, rootCompartmentID *string) ([]*string, error) {
-	listCompartmentsRequest := identity.ListCompartmentsRequest{
-		CompartmentId: rootCompartmentID,
+// GetCompartmentIDs returns the children of rootCompartmentID, or all
+// compartments in the tree below it if recursion is enabled. If root child
+// names are configured, only the children of the root with those names and
+// the compartments below them are returned.
+func (o remoteOciClientWrapper) GetCompartmentIDs(ctx context.Context, rootCompartmentID *string) ([]compartmentRef, error) {
+	compartmentIDs := []compartmentRef{}
+	var walk func(parentID *string, depth int) error
+	walk = func(parentID *string, depth int) error {
+		listCompartmentsRequest := identity.ListCompartmentsRequest{
+			CompartmentId: parentID,
+			AccessLevel:   o.compartmentAccessLevel,
+		}
+		listCompartmentsResponse, err := o.ociIdentityClient.ListCompartments(ctx, listCompartmentsRequest)
+		if err != nil {
+			return err
+		}
+		for _, compartmentItem := range listCompartmentsResponse.Items {
+			if !o.includeInactiveCompartments && compartmentItem.LifecycleState != identity.CompartmentLifecycleStateActive {
+				continue
+			}
+			if depth == 1 && len(o.rootChildNames) > 0 && !o.rootChildNames[stringValue(compartmentItem.Name)] {
+				continue
+			}
+			compartmentIDs = append(compartmentIDs, compartmentRef{id: compartmentItem.Id, depth: depth})
+			if !o.recurseCompartments {
+				continue
+			}
+			if err := walk(compartmentItem.Id, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
-	listCompartmentsResponse, err := o.ociIdentityClient.ListCompartments(ctx, listCompartmentsRequest)
-	if err != nil {
+	if err := walk(rootCompartmentID, 1); err != nil {
 		return nil, err
 	}
-	compartmentIDs := []*string{}
-	for _, compartmentItem := range listCompartmentsResponse.Items {
-		compartmentIDs = append(compartmentIDs, compartmentItem.Id)
-	}
 	return compartmentIDs, nil
 }
 
-func (o remoteOciClientWrapper) GetCompartmentName(ctx context.Context, compartmentID *string) (string, error) {
+func (o remoteOciClientWrapper) GetCompartment(ctx context.Context, compartmentID *string) (compartment, error) {
 	getCompartmentRequest := identity.GetCompartmentRequest{
 		CompartmentId: compartmentID,
 	}
 	getCompartmentResponse, err := o.ociIdentityClient.GetCompartment(ctx, getCompartmentRequest)
 	if err != nil {
-		return "", err
+		return compartment{}, err
 	}
-	return *getCompartmentResponse.Name, nil
+	return compartment{
+		name:         *getCompartmentResponse.Name,
+		freeformTags: getCompartmentResponse.FreeformTags,
+		parentID:     stringValue(getCompartmentResponse.CompartmentId),
+	}, nil
 }
 
-func (o remoteOciClientWrapper) ListInstances(ctx context.Context, compartmentID *string, displayName *string) (*instanceResponse, error) {
-	listInstancesRequest := core.ListInstancesRequest{
-		CompartmentId:  compartmentID,
-		LifecycleState: core.InstanceLifecycleStateRunning,
-	}
-	if displayName != nil {
-		listInstancesRequest.DisplayName = displayName
+// instance resolves the addresses of an instance returned by the compute API.
+func (o remoteOciClientWrapper) instance(ctx context.Context, instanceItem core.Instance) (Instance, error) {
+	t0 := time.Now()
+	defer func() {
+		ociSDVNICResolutionDuration.Observe(time.Since(t0).Seconds())
+	}()
+	vnicRequest := core.ListVnicAttachmentsRequest{
+		InstanceId:    instanceItem.Id,
+		CompartmentId: instanceItem.CompartmentId,
 	}
-
-	listInstancesResponse, err := o.ociComputeClient.ListInstances(ctx, listInstancesRequest)
-	if err != nil {
-		return nil, err
+	var vnicErr error
+	vnics, err := o.ociComputeClient.ListVnicAttachments(ctx, vnicRequest)
+	switch {
+	case err != nil && o.skipVNICErrors:
+		vnicErr = fmt.Errorf("error retrieving vnic attachments from OCI: %s", err)
+	case err != nil:
+		return Instance{}, fmt.Errorf("error retrieving vnic attachments from OCI: %s", err)
 	}
-	instances := []instance{}
-	for _, instanceItem := range listInstancesResponse.Items {
-		vnicRequest := core.ListVnicAttachmentsRequest{
-			InstanceId:    instanceItem.Id,
-			CompartmentId: compartmentID,
+	var privateIP, publicIP, subnetID string
+	var vnicIDs []*string
+	preferredSubnetFound := false
+	for _, vnicAttachmentItem := range vnics.Items {
+		vnicRequest := core.GetVnicRequest{
+			VnicId: vnicAttachmentItem.VnicId,
+		}
+		vnic, err := o.ociVirtualNetworkClient.GetVnic(ctx, vnicRequest)
+		if err != nil && o.skipVNICErrors {
+			// Addresses of VNICs resolved so far are dropped, the instance
+			// is only kept without any.
+			vnicErr = fmt.Errorf("error retrieving vnic from OCI: %s", err)
+			privateIP, publicIP, subnetID = "", "", ""
+			break
 		}
-		vnics, err := o.ociComputeClient.ListVnicAttachments(ctx, vnicRequest)
 		if err != nil {
-			return nil, fmt.Errorf("error retrieving vnic attachments from OCI: %s", err)
+			return Instance{}, fmt.Errorf("error retrieving vnic from OCI: %s", err)
 		}
-		var privateIP string
-		for _, vnicAttachmentItem := range vnics.Items {
-			vnicRequest := core.GetVnicRequest{
-				VnicId: vnicAttachmentItem.VnicId,
-			}
-			vnic, err := o.ociVirtualNetworkClient.GetVnic(ctx, vnicRequest)
-			if err != nil {
-				return nil, fmt.Errorf("error retrieving vnic from OCI: %s", err)
-			}
+		// Once found, the addresses of the VNIC on the preferred subnet
+		// are kept.
+		switch {
+		case preferredSubnetFound:
+		case o.preferredSubnetID != "" && stringValue(vnic.SubnetId) == o.preferredSubnetID:
+			preferredSubnetFound = true
+			privateIP = stringValue(vnic.PrivateIp)
+			publicIP = stringValue(vnic.PublicIp)
+			subnetID = stringValue(vnic.SubnetId)
+		default:
 			if vnic.PrivateIp != nil {
 				privateIP = *vnic.PrivateIp
+				subnetID = stringValue(vnic.SubnetId)
+			}
+			if vnic.PublicIp != nil {
+				publicIP = *vnic.PublicIp
 			}
 		}
-		instance := instance{
-			ID:            *instanceItem.Id,
-			privateIP:     privateIP,
-			DisplayName:   *instanceItem.DisplayName,
-			CompartmentID: *instanceItem.CompartmentId,
-			FreeformTags:  instanceItem.FreeformTags,
+		vnicIDs = append(vnicIDs, vnicAttachmentItem.VnicId)
+	}
+	var bootVolumeID string
+	if o.emitBootVolumeID {
+		if bootVolumeID, err = o.bootVolumeID(ctx, instanceItem); err != nil {
+			return Instance{}, err
 		}
-		instances = append(instances, instance)
 	}
-	instanceResponse := &instanceResponse{
-		instances: instances,
+	var subnetPublic *bool
+	if o.emitSubnetPublic && subnetID != "" && vnicErr == nil {
+		public, err := o.subnetPublic(ctx, subnetID)
+		switch {
+		case err != nil && o.skipVNICErrors:
+			vnicErr = fmt.Errorf("error retrieving subnet from OCI: %s", err)
+		case err != nil:
+			return Instance{}, fmt.Errorf("error retrieving subnet from OCI: %s", err)
+		default:
+			subnetPublic = &public
+		}
 	}
-	return instanceResponse, nil
-}
-
-// NewDiscovery returns a new Discovery which periodically refreshes its targets.
-func NewDiscovery(conf SDConfig, logger log.Logger) (*Discovery, error) {
-	if logger == nil {
-		logger = log.NewNopLogger()
+	var rebootDue *time.Time
+	if instanceItem.TimeMaintenanceRebootDue != nil {
+		due := instanceItem.TimeMaintenanceRebootDue.Time
+		rebootDue = &due
 	}
-	var err error
-
-	var config common.ConfigurationProvider
-	if conf.UseInstancePrincipals {
-		config, err = auth.InstancePrincipalConfigurationProvider()
+	var secondaryPrivateIPs []string
+	if o.includeSecondaryIPs && vnicErr == nil {
+		secondaryPrivateIPs, err = o.listSecondaryPrivateIPs(ctx, vnicIDs, privateIP)
 		if err != nil {
-			return nil, fmt.Errorf("error connecting to api using instance principals: %s", err)
+			return Instance{}, err
 		}
-	} else {
-		config = common.DefaultConfigProvider()
 	}
+	return Instance{
+		ID:                       *instanceItem.Id,
+		PrivateIP:                privateIP,
+		PublicIP:                 publicIP,
+		SecondaryPrivateIPs:      secondaryPrivateIPs,
+		DisplayName:              *instanceItem.DisplayName,
+		CompartmentID:            *instanceItem.CompartmentId,
+		AvailabilityDomain:       stringValue(instanceItem.AvailabilityDomain),
+		Region:                   stringValue(instanceItem.Region),
+		Shape:                    stringValue(instanceItem.Shape),
+		SubnetID:                 subnetID,
+		FreeformTags:             instanceItem.FreeformTags,
+		DefinedTags:              instanceItem.DefinedTags,
+		VNICCount:                len(vnics.Items),
+		BootVolumeID:             bootVolumeID,
+		LifecycleState:           string(instanceItem.LifecycleState),
+		TimeMaintenanceRebootDue: rebootDue,
+		subnetPublic:             subnetPublic,
+		vnicErr:                  vnicErr,
+		missingPreferredSubnet:   o.preferredSubnetID != "" && vnicErr == nil && !preferredSubnetFound,
+	}, nil
+}
 
-	computeClient, err := core.NewComputeClientWithConfigurationProvider(config)
+// bootVolumeID returns the id of the boot volume attached to the instance, or
+// an empty string if none is attached.
+func (o remoteOciClientWrapper) bootVolumeID(ctx context.Context, instanceItem core.Instance) (string, error) {
+	response, err := o.ociComputeClient.ListBootVolumeAttachments(ctx, core.ListBootVolumeAttachmentsRequest{
+		AvailabilityDomain: instanceItem.AvailabilityDomain,
+		CompartmentId:      instanceItem.CompartmentId,
+		InstanceId:         instanceItem.Id,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("error setting up compute client for OCI: %s", err)
+		return "", fmt.Errorf("error retrieving boot volume attachments from OCI: %s", err)
+	}
+	for _, attachment := range response.Items {
+		if attachment.LifecycleState == core.BootVolumeAttachmentLifecycleStateAttached {
+			return stringValue(attachment.BootVolumeId), nil
+		}
 	}
+	return "", nil
+}
 
-	identityClient, err := identity.NewIdentityClientWithConfigurationProvider(config)
+// GetNamespace returns the object storage namespace of the tenancy the
+// client authenticates against.
+func (o remoteOciClientWrapper) GetNamespace(ctx context.Context) (string, error) {
+	response, err := o.ociObjectStorageClient.GetNamespace(ctx, objectstorage.GetNamespaceRequest{})
 	if err != nil {
-		return nil, fmt.Errorf("error setting up vnic client for OCI: %s", err)
+		return "", fmt.Errorf("error retrieving object storage namespace from OCI: %s", err)
 	}
+	return stringValue(response.Value), nil
+}
 
-	virtualNetworkClient, err := core.NewVirtualNetworkClientWithConfigurationProvider(config)
+// GetTenancyName returns the name of the tenancy the client authenticates
+// against.
+func (o remoteOciClientWrapper) GetTenancyName(ctx context.Context) (string, error) {
+	response, err := o.ociIdentityClient.GetTenancy(ctx, identity.GetTenancyRequest{TenancyId: &o.tenancyID})
 	if err != nil {
-		return nil, fmt.Errorf("error setting up vnic client for OCI: %s", err)
+		return "", fmt.Errorf("error retrieving tenancy from OCI: %s", err)
 	}
+	return stringValue(response.Name), nil
+}
 
-	remoteOciClientWrapper := remoteOciClientWrapper{
-		ociComputeClient:        &computeClient,
-		ociIdentityClient:       &identityClient,
-		ociVirtualNetworkClient: &virtualNetworkClient,
+func (o remoteOciClientWrapper) ListAvailabilityDomains(ctx context.Context, compartmentID *string) ([]string, error) {
+	response, err := o.ociIdentityClient.ListAvailabilityDomains(ctx, identity.ListAvailabilityDomainsRequest{CompartmentId: compartmentID})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving availability domains from OCI: %s", err)
 	}
-
-	ociDiscovery := &Discovery{
-		compartmentID:     conf.CompartmentID,
-		rootCompartmentID: conf.RootCompartmentID,
-		displayName:       conf.DisplayName,
-		interval:          time.Duration(conf.RefreshInterval),
-		port:              conf.Port,
-		logger:            logger,
-		ociClientWrapper:  remoteOciClientWrapper,
+	names := make([]string, 0, len(response.Items))
+	for _, item := range response.Items {
+		names = append(names, stringValue(item.Name))
 	}
-	return ociDiscovery, nil
+	return names, nil
 }
 
-// Run implements the Discoverer interface.
-func (d *Discovery) Run(ctx context.Context, ch chan<- []*targetgroup.Group) {
-	tgs, err := d.refresh()
+// ListRegionSubscriptions returns the regions the tenancy is subscribed to,
+// leaving out those whose subscription isn't ready yet.
+func (o remoteOciClientWrapper) ListRegionSubscriptions(ctx context.Context) ([]string, error) {
+	response, err := o.ociIdentityClient.ListRegionSubscriptions(ctx, identity.ListRegionSubscriptionsRequest{TenancyId: &o.tenancyID})
 	if err != nil {
-		level.Error(d.logger).Log("msg", "Refresh failed", "err", err)
-	} else {
-		select {
-		case ch <- tgs:
-		case <-ctx.Done():
+		return nil, fmt.Errorf("error retrieving region subscriptions from OCI: %s", err)
+	}
+	var regions []string
+	for _, item := range response.Items {
+		if item.Status == identity.RegionSubscriptionStatusReady {
+			regions = append(regions, stringValue(item.RegionName))
 		}
 	}
+	return regions, nil
+}
 
-	ticker := time.NewTicker(d.interval)
-	defer ticker.Stop()
+// SearchInstances runs a structured resource search query and resolves the
+// running and metadata-only instances among its results.
+func (o remoteOciClientWrapper) SearchInstances(ctx context.Context, query string) ([]Instance, error) {
+	request := resourcesearch.SearchResourcesRequest{
+		SearchDetails: resourcesearch.StructuredSearchDetails{Query: &query},
+	}
+	var instanceIDs []*string
 	for {
-		select {
-		case <-ticker.C:
-			tgs, err := d.refresh()
-			if err != nil {
-				level.Error(d.logger).Log("msg", "Refresh failed", "err", err)
+		response, err := o.ociResourceSearchClient.SearchResources(ctx, request)
+		if err != nil {
+			return nil, fmt.Errorf("error searching resources in OCI: %s", err)
+		}
+		for _, item := range response.Items {
+			if stringValue(item.ResourceType) != searchResourceTypeInstance || !o.discoverable(strings.ToUpper(stringValue(item.LifecycleState))) {
 				continue
 			}
-			select {
-			case ch <- tgs:
-			case <-ctx.Done():
-			}
-		case <-ctx.Done():
-			return
+			instanceIDs = append(instanceIDs, item.Identifier)
 		}
+		if response.OpcNextPage == nil {
+			break
+		}
+		request.Page = response.OpcNextPage
 	}
-}
 
-// instanceResponse wraps an oci ListInstancesResponse, i.e. pagination and a list of instances
-type instanceResponse struct {
-	Page        *string
-	OpcNextPage *string
-	instances   []instance
+	instances := make([]Instance, len(instanceIDs))
+	err := forEach(len(instances), o.instanceConcurrency, func(i int) error {
+		getInstanceResponse, err := o.ociComputeClient.GetInstance(ctx, core.GetInstanceRequest{InstanceId: instanceIDs[i]})
+		if err != nil {
+			return fmt.Errorf("error retrieving instance from OCI: %s", err)
+		}
+		instance, err := o.instance(ctx, getInstanceResponse.Instance)
+		if err != nil {
+			return err
+		}
+		instances[i] = instance
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return instances, nil
 }
 
-// instance wraps the relevant attributes for instances, i.e. the data we want to export as labels
-type instance struct {
-	ID            string
-	privateIP     string
-	DisplayName   string
-	CompartmentID string
-	FreeformTags  map[string]string
+// listSecondaryPrivateIPs returns all private IPs of the given VNICs except
+// the instance's primary one.
+func (o remoteOciClientWrapper) listSecondaryPrivateIPs(ctx context.Context, vnicIDs []*string, primaryIP string) ([]string, error) {
+	var ips []string
+	for _, vnicID := range vnicIDs {
+		request := core.ListPrivateIpsRequest{
+			VnicId: vnicID,
+		}
+		for {
+			response, err := o.ociVirtualNetworkClient.ListPrivateIps(ctx, request)
+			if err != nil {
+				return nil, fmt.Errorf("error retrieving private ips from OCI: %s", err)
+			}
+			for _, privateIPItem := range response.Items {
+				if privateIPItem.IpAddress == nil || *privateIPItem.IpAddress == primaryIP {
+					continue
+				}
+				ips = append(ips, *privateIPItem.IpAddress)
+			}
+			if response.OpcNextPage == nil {
+				break
+			}
+			request.Page = response.OpcNextPage
+		}
+	}
+	return ips, nil
 }
 
-func (d *Discovery) refresh() (tgs []*targetgroup.Group, err error) {
-	t0 := time.Now()
-	defer func() {
-		ociSDRefreshDuration.Observe(time.Since(t0).Seconds())
-		if err != nil {
-			ociSDRefreshFailuresCount.Inc()
-		}
-	}()
+// discoverable reports whether instances in the given lifecycle state are
+// discovered, i.e. whether they are running, scrapeable or metadata-only.
+func (o remoteOciClientWrapper) discoverable(state string) bool {
+	return state == string(core.InstanceLifecycleStateRunning) || o.metadataOnlyStates[state] || o.scrapeableStates[state]
+}
 
-	ctx := context.Background()
+func (o remoteOciClientWrapper) ListInstances(ctx context.Context, compartmentID *string, filter instanceFilter) (*instanceResponse, error) {
+	listInstancesRequest := core.ListInstancesRequest{
+		CompartmentId:      compartmentID,
+		LifecycleState:     core.InstanceLifecycleStateRunning,
+		DisplayName:        filter.displayName,
+		AvailabilityDomain: filter.availabilityDomain,
+		Page:               filter.page,
+		SortBy:             o.instanceSortBy,
+		SortOrder:          o.instanceSortOrder,
+	}
+	if o.instancePageLimit > 0 {
+		listInstancesRequest.Limit = &o.instancePageLimit
+	}
+	if len(o.metadataOnlyStates) > 0 || len(o.scrapeableStates) > 0 {
+		// Instances in other states are filtered below.
+		listInstancesRequest.LifecycleState = ""
+	}
 
-	var compartmentIDs []*string
-	if d.rootCompartmentID != "" {
-		compartmentIDs, err = d.ociClientWrapper.GetCompartmentIDs(ctx, &d.rootCompartmentID)
+	listInstancesResponse, err := o.ociComputeClient.ListInstances(ctx, listInstancesRequest)
+	if err != nil {
+		return nil, err
+	}
+	items := listInstancesResponse.Items
+	if len(o.metadataOnlyStates) > 0 || len(o.scrapeableStates) > 0 {
+		items = make([]core.Instance, 0, len(listInstancesResponse.Items))
+		for _, item := range listInstancesResponse.Items {
+			if o.discoverable(string(item.LifecycleState)) {
+				items = append(items, item)
+			}
+		}
+	}
+	instances := make([]Instance, len(items))
+	err = forEach(len(instances), o.instanceConcurrency, func(i int) error {
+		instance, err := o.instance(ctx, items[i])
 		if err != nil {
-			return nil, fmt.Errorf("error retrieving compartment ids from OCI: %s", err)
+			return err
 		}
-	} else {
-		compartmentIDs = []*string{&d.compartmentID}
+		instances[i] = instance
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	var filterDisplayName *string
-	if d.displayName == "" {
-		filterDisplayName = nil
-	} else {
-		filterDisplayName = &d.displayName
+	instanceResponse := &instanceResponse{
+		Page:        filter.page,
+		OpcNextPage: listInstancesResponse.OpcNextPage,
+		instances:   instances,
 	}
+	return instanceResponse, nil
+}
 
-	for _, compartmentID := range compartmentIDs {
-		compartmentName, err := d.ociClientWrapper.GetCompartmentName(ctx, compartmentID)
-		if err != nil {
-			return nil, fmt.Errorf("error retrieving compartment from OCI: %s", err)
-		}
+// reauthenticatingClientWrapper retries calls once with freshly set up
+// clients when the API reports an expired token, as happens occasionally
+// when instance principal certificates are rotated.
+type reauthenticatingClientWrapper struct {
+	mtx     sync.Mutex
+	current ociClientWrapper
+	// generation counts the clients set up so far, so that calls rejected
+	// at the same time set up new clients only once.
+	generation       uint64
+	newClientWrapper func() (ociClientWrapper, error)
+	retryDelay       time.Duration
+	logger           log.Logger
+}
 
-		listInstancesFunc := func(compartmentID *string, displayName *string) (*instanceResponse, error) {
-			return d.ociClientWrapper.ListInstances(ctx, compartmentID, displayName)
-		}
+func (o *reauthenticatingClientWrapper) GetCompartmentIDs(ctx context.Context, rootCompartmentID *string) (compartmentIDs []compartmentRef, err error) {
+	err = o.retry(ctx, func(clientWrapper ociClientWrapper) error {
+		compartmentIDs, err = clientWrapper.GetCompartmentIDs(ctx, rootCompartmentID)
+		return err
+	})
+	return compartmentIDs, err
+}
 
-		for instanceResponse, err := listInstancesFunc(compartmentID, filterDisplayName); ; instanceResponse, err = listInstancesFunc(compartmentID, filterDisplayName) {
-			if err != nil {
-				return tgs, fmt.Errorf("error retrieving targets from oci: %s", err)
-			}
-			for _, instance := range instanceResponse.instances {
-				privateIP := instance.privateIP
-				addr := fmt.Sprintf("%s:%d", privateIP, d.port)
-				target := model.LabelSet{
-					model.AddressLabel: model.LabelValue(addr),
-				}
-				labels := model.LabelSet{
-					ociInstanceID:      model.LabelValue(instance.ID),
-					ociDisplayName:     model.LabelValue(instance.DisplayName),
-					ociCompartmentID:   model.LabelValue(instance.CompartmentID),
-					ociCompartmentName: model.LabelValue(compartmentName),
-					model.AddressLabel: model.LabelValue(addr),
-				}
-				for key, value := range instance.FreeformTags {
-					name := strutil.SanitizeLabelName(key)
-					labels[ociTagLabel+model.LabelName(name)] = model.LabelValue(value)
-				}
-				tg := &targetgroup.Group{
-					Source:  fmt.Sprintf("OCI_%s_", instance.ID),
-					Labels:  labels,
-					Targets: []model.LabelSet{target},
-				}
-				tgs = append(tgs, tg)
-			}
+func (o *reauthenticatingClientWrapper) GetCompartment(ctx context.Context, compartmentID *string) (c compartment, err error) {
+	err = o.retry(ctx, func(clientWrapper ociClientWrapper) error {
+		c, err = clientWrapper.GetCompartment(ctx, compartmentID)
+		return err
+	})
+	return c, err
+}
 
-			if instanceResponse.OpcNextPage != nil {
-				instanceResponse.Page = instanceResponse.OpcNextPage
-			} else {
-				break
-			}
+func (o *reauthenticatingClientWrapper) ListInstances(ctx context.Context, compartmentID *string, filter instanceFilter) (response *instanceResponse, err error) {
+	err = o.retry(ctx, func(clientWrapper ociClientWrapper) error {
+		response, err = clientWrapper.ListInstances(ctx, compartmentID, filter)
+		return err
+	})
+	return response, err
+}
+
+func (o *reauthenticatingClientWrapper) SearchInstances(ctx context.Context, query string) (instances []Instance, err error) {
+	err = o.retry(ctx, func(clientWrapper ociClientWrapper) error {
+		instances, err = clientWrapper.SearchInstances(ctx, query)
+		return err
+	})
+	return instances, err
+}
+
+func (o *reauthenticatingClientWrapper) GetNamespace(ctx context.Context) (namespace string, err error) {
+	err = o.retry(ctx, func(clientWrapper ociClientWrapper) error {
+		namespace, err = clientWrapper.GetNamespace(ctx)
+		return err
+	})
+	return namespace, err
+}
+
+func (o *reauthenticatingClientWrapper) GetTenancyName(ctx context.Context) (name string, err error) {
+	err = o.retry(ctx, func(clientWrapper ociClientWrapper) error {
+		name, err = clientWrapper.GetTenancyName(ctx)
+		return err
+	})
+	return name, err
+}
+
+func (o *reauthenticatingClientWrapper) ListAvailabilityDomains(ctx context.Context, compartmentID *string) (domains []string, err error) {
+	err = o.retry(ctx, func(clientWrapper ociClientWrapper) error {
+		domains, err = clientWrapper.ListAvailabilityDomains(ctx, compartmentID)
+		return err
+	})
+	return domains, err
+}
+
+func (o *reauthenticatingClientWrapper) ListRegionSubscriptions(ctx context.Context) (regions []string, err error) {
+	err = o.retry(ctx, func(clientWrapper ociClientWrapper) error {
+		regions, err = clientWrapper.ListRegionSubscriptions(ctx)
+		return err
+	})
+	return regions, err
+}
+
+func (o *reauthenticatingClientWrapper) retry(ctx context.Context, call func(ociClientWrapper) error) error {
+	o.mtx.Lock()
+	clientWrapper, generation := o.current, o.generation
+	o.mtx.Unlock()
+
+	err := call(clientWrapper)
+	if !isAuthExpired(err) {
+		return err
+	}
+	level.Warn(o.logger).Log("msg", "Authentication rejected, refreshing instance principals", "err", err)
+
+	if o.retryDelay > 0 {
+		jitter := time.Duration(rand.Int63n(int64(o.retryDelay)))
+		select {
+		case <-time.After(o.retryDelay + jitter):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	clientWrapper, refreshErr := o.refresh(generation)
+	if refreshErr != nil {
+		return fmt.Errorf("error refreshing instance principals after %s: %s", err, refreshErr)
+	}
+	return call(clientWrapper)
+}
+
+// refresh sets up new clients to replace the given generation of clients and
+// returns them. If another call replaced that generation already, its
+// clients are returned instead.
+func (o *reauthenticatingClientWrapper) refresh(generation uint64) (ociClientWrapper, error) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	if o.generation != generation {
+		return o.current, nil
+	}
+	clientWrapper, err := o.newClientWrapper()
+	if err != nil {
+		return nil, err
+	}
+	// Every set of clients has its own transport, which would otherwise keep
+	// the connections of the rejected clients open.
+	if c, ok := o.current.(idleConnectionsCloser); ok {
+		c.closeIdleConnections()
+	}
+	o.current = clientWrapper
+	o.generation++
+	return clientWrapper, nil
+}
+
+// isAuthExpired reports whether err is the API rejecting the request's
+// credentials.
+func isAuthExpired(err error) bool {
+	serviceErr, ok := common.IsServiceError(err)
+	return ok && serviceErr.GetHTTPStatusCode() == http.StatusUnauthorized
+}
+
+// definedTagFilter matches instances carrying a defined tag. Without a value
+// the tag merely has to exist.
+type definedTagFilter struct {
+	namespace string
+	key       string
+	value     string
+	exists    bool
+}
+
+// parseDefinedTagFilter parses filters of the form namespace.key=value. A
+// value of * or no value at all only requires the tag to be present.
+func parseDefinedTagFilter(s string) (definedTagFilter, error) {
+	tag, value := s, ""
+	hasValue := false
+	if i := strings.Index(s, "="); i >= 0 {
+		tag, value, hasValue = s[:i], s[i+1:], true
+	}
+	i := strings.Index(tag, ".")
+	if i <= 0 || i == len(tag)-1 {
+		return definedTagFilter{}, fmt.Errorf("invalid defined tag filter %q, expected namespace.key=value", s)
+	}
+	f := definedTagFilter{
+		namespace: tag[:i],
+		key:       tag[i+1:],
+		value:     value,
+	}
+	if !hasValue || value == "" || value == "*" {
+		f.exists = true
+		f.value = ""
+	}
+	return f, nil
+}
+
+func (f definedTagFilter) matches(definedTags map[string]map[string]interface{}) bool {
+	value, ok := definedTags[f.namespace][f.key]
+	if !ok {
+		return false
+	}
+	return f.exists || fmt.Sprint(value) == f.value
+}
+
+// definedTagKey identifies a defined tag by namespace and key.
+type definedTagKey struct {
+	namespace string
+	key       string
+}
+
+// parseDefinedTagKey parses defined tag keys of the form namespace.key.
+func parseDefinedTagKey(s string) (definedTagKey, error) {
+	i := strings.Index(s, ".")
+	if i <= 0 || i == len(s)-1 {
+		return definedTagKey{}, fmt.Errorf("invalid defined tag %q, expected namespace.key", s)
+	}
+	return definedTagKey{namespace: s[:i], key: s[i+1:]}, nil
+}
+
+// parseCIDRs parses the given CIDRs, e.g. 10.0.1.0/24.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP filter CIDR %q: %s", cidr, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (k definedTagKey) lookup(definedTags map[string]map[string]interface{}) (string, bool) {
+	value, ok := definedTags[k.namespace][k.key]
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprint(value), true
+}
+
+// applyConfig sets the parts of the configuration that can be changed without
+// setting up new clients. The caller must hold the write lock or own d
+// exclusively.
+func (d *Discovery) applyConfig(conf SDConfig) error {
+	var definedTagFilters []definedTagFilter
+	for _, f := range conf.DefinedTagFilters {
+		filter, err := parseDefinedTagFilter(f)
+		if err != nil {
+			return err
+		}
+		definedTagFilters = append(definedTagFilters, filter)
+	}
+	var portDefinedTag definedTagKey
+	if conf.PortFromDefinedTag != "" {
+		var err error
+		if portDefinedTag, err = parseDefinedTagKey(conf.PortFromDefinedTag); err != nil {
+			return err
+		}
+	}
+	var costCenterTag definedTagKey
+	if conf.CostCenterTag != "" {
+		var err error
+		if costCenterTag, err = parseDefinedTagKey(conf.CostCenterTag); err != nil {
+			return err
+		}
+	}
+	ipFilterNets, err := parseCIDRs(conf.IPFilterCIDRs)
+	if err != nil {
+		return err
+	}
+	d.compartmentID = conf.CompartmentID
+	d.rootCompartmentID = conf.RootCompartmentID
+	d.compartmentIDsFile = conf.CompartmentIDsFile
+	d.displayName = conf.DisplayName
+	d.interval = time.Duration(conf.RefreshInterval)
+	d.port = conf.Port
+	d.roleTag = conf.RoleTag
+	d.availabilityDomain = conf.AvailabilityDomain
+	d.regionalSource = conf.RegionalSource
+	d.displayNameFilterLabel = conf.DisplayNameFilterLabel
+	d.addressPreference = conf.AddressPreference
+	d.scrapeHintTag = conf.ScrapeHintTag
+	d.includeRootCompartment = conf.IncludeRootCompartment
+	d.maxTargets = conf.MaxTargets
+	d.failOnMaxTargets = conf.FailOnMaxTargets
+	d.emitVNICErrors = conf.EmitVNICErrors
+	d.definedTagFilters = definedTagFilters
+	d.portDefinedTag = portDefinedTag
+	d.costCenterTag = costCenterTag
+	d.emitCompartmentTags = conf.EmitCompartmentTags
+	d.compartmentTagFilters = conf.CompartmentTagFilters
+	d.portOptional = conf.PortOptional
+	d.searchQuery = conf.SearchQuery
+	d.compartmentConcurrency = conf.CompartmentConcurrency
+	d.cacheFile = conf.CacheFile
+	d.cacheMaxAge = time.Duration(conf.CacheMaxAge)
+	d.emitNamespace = conf.EmitNamespace
+	d.emitTenancyName = conf.EmitTenancyName
+	d.emitRootName = conf.EmitRootCompartmentName
+	d.groupBy = conf.GroupBy
+	d.homeRegion = conf.HomeRegion
+	d.refreshTimeout = time.Duration(conf.RefreshTimeout)
+	d.retryOnEmpty = conf.RetryOnEmpty
+	d.labelNameMode = conf.LabelNameMode
+	d.sanitizedTagKeyPrefix = conf.SanitizedTagKeyPrefix
+	d.lowercaseTagValues = conf.LowercaseTagValues
+	d.metadataOnly = len(conf.MetadataOnlyStates) > 0 || len(conf.ScrapeableStates) > 0
+	d.scrapeableStates = stringSet(conf.ScrapeableStates)
+	d.metadataOnlyOmitAddress = conf.MetadataOnlyOmitAddress
+	d.rotateAvailabilityDomains = conf.RotateAvailabilityDomains
+	d.targetRemovalGracePeriod = time.Duration(conf.TargetRemovalGracePeriod)
+	d.ipFilterNets = ipFilterNets
+	d.failOnNoCompartments = conf.FailOnNoCompartments
+	d.emitConsoleURL = conf.EmitConsoleURL
+	d.shards = conf.Shards
+	d.dedupKey = conf.DedupKey
+	d.sortTargets = conf.SortTargets
+	d.emitCompartmentSize = conf.EmitCompartmentTargetCount
+	d.usePrometheusTagNamespace = conf.UsePrometheusTagNamespace
+	d.unresolvedAddress = conf.UnresolvedAddressPlaceholder
+	d.breakerThreshold = conf.CompartmentFailureThreshold
+	d.breakerCooldown = time.Duration(conf.CompartmentCooldown)
+	d.retryOnEmptyDelay = time.Duration(conf.RetryOnEmptyDelay)
+	return nil
+}
+
+// clientSettings returns the part of conf the clients are built from, which
+// UpdateConfig can't change.
+func clientSettings(conf SDConfig) SDConfig {
+	return SDConfig{
+		UseInstancePrincipals:       conf.UseInstancePrincipals,
+		CompartmentAccessLevel:      conf.CompartmentAccessLevel,
+		IncludeSecondaryIPs:         conf.IncludeSecondaryIPs,
+		SkipVNICErrors:              conf.SkipVNICErrors,
+		InstanceSortBy:              conf.InstanceSortBy,
+		InstanceSortOrder:           conf.InstanceSortOrder,
+		InstancePageLimit:           conf.InstancePageLimit,
+		IncludeInactiveCompartments: conf.IncludeInactiveCompartments,
+		RecurseCompartments:         conf.RecurseCompartments,
+		HomeRegion:                  conf.HomeRegion,
+		InstanceConcurrency:         conf.InstanceConcurrency,
+		MaxIdleConns:                conf.MaxIdleConns,
+		MaxIdleConnsPerHost:         conf.MaxIdleConnsPerHost,
+		RootChildNames:              conf.RootChildNames,
+		EmitBootVolumeID:            conf.EmitBootVolumeID,
+		MetadataOnlyStates:          conf.MetadataOnlyStates,
+		ScrapeableStates:            conf.ScrapeableStates,
+		Realm:                       conf.Realm,
+		PreferredSubnetID:           conf.PreferredSubnetID,
+		EmitSubnetPublic:            conf.EmitSubnetPublic,
+		EmitTenancyName:             conf.EmitTenancyName,
+		MaxConcurrentRequests:       conf.MaxConcurrentRequests,
+		AllSubscribedRegions:        conf.AllSubscribedRegions,
+		RegionAllowlist:             conf.RegionAllowlist,
+		PrincipalBootstrapTimeout:   conf.PrincipalBootstrapTimeout,
+		PrincipalBootstrapRetries:   conf.PrincipalBootstrapRetries,
+		Tenancies:                   conf.Tenancies,
+	}
+}
+
+// UpdateConfig validates conf and swaps in the compartments, filters and
+// refresh interval it configures. The changes take effect with the next
+// refresh. Changes to credentials, tenancies or settings of the OCI clients
+// can't be applied to a running discovery and are rejected.
+func (d *Discovery) UpdateConfig(conf SDConfig) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	if conf.RefreshInterval <= 0 {
+		return fmt.Errorf("OCI SD refresh interval must be positive, got %s", conf.RefreshInterval)
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if !reflect.DeepEqual(clientSettings(conf), clientSettings(d.conf)) {
+		return fmt.Errorf("OCI SD configuration change requires new clients, restart discovery to apply it")
+	}
+	if err := d.applyConfig(conf); err != nil {
+		return err
+	}
+	d.conf = conf
+	return nil
+}
+
+func (d *Discovery) refreshInterval() time.Duration {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	return d.interval
+}
+
+func (d *Discovery) cache() (string, time.Duration) {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	return d.cacheFile, d.cacheMaxAge
+}
+
+// sendCachedTargets passes the targets cached by an earlier run to send, so
+// they are served while the first refresh is running.
+func (d *Discovery) sendCachedTargets(send func([]*targetgroup.Group)) {
+	filename, maxAge := d.cache()
+	if filename == "" {
+		return
+	}
+	tgs, err := loadCache(filename, maxAge, time.Now())
+	if os.IsNotExist(err) {
+		level.Debug(d.logger).Log("msg", "No cached targets to start with", "file", filename)
+		return
+	}
+	if err != nil {
+		level.Warn(d.logger).Log("msg", "Ignoring cached targets", "err", err)
+		return
+	}
+	level.Info(d.logger).Log("msg", "Serving cached targets until the first refresh", "file", filename, "groups", len(tgs))
+	send(tgs)
+}
+
+// cacheTargets persists the targets of a successful refresh, if a cache file
+// is configured.
+func (d *Discovery) cacheTargets(tgs []*targetgroup.Group) {
+	filename, _ := d.cache()
+	if filename == "" {
+		return
+	}
+	if err := saveCache(filename, time.Now(), tgs); err != nil {
+		level.Warn(d.logger).Log("msg", "Failed to save cached targets", "file", filename, "err", err)
+	}
+}
+
+// stringValue dereferences optional strings returned by the API.
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// CredentialProvider supplies the credentials to access a tenancy with, e.g.
+// from a secret manager. The top level settings of SDConfig are passed as a
+// TenancyConfig without tenancy id.
+type CredentialProvider interface {
+	ConfigurationProvider(t TenancyConfig) (common.ConfigurationProvider, error)
+}
+
+// defaultCredentialProvider uses instance principals or an OCI config file,
+// as configured for the tenancy.
+type defaultCredentialProvider struct {
+	principals principalBootstrap
+}
+
+func (p defaultCredentialProvider) ConfigurationProvider(t TenancyConfig) (common.ConfigurationProvider, error) {
+	if t.UseInstancePrincipals {
+		// Credential providers can't be cancelled, attempts are bounded by
+		// the bootstrap timeout instead.
+		return p.principals.configurationProvider(context.Background())
+	}
+	return newConfigurationProvider(t.ConfigFile, t.Profile)
+}
+
+// NewDiscoveryWithCredentialProvider returns a new Discovery which accesses
+// OCI with the credentials supplied by credentials instead of the built-in
+// authentication methods.
+//
+// Deprecated: use NewDiscovery with WithCredentialProvider.
+func NewDiscoveryWithCredentialProvider(conf SDConfig, logger log.Logger, credentials CredentialProvider) (*Discovery, error) {
+	return NewDiscovery(conf, logger, WithCredentialProvider(credentials))
+}
+
+// setCredentials sets up the clients of d for the configured tenancies and
+// regions with the credentials supplied by credentials.
+func (d *Discovery) setCredentials(conf SDConfig, credentials CredentialProvider) error {
+	// Tenancies share the request limit.
+	limiter := newRequestLimiter(conf.MaxConcurrentRequests)
+	regions := func(t TenancyConfig) *regionalClients {
+		if !conf.AllSubscribedRegions {
+			return nil
+		}
+		return newRegionalClients(conf.RegionAllowlist, func(region string) (ociClientWrapper, error) {
+			t.Region = region
+			return newClientWrapper(conf, t, credentials, limiter, d.logger)
+		})
+	}
+	if len(conf.Tenancies) == 0 {
+		t := TenancyConfig{UseInstancePrincipals: conf.UseInstancePrincipals, HomeRegion: conf.HomeRegion}
+		clientWrapper, err := newClientWrapper(conf, t, credentials, limiter, d.logger)
+		if err != nil {
+			return err
+		}
+		d.ociClientWrapper = clientWrapper
+		d.regions = regions(t)
+	}
+
+	for _, t := range conf.Tenancies {
+		clientWrapper, err := newClientWrapper(conf, t, credentials, limiter, d.logger)
+		if err != nil {
+			return fmt.Errorf("error setting up tenancy %s: %s", t.TenancyID, err)
+		}
+		d.tenancies = append(d.tenancies, tenancy{
+			id:                t.TenancyID,
+			compartmentID:     t.CompartmentID,
+			rootCompartmentID: t.RootCompartmentID,
+			homeRegion:        t.HomeRegion,
+			ociClientWrapper:  clientWrapper,
+			regions:           regions(t),
+		})
+	}
+	return nil
+}
+
+// newClientWrapper sets up the OCI clients for the given credentials. When
+// instance principals are used the clients are rebuilt whenever the API
+// rejects the current token.
+func newClientWrapper(conf SDConfig, t TenancyConfig, credentials CredentialProvider, limiter requestLimiter, logger log.Logger) (ociClientWrapper, error) {
+	newRemote := func() (ociClientWrapper, error) {
+		config, err := credentials.ConfigurationProvider(t)
+		if err != nil {
+			return nil, err
+		}
+		clientWrapper, err := newRemoteOciClientWrapper(config, conf, t.Region, t.HomeRegion)
+		if err != nil {
+			return nil, err
+		}
+		return clientWrapper.withRequestLimiter(limiter), nil
+	}
+	clientWrapper, err := newRemote()
+	if err != nil {
+		return nil, err
+	}
+	if !t.UseInstancePrincipals {
+		return clientWrapper, nil
+	}
+	return &reauthenticatingClientWrapper{
+		current:          clientWrapper,
+		newClientWrapper: newRemote,
+		retryDelay:       principalRefreshRetryDelay,
+		logger:           logger,
+	}, nil
+}
+
+func newConfigurationProvider(configFile string, profile string) (common.ConfigurationProvider, error) {
+	if configFile == "" && profile == "" {
+		return common.DefaultConfigProvider(), nil
+	}
+	if configFile == "" {
+		configFile = filepath.Join(os.Getenv("HOME"), ".oci", "config")
+	}
+	if profile == "" {
+		profile = defaultProfile
+	}
+	config, err := common.ConfigurationProviderFromFileWithProfile(configFile, profile, "")
+	if err != nil {
+		return nil, fmt.Errorf("error reading OCI config file %s: %s", configFile, err)
+	}
+	return config, nil
+}
+
+// newRemoteOciClientWrapper sets up the OCI clients. The compute and network
+// clients use region, the identity client homeRegion. Empty regions keep the
+// region of config.
+func newRemoteOciClientWrapper(config common.ConfigurationProvider, conf SDConfig, region string, homeRegion string) (remoteOciClientWrapper, error) {
+	computeClient, err := core.NewComputeClientWithConfigurationProvider(config)
+	if err != nil {
+		return remoteOciClientWrapper{}, fmt.Errorf("error setting up compute client for OCI: %s", err)
+	}
+
+	identityClient, err := identity.NewIdentityClientWithConfigurationProvider(config)
+	if err != nil {
+		return remoteOciClientWrapper{}, fmt.Errorf("error setting up vnic client for OCI: %s", err)
+	}
+
+	virtualNetworkClient, err := core.NewVirtualNetworkClientWithConfigurationProvider(config)
+	if err != nil {
+		return remoteOciClientWrapper{}, fmt.Errorf("error setting up vnic client for OCI: %s", err)
+	}
+
+	resourceSearchClient, err := resourcesearch.NewResourceSearchClientWithConfigurationProvider(config)
+	if err != nil {
+		return remoteOciClientWrapper{}, fmt.Errorf("error setting up resource search client for OCI: %s", err)
+	}
+
+	objectStorageClient, err := objectstorage.NewObjectStorageClientWithConfigurationProvider(config)
+	if err != nil {
+		return remoteOciClientWrapper{}, fmt.Errorf("error setting up object storage client for OCI: %s", err)
+	}
+
+	if region != "" {
+		computeClient.SetRegion(region)
+		identityClient.SetRegion(region)
+		virtualNetworkClient.SetRegion(region)
+		resourceSearchClient.SetRegion(region)
+		objectStorageClient.SetRegion(region)
+	}
+	if homeRegion != "" {
+		identityClient.SetRegion(homeRegion)
+	}
+	if conf.Realm != "" {
+		computeClient.Host = realmHost(computeClient.Host, conf.Realm)
+		identityClient.Host = realmHost(identityClient.Host, conf.Realm)
+		virtualNetworkClient.Host = realmHost(virtualNetworkClient.Host, conf.Realm)
+		resourceSearchClient.Host = realmHost(resourceSearchClient.Host, conf.Realm)
+		objectStorageClient.Host = realmHost(objectStorageClient.Host, conf.Realm)
+	}
+
+	// The clients share a transport owned by the discovery so that idle
+	// connections can be released on Close.
+	transport := newTransport(conf)
+	httpClient := &http.Client{Transport: transport, Timeout: clientTimeout}
+	computeClient.HTTPClient = httpClient
+	identityClient.HTTPClient = httpClient
+	virtualNetworkClient.HTTPClient = httpClient
+	resourceSearchClient.HTTPClient = httpClient
+	objectStorageClient.HTTPClient = httpClient
+
+	compartmentAccessLevel := identity.ListCompartmentsAccessLevelEnum(conf.CompartmentAccessLevel)
+	if compartmentAccessLevel == "" {
+		compartmentAccessLevel = identity.ListCompartmentsAccessLevelAccessible
+	}
+
+	// The tenancy id is only needed to list region subscriptions and to look
+	// up the tenancy name.
+	var tenancyID string
+	if conf.AllSubscribedRegions || conf.EmitTenancyName {
+		if tenancyID, err = config.TenancyOCID(); err != nil {
+			return remoteOciClientWrapper{}, fmt.Errorf("error reading tenancy id for OCI: %s", err)
+		}
+	}
+
+	return remoteOciClientWrapper{
+		ociComputeClient:            &computeClient,
+		ociIdentityClient:           &identityClient,
+		ociVirtualNetworkClient:     &virtualNetworkClient,
+		ociResourceSearchClient:     &resourceSearchClient,
+		ociObjectStorageClient:      &objectStorageClient,
+		compartmentAccessLevel:      compartmentAccessLevel,
+		includeSecondaryIPs:         conf.IncludeSecondaryIPs,
+		skipVNICErrors:              conf.SkipVNICErrors,
+		includeInactiveCompartments: conf.IncludeInactiveCompartments,
+		recurseCompartments:         conf.RecurseCompartments,
+		instanceSortBy:              core.ListInstancesSortByEnum(conf.InstanceSortBy),
+		instanceSortOrder:           core.ListInstancesSortOrderEnum(conf.InstanceSortOrder),
+		instancePageLimit:           conf.InstancePageLimit,
+		instanceConcurrency:         conf.InstanceConcurrency,
+		rootChildNames:              stringSet(conf.RootChildNames),
+		emitBootVolumeID:            conf.EmitBootVolumeID,
+		metadataOnlyStates:          stringSet(conf.MetadataOnlyStates),
+		scrapeableStates:            stringSet(conf.ScrapeableStates),
+		preferredSubnetID:           conf.PreferredSubnetID,
+		emitSubnetPublic:            conf.EmitSubnetPublic,
+		subnets:                     &subnetCache{},
+		tenancyID:                   tenancyID,
+		transport:                   transport,
+	}, nil
+}
+
+// realmHost moves an endpoint host of the commercial realm, as resolved by
+// the SDK, to the given realm.
+func realmHost(host, realm string) string {
+	return strings.TrimSuffix(host, commercialRealm) + strings.TrimPrefix(realm, ".")
+}
+
+// stringSet returns a set holding the given values, or nil if there are none.
+func stringSet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+// newTransport returns a transport with the same settings as
+// http.DefaultTransport, except for the idle connection limits set in conf.
+func newTransport(conf SDConfig) *http.Transport {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if conf.MaxIdleConns > 0 {
+		transport.MaxIdleConns = conf.MaxIdleConns
+	}
+	if conf.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = conf.MaxIdleConnsPerHost
+	}
+	return transport
+}
+
+func (o remoteOciClientWrapper) closeIdleConnections() {
+	if o.transport != nil {
+		o.transport.CloseIdleConnections()
+	}
+}
+
+func (o *reauthenticatingClientWrapper) closeIdleConnections() {
+	o.mtx.Lock()
+	clientWrapper := o.current
+	o.mtx.Unlock()
+	if c, ok := clientWrapper.(idleConnectionsCloser); ok {
+		c.closeIdleConnections()
+	}
+}
+
+// idleConnectionsCloser is implemented by client wrappers and regional
+// clients holding HTTP connections.
+type idleConnectionsCloser interface {
+	closeIdleConnections()
+}
+
+// CompartmentNames returns the names of the compartments looked at by the
+// last successful refresh by compartment id. It is empty before the first
+// refresh.
+func (d *Discovery) CompartmentNames() map[string]string {
+	d.compartmentNamesMtx.Lock()
+	defer d.compartmentNamesMtx.Unlock()
+	names := make(map[string]string, len(d.compartmentNames))
+	for id, name := range d.compartmentNames {
+		names[id] = name
+	}
+	return names
+}
+
+// Close stops a running Run and releases idle connections to the OCI API.
+// Discoveries replaced on a configuration reload should be closed so they
+// don't keep connections open. Close may be called more than once.
+func (d *Discovery) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.closing())
+		closers := []interface{}{d.ociClientWrapper}
+		if d.regions != nil {
+			closers = append(closers, d.regions)
+		}
+		for _, t := range d.tenancies {
+			closers = append(closers, t.ociClientWrapper)
+			if t.regions != nil {
+				closers = append(closers, t.regions)
+			}
+		}
+		for _, closer := range closers {
+			if c, ok := closer.(idleConnectionsCloser); ok {
+				c.closeIdleConnections()
+			}
+		}
+	})
+	return nil
+}
+
+// closing returns a channel that is closed once the discovery is closed.
+func (d *Discovery) closing() chan struct{} {
+	d.closedMtx.Lock()
+	defer d.closedMtx.Unlock()
+	if d.closed == nil {
+		d.closed = make(chan struct{})
+	}
+	return d.closed
+}
+
+// Run implements the Discoverer interface.
+func (d *Discovery) Run(ctx context.Context, ch chan<- []*targetgroup.Group) {
+	closed := d.closing()
+	// last holds the target groups last sent on ch, so unchanged refreshes
+	// do not cause the consumer to rewrite its output. They are compared
+	// with their sources and target labels, which the file_sd format leaves
+	// out.
+	var last []*targetgroup.Group
+	send := func(tgs []*targetgroup.Group) {
+		if last != nil && reflect.DeepEqual(tgs, last) {
+			ociSDSkippedUpdatesCount.Inc()
+			return
+		}
+		select {
+		case ch <- tgs:
+			last = tgs
+		case <-ctx.Done():
+		case <-closed:
+		}
+	}
+
+	d.sendCachedTargets(send)
+
+	tgs, err := d.refreshContext(ctx)
+	if err != nil {
+		level.Error(d.logger).Log("msg", "Refresh failed", "err", err)
+	} else {
+		d.cacheTargets(tgs)
+		send(tgs)
+	}
+
+	interval := d.refreshInterval()
+	ticker := time.NewTicker(interval)
+	defer func() {
+		ticker.Stop()
+	}()
+	for {
+		select {
+		case <-ticker.C:
+			if i := d.refreshInterval(); i != interval {
+				ticker.Stop()
+				interval = i
+				ticker = time.NewTicker(interval)
+			}
+			tgs, err := d.refreshContext(ctx)
+			if err != nil {
+				level.Error(d.logger).Log("msg", "Refresh failed", "err", err)
+				continue
+			}
+			d.cacheTargets(tgs)
+			send(tgs)
+		case <-ctx.Done():
+			return
+		case <-closed:
+			return
+		}
+	}
+}
+
+// instanceResponse wraps an oci ListInstancesResponse, i.e. pagination and a list of instances
+type instanceResponse struct {
+	Page        *string
+	OpcNextPage *string
+	instances   []Instance
+}
+
+// Instance wraps the relevant attributes for instances, i.e. the data we want to export as labels
+type Instance struct {
+	ID                  string
+	PrivateIP           string
+	PublicIP            string
+	SecondaryPrivateIPs []string
+	DisplayName         string
+	CompartmentID       string
+	AvailabilityDomain  string
+	Region              string
+	Shape               string
+	// SubnetID is the subnet of the VNIC the addresses are taken from.
+	SubnetID     string
+	FreeformTags map[string]string
+	DefinedTags  map[string]map[string]interface{}
+	// VNICCount is the number of VNICs attached to the instance.
+	VNICCount int
+	// BootVolumeID is only looked up if boot volume ids are emitted.
+	BootVolumeID   string
+	LifecycleState string
+	// TimeMaintenanceRebootDue is when a maintenance reboot is scheduled,
+	// nil if none is.
+	TimeMaintenanceRebootDue *time.Time
+	// subnetPublic is whether the subnet is public, if looked up.
+	subnetPublic *bool
+	// vnicErr is set when the instance's VNICs could not be resolved and
+	// such errors are configured to be skipped.
+	vnicErr error
+	// missingPreferredSubnet is set when a preferred subnet is configured
+	// but none of the instance's VNICs is on it.
+	missingPreferredSubnet bool
+}
+
+// AddressConfig holds the configuration relevant for building addresses.
+type AddressConfig struct {
+	// Port is the port to scrape.
+	Port int
+	// PortOptional leaves the port out of the address if Port is 0, for
+	// relabeling to add it.
+	PortOptional bool
+	// Preference lists the kinds of IP ("private" or "public") to scrape in
+	// order of preference. Empty means the private IP.
+	Preference []string
+}
+
+// AddressBuilder builds the scrape address of a discovered instance.
+type AddressBuilder interface {
+	// BuildAddress returns the address to scrape and additional labels to
+	// attach to the instance's target group.
+	BuildAddress(instance Instance, conf AddressConfig) (string, model.LabelSet, error)
+}
+
+// defaultAddressBuilder scrapes the first available IP in order of the
+// configured preference, by default the primary private IP, on the
+// configured port.
+type defaultAddressBuilder struct{}
+
+func (defaultAddressBuilder) BuildAddress(instance Instance, conf AddressConfig) (string, model.LabelSet, error) {
+	if len(conf.Preference) == 0 {
+		return hostPort(instance.PrivateIP, conf), nil, nil
+	}
+	for _, kind := range conf.Preference {
+		var ip string
+		switch kind {
+		case addressPrivate:
+			ip = instance.PrivateIP
+		case addressPublic:
+			ip = instance.PublicIP
+		}
+		if ip != "" {
+			return hostPort(ip, conf), nil, nil
+		}
+	}
+	return "", nil, fmt.Errorf("instance has none of the preferred addresses %v", conf.Preference)
+}
+
+// hostPort joins ip and the configured port into an address, leaving out the
+// port if it is 0 and optional.
+func hostPort(ip string, conf AddressConfig) string {
+	if conf.Port == 0 && conf.PortOptional {
+		return ip
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(conf.Port))
+}
+
+// fingerprint returns a stable key for the instance derived from its OCID and
+// primary private IP, unaffected by renames.
+func (i Instance) fingerprint() string {
+	h := fnv.New64a()
+	h.Write([]byte(i.ID))
+	h.Write([]byte{0})
+	h.Write([]byte(i.PrivateIP))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// targetGroup builds the target group for a single address of an instance.
+func (d *Discovery) targetGroup(t tenancy, c compartment, instance Instance, addressBuilder AddressBuilder) (*targetgroup.Group, error) {
+	var hint scrapeHint
+	if value, ok := instance.FreeformTags[d.scrapeHintTag]; ok && d.scrapeHintTag != "" {
+		var err error
+		if hint, err = parseScrapeHint(value); err != nil {
+			level.Warn(d.logger).Log("msg", "Ignoring invalid scrape hint", "instance", instance.ID, "tag", d.scrapeHintTag, "err", err)
+		}
+	}
+	port := d.port
+	if d.portOptional {
+		port = 0
+	}
+	if value, ok := d.portDefinedTag.lookup(instance.DefinedTags); ok && d.portDefinedTag.namespace != "" {
+		if p, err := strconv.Atoi(value); err == nil && p >= 1 && p <= 65535 {
+			port = p
+		} else {
+			level.Warn(d.logger).Log("msg", "Ignoring invalid port in defined tag", "instance", instance.ID, "tag", d.portDefinedTag.namespace+"."+d.portDefinedTag.key, "value", value)
+		}
+	}
+	if d.usePrometheusTagNamespace {
+		tagHint := d.prometheusTagHint(instance)
+		if tagHint.port != 0 {
+			port = tagHint.port
+		}
+		if hint.scheme == "" {
+			hint.scheme = tagHint.scheme
+		}
+		if hint.path == "" {
+			hint.path = tagHint.path
+		}
+	}
+	if hint.port != 0 {
+		port = hint.port
+	}
+	scrapeable := d.scrapeable(instance.LifecycleState)
+	var addr string
+	var addrLabels model.LabelSet
+	resolved := true
+	if instance.vnicErr != nil {
+		addr, resolved = d.unresolvedAddress, false
+	} else if scrapeable || !d.metadataOnlyOmitAddress && len(d.scrapeableStates) == 0 {
+		var err error
+		if addr, addrLabels, err = addressBuilder.BuildAddress(instance, AddressConfig{Port: port, PortOptional: d.portOptional, Preference: d.addressPreference}); err != nil {
+			if d.unresolvedAddress == "" {
+				return nil, err
+			}
+			level.Warn(d.logger).Log("msg", "Using placeholder address for instance without address", "instance", instance.ID, "err", err)
+			addr, addrLabels, resolved = d.unresolvedAddress, nil, false
+		}
+	}
+	target := model.LabelSet{}
+	labels := model.LabelSet{
+		ociInstanceID:      model.LabelValue(instance.ID),
+		ociDisplayName:     model.LabelValue(instance.DisplayName),
+		ociCompartmentID:   model.LabelValue(instance.CompartmentID),
+		ociCompartmentName: model.LabelValue(c.name),
+		ociFingerprint:     model.LabelValue(instance.fingerprint()),
+		ociVNICCount:       model.LabelValue(strconv.Itoa(instance.VNICCount)),
+	}
+	if addr != "" {
+		target[model.AddressLabel] = model.LabelValue(addr)
+		labels[model.AddressLabel] = model.LabelValue(addr)
+	}
+	if d.unresolvedAddress != "" {
+		labels[ociAddressResolved] = model.LabelValue(strconv.FormatBool(resolved))
+	}
+	if instance.vnicErr != nil {
+		labels[ociVNICError] = model.LabelValue(instance.vnicErr.Error())
+	}
+	if d.metadataOnly {
+		labels[ociScrapeable] = model.LabelValue(strconv.FormatBool(scrapeable))
+		if instance.LifecycleState != "" {
+			labels[ociInstanceState] = model.LabelValue(instance.LifecycleState)
+		}
+	}
+	if t.id != "" {
+		labels[ociTenancyID] = model.LabelValue(t.id)
+	}
+	if t.namespace != "" {
+		labels[ociNamespace] = model.LabelValue(t.namespace)
+	}
+	if t.name != "" {
+		labels[ociTenancyName] = model.LabelValue(t.name)
+	}
+	if t.rootName != "" {
+		labels[ociRootName] = model.LabelValue(t.rootName)
+	}
+	if value, ok := d.costCenterTag.lookup(instance.DefinedTags); ok && d.costCenterTag.namespace != "" && value != "" {
+		labels[ociCostCenter] = model.LabelValue(value)
+	}
+	if instance.AvailabilityDomain != "" {
+		labels[ociAvailabilityDomain] = model.LabelValue(instance.AvailabilityDomain)
+	}
+	if instance.Shape != "" {
+		labels[ociShape] = model.LabelValue(instance.Shape)
+		labels[ociShapeFamily] = model.LabelValue(shapeFamily(instance.Shape))
+	}
+	if instance.subnetPublic != nil {
+		labels[ociSubnetPublic] = model.LabelValue(strconv.FormatBool(*instance.subnetPublic))
+	}
+	if instance.BootVolumeID != "" {
+		labels[ociBootVolumeID] = model.LabelValue(instance.BootVolumeID)
+	}
+	if instance.TimeMaintenanceRebootDue != nil {
+		labels[ociRebootDue] = model.LabelValue(instance.TimeMaintenanceRebootDue.UTC().Format(time.RFC3339))
+	}
+	if c.parentID != "" {
+		labels[ociParentCompartment] = model.LabelValue(c.parentID)
+	}
+	if d.emitConsoleURL && instance.Region != "" {
+		labels[ociConsoleURL] = model.LabelValue(consoleURL(instance))
+	}
+	if d.shards > 0 {
+		labels[ociShard] = model.LabelValue(strconv.Itoa(shard(instance.ID, d.shards)))
+	}
+	if c.depth >= 0 {
+		labels[ociCompartmentDepth] = model.LabelValue(strconv.Itoa(c.depth))
+	}
+	if t.homeRegion != "" && instance.Region != "" {
+		// Instances report their region by its short key, e.g. phx.
+		isHomeRegion := common.StringToRegion(instance.Region) == common.StringToRegion(t.homeRegion)
+		labels[ociIsHomeRegion] = model.LabelValue(strconv.FormatBool(isHomeRegion))
+	}
+	if instance.PrivateIP != "" {
+		labels[ociPrivateIP] = model.LabelValue(instance.PrivateIP)
+	}
+	if instance.PublicIP != "" {
+		labels[ociPublicIP] = model.LabelValue(instance.PublicIP)
+	}
+	if role, ok := instance.FreeformTags[d.roleTag]; ok && d.roleTag != "" {
+		labels[ociRole] = model.LabelValue(role)
+	}
+	if hint.scheme != "" {
+		labels[model.SchemeLabel] = model.LabelValue(hint.scheme)
+	}
+	if hint.path != "" {
+		labels[model.MetricsPathLabel] = model.LabelValue(hint.path)
+	}
+	if d.displayNameFilterLabel && d.displayName != "" {
+		labels[ociDisplayNameFilter] = model.LabelValue(d.displayName)
+	}
+	for name, value := range addrLabels {
+		labels[name] = value
+	}
+	if d.emitCompartmentTags {
+		for name, value := range d.tagLabels(ociCompartmentTagLabel, c.freeformTags, "compartment", c.name) {
+			labels[name] = value
+		}
+	}
+	for name, value := range d.tagLabels(ociTagLabel, instance.FreeformTags, "instance", instance.ID) {
+		labels[name] = value
+	}
+	tg := &targetgroup.Group{
+		Source:  d.source(t, instance, ""),
+		Labels:  labels,
+		Targets: []model.LabelSet{target},
+	}
+	return tg, nil
+}
+
+// scrapeable reports whether instances in the given lifecycle state can be
+// scraped. Instances of unknown state are assumed to be running.
+func (d *Discovery) scrapeable(state string) bool {
+	if state == "" {
+		state = string(core.InstanceLifecycleStateRunning)
+	}
+	if len(d.scrapeableStates) == 0 {
+		return state == string(core.InstanceLifecycleStateRunning)
+	}
+	return d.scrapeableStates[state]
+}
+
+// consoleURL returns the URL of the instance in the OCI console. Instances
+// report their region by its short key, which the console doesn't accept.
+func consoleURL(instance Instance) string {
+	region := common.StringToRegion(instance.Region)
+	return fmt.Sprintf("https://cloud.oracle.com/compute/instances/%s?region=%s", url.PathEscape(instance.ID), url.QueryEscape(string(region)))
+}
+
+// shapeFamilies are the shape families told apart by shapeFamily.
+var shapeFamilies = []string{"DenseIO", "GPU", "HPC", "Optimized", "Standard"}
+
+// shapeFamily returns the family of a shape such as VM.Standard2.1 or
+// BM.DenseIO.E4.128, taken from its second part without generation, or
+// unknown.
+func shapeFamily(shape string) string {
+	parts := strings.Split(shape, ".")
+	if len(parts) < 2 || parts[0] != "VM" && parts[0] != "BM" {
+		return "unknown"
+	}
+	for _, family := range shapeFamilies {
+		if strings.HasPrefix(parts[1], family) {
+			return family
+		}
+	}
+	return "unknown"
+}
+
+// shard returns the shard of the instance among n shards. FNV-1a is used as
+// it is stable across processes and releases, unlike the runtime's map hash.
+func shard(instanceID string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(instanceID))
+	return int(h.Sum32() % uint32(n))
+}
+
+// tagLabels turns freeform tags into labels with the given prefix. Tag keys
+// that sanitize to the same label name are disambiguated by appending _2, _3
+// and so on to the names of all but the first of them in key order, so no tag
+// value is lost. The owner is only used to log such collisions. In utf8 label
+// name mode tag keys are used unchanged.
+func (d *Discovery) tagLabels(prefix model.LabelName, tags map[string]string, ownerKind, owner string) model.LabelSet {
+	if d.labelNameMode == labelNameModeUTF8 {
+		labels := make(model.LabelSet, len(tags))
+		for key, value := range tags {
+			labels[prefix+model.LabelName(key)] = d.tagValue(value)
+		}
+		return labels
+	}
+	keys := make([]string, 0, len(tags))
+	used := make(map[string]bool, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+		used[d.sanitizeTagKey(key)] = true
+	}
+	sort.Strings(keys)
+	labels := make(model.LabelSet, len(tags))
+	assigned := make(map[string]string, len(tags))
+	for _, key := range keys {
+		name := d.sanitizeTagKey(key)
+		if first, ok := assigned[name]; ok {
+			base := name
+			for i := 2; used[name]; i++ {
+				name = fmt.Sprintf("%s_%d", base, i)
+			}
+			used[name] = true
+			level.Warn(d.logger).Log("msg", "Freeform tag keys sanitize to the same label name", ownerKind, owner, "key", key, "other_key", first, "label", string(prefix)+name)
+		}
+		assigned[name] = key
+		labels[prefix+model.LabelName(name)] = d.tagValue(tags[key])
+	}
+	return labels
+}
+
+// tagValue returns the label value of a tag value.
+func (d *Discovery) tagValue(value string) model.LabelValue {
+	if d.lowercaseTagValues {
+		value = strings.ToLower(value)
+	}
+	return model.LabelValue(value)
+}
+
+// sanitizeTagKey turns a tag key into the label name suffix of its tag,
+// prefixed with the configured prefix if it starts with a digit or an
+// underscore.
+func (d *Discovery) sanitizeTagKey(key string) string {
+	name := strutil.SanitizeLabelName(key)
+	if d.sanitizedTagKeyPrefix != "" && name != "" && (name[0] == '_' || name[0] >= '0' && name[0] <= '9') {
+		return d.sanitizedTagKeyPrefix + name
+	}
+	return name
+}
+
+// scrapeHint holds the scrape parameters an instance overrides through its
+// scrape hint tag. Zero values keep the configured defaults.
+type scrapeHint struct {
+	scheme string
+	port   int
+	path   string
+}
+
+// parseScrapeHint parses a scrape hint of the form [scheme:]port[/path],
+// e.g. https:9443/metrics.
+func parseScrapeHint(s string) (scrapeHint, error) {
+	var hint scrapeHint
+	rest := s
+	if i := strings.Index(rest, ":"); i >= 0 {
+		hint.scheme, rest = rest[:i], rest[i+1:]
+		if hint.scheme != "http" && hint.scheme != "https" {
+			return scrapeHint{}, fmt.Errorf("invalid scheme %q in scrape hint %q", hint.scheme, s)
+		}
+	}
+	if i := strings.Index(rest, "/"); i >= 0 {
+		rest, hint.path = rest[:i], rest[i:]
+	}
+	port, err := strconv.Atoi(rest)
+	if err != nil || port < 1 || port > 65535 {
+		return scrapeHint{}, fmt.Errorf("invalid port %q in scrape hint %q", rest, s)
+	}
+	hint.port = port
+	return hint, nil
+}
+
+// source returns the target group source for an instance. Regional sources
+// are prefixed with the tenancy, if configured, and the instance's region.
+func (d *Discovery) source(t tenancy, instance Instance, suffix string) string {
+	if !d.regionalSource {
+		return fmt.Sprintf("OCI_%s_%s", instance.ID, suffix)
+	}
+	if t.id != "" {
+		return fmt.Sprintf("OCI_%s_%s_%s_%s", t.id, instance.Region, instance.ID, suffix)
+	}
+	return fmt.Sprintf("OCI_%s_%s_%s", instance.Region, instance.ID, suffix)
+}
+
+func (d *Discovery) matchesDefinedTags(i Instance) bool {
+	for _, f := range d.definedTagFilters {
+		if !f.matches(i.DefinedTags) {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Discovery) refresh() ([]*targetgroup.Group, error) {
+	return d.refreshContext(context.Background())
+}
+
+// refreshContext performs a refresh bounded by ctx and, if configured, the
+// refresh timeout.
+func (d *Discovery) refreshContext(ctx context.Context) (tgs []*targetgroup.Group, err error) {
+	t0 := time.Now()
+	var stats refreshStats
+	defer func() {
+		ociSDRefreshDuration.Observe(time.Since(t0).Seconds())
+		if err != nil {
+			ociSDRefreshFailuresCount.Inc()
+		}
+		d.health.record(err)
+		d.emitRefreshEvent(t0, stats, len(tgs), err)
+	}()
+
+	s := d.snapshot()
+	timeout, retries, delay := s.refreshTimeout, s.retryOnEmpty, s.retryOnEmptyDelay
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	for attempt := 1; ; attempt++ {
+		stats = refreshStats{}
+		tgs, err = s.refreshTargets(ctx, &stats)
+		if err != nil || len(tgs) > 0 || attempt > retries || !d.expectsTargets() {
+			break
+		}
+		level.Warn(d.logger).Log("msg", "Refresh found no targets, retrying", "attempt", attempt, "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if err == nil {
+		d.lastTargetsMtx.Lock()
+		d.lastTargets = len(tgs)
+		d.lastTargetsMtx.Unlock()
+	}
+	return tgs, err
+}
+
+// expectsTargets reports whether the last successful refresh found targets.
+func (d *Discovery) expectsTargets() bool {
+	d.lastTargetsMtx.Lock()
+	defer d.lastTargetsMtx.Unlock()
+	return d.lastTargets > 0
+}
+
+// refreshTargets performs a single attempt at discovering the targets. It runs
+// on a snapshot of the settings.
+func (d *Discovery) refreshTargets(ctx context.Context, stats *refreshStats) (tgs []*targetgroup.Group, err error) {
+	if len(d.tenancies) == 0 && d.rootCompartmentID == "" && d.compartmentIDsFile == "" && d.searchQuery == "" && !d.rotateAvailabilityDomains && d.regions == nil {
+		// A single compartment needs neither tenancy nor compartment tree
+		// handling.
+		stats.compartments++
+		t := tenancy{compartmentID: d.compartmentID, homeRegion: d.homeRegion, ociClientWrapper: d.ociClientWrapper}
+		if t.namespace, err = d.namespace(ctx, t); err != nil {
+			return nil, err
+		}
+		if t.name, err = d.tenancyName(ctx, t); err != nil {
+			return nil, err
+		}
+		if t.rootName, err = d.rootCompartmentName(ctx, t); err != nil {
+			return nil, err
+		}
+		tgs, err = d.refreshCompartment(ctx, t, compartmentRef{id: &t.compartmentID}, stats)
+	} else {
+		tgs, err = d.refreshTenancies(ctx, stats)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tgs = d.dedup(tgs)
+	if d.targetRemovalGracePeriod > 0 {
+		tgs = d.state().removalGrace.apply(tgs, d.targetRemovalGracePeriod, time.Now())
+	}
+	if d.sortTargets {
+		sortTargetGroups(tgs)
+	}
+	overflow := 0
+	if d.maxTargets > 0 && len(tgs) > d.maxTargets {
+		overflow = len(tgs) - d.maxTargets
+	}
+	ociSDTargetsOverLimit.Set(float64(overflow))
+	if overflow > 0 {
+		if d.failOnMaxTargets {
+			return nil, fmt.Errorf("found %d targets, more than the maximum of %d", len(tgs), d.maxTargets)
+		}
+		level.Warn(d.logger).Log("msg", "Dropping targets beyond the maximum", "targets", len(tgs), "max_targets", d.maxTargets)
+		tgs = tgs[:d.maxTargets]
+	}
+	if d.emitCompartmentSize {
+		labelCompartmentSizes(tgs)
+	}
+	if d.groupBy == groupByAvailabilityDomain {
+		tgs = groupByAD(tgs)
+	}
+	if d.postProcessor != nil {
+		tgs = d.postProcessor(tgs)
+	}
+	state := d.state()
+	state.compartmentNamesMtx.Lock()
+	state.compartmentNames = stats.compartmentNames
+	state.compartmentNamesMtx.Unlock()
+	if len(tgs) == 0 && d.hasFilters() {
+		level.Warn(d.logger).Log("msg", "No targets match the configured filters", "display_name", d.displayName, "availability_domain", d.availabilityDomain, "defined_tag_filters", len(d.definedTagFilters), "compartment_tag_filters", len(d.compartmentTagFilters), "ip_filter_cidrs", len(d.ipFilterNets), "compartments", stats.compartments, "instances_before_filtering", stats.instances)
+	}
+	return tgs, nil
+}
+
+// labelCompartmentSizes labels every target group with the number of targets
+// in its compartment.
+func labelCompartmentSizes(tgs []*targetgroup.Group) {
+	sizes := map[model.LabelValue]int{}
+	for _, tg := range tgs {
+		sizes[tg.Labels[ociCompartmentID]] += len(tg.Targets)
+	}
+	for _, tg := range tgs {
+		tg.Labels[ociCompartmentSize] = model.LabelValue(strconv.Itoa(sizes[tg.Labels[ociCompartmentID]]))
+	}
+}
+
+// groupByAD merges per-target groups into one group per tenancy and
+// availability domain, in the order the domains are first seen. The group
+// carries the tenancy and availability domain labels, every other label moves
+// to the target it was set for.
+func groupByAD(tgs []*targetgroup.Group) []*targetgroup.Group {
+	var grouped []*targetgroup.Group
+	groups := map[string]*targetgroup.Group{}
+	for _, tg := range tgs {
+		groupLabels := model.LabelSet{}
+		for _, name := range []model.LabelName{ociTenancyID, ociAvailabilityDomain} {
+			if value, ok := tg.Labels[name]; ok {
+				groupLabels[name] = value
+			}
+		}
+		key := string(groupLabels[ociTenancyID]) + "/" + string(groupLabels[ociAvailabilityDomain])
+		group, ok := groups[key]
+		if !ok {
+			source := "OCI_AD_" + string(groupLabels[ociAvailabilityDomain])
+			if tenancyID, ok := groupLabels[ociTenancyID]; ok {
+				source = fmt.Sprintf("OCI_AD_%s_%s", tenancyID, groupLabels[ociAvailabilityDomain])
+			}
+			group = &targetgroup.Group{Source: source, Labels: groupLabels}
+			groups[key] = group
+			grouped = append(grouped, group)
+		}
+		for _, target := range tg.Targets {
+			labels := tg.Labels.Merge(target)
+			for name := range groupLabels {
+				delete(labels, name)
+			}
+			group.Targets = append(group.Targets, labels)
+		}
+	}
+	return grouped
+}
+
+// sortTargetGroups sorts per-target groups by tenancy, region, compartment
+// and instance id, and by source among the groups of an instance. The region
+// is taken from the instance id, as targets aren't labeled with it.
+func sortTargetGroups(tgs []*targetgroup.Group) {
+	key := func(tg *targetgroup.Group) []string {
+		instanceID := string(tg.Labels[ociInstanceID])
+		return []string{string(tg.Labels[ociTenancyID]), instanceRegion(instanceID), string(tg.Labels[ociCompartmentID]), instanceID, tg.Source}
+	}
+	sort.SliceStable(tgs, func(i, j int) bool {
+		ki, kj := key(tgs[i]), key(tgs[j])
+		for n := range ki {
+			if ki[n] != kj[n] {
+				return ki[n] < kj[n]
+			}
+		}
+		return false
+	})
+}
+
+// instanceRegion returns the region key of an instance OCID of the form
+// ocid1.instance.<realm>.<region>.<unique id>, or an empty string for other
+// ids.
+func instanceRegion(instanceID string) string {
+	parts := strings.SplitN(instanceID, ".", 5)
+	if len(parts) < 5 {
+		return ""
+	}
+	return parts[3]
+}
+
+// instanceTargetGroups builds the target groups for all addresses of an
+// instance that passes the instance filters.
+func (d *Discovery) instanceTargetGroups(t tenancy, c compartment, instance Instance, addressBuilder AddressBuilder) (tgs []*targetgroup.Group) {
+	level.Debug(d.logger).Log("msg", "Considering instance", "instance", instance.ID, "display_name", instance.DisplayName, "compartment", instance.CompartmentID)
+	if !d.matchesDefinedTags(instance) {
+		level.Debug(d.logger).Log("msg", "Instance does not match defined tag filters", "instance", instance.ID)
+		return nil
+	}
+	if d.usePrometheusTagNamespace && !d.prometheusTagsEnabled(instance) {
+		level.Debug(d.logger).Log("msg", "Instance is disabled through its defined tags", "instance", instance.ID)
+		return nil
+	}
+	if instance.vnicErr != nil && !d.emitVNICErrors {
+		level.Warn(d.logger).Log("msg", "Skipping instance with unresolvable VNICs", "instance", instance.ID, "err", instance.vnicErr)
+		return nil
+	}
+	if instance.vnicErr != nil {
+		level.Warn(d.logger).Log("msg", "Keeping instance with unresolvable VNICs", "instance", instance.ID, "err", instance.vnicErr)
+	}
+	if instance.missingPreferredSubnet {
+		level.Warn(d.logger).Log("msg", "Instance has no VNIC on the preferred subnet, using its default address", "instance", instance.ID)
+	}
+	addressed := []Instance{instance}
+	if d.includeSecondaryIPs {
+		for _, ip := range instance.SecondaryPrivateIPs {
+			secondary := instance
+			secondary.PrivateIP = ip
+			// The public IP belongs to the primary private IP.
+			secondary.PublicIP = ""
+			addressed = append(addressed, secondary)
+		}
+	}
+	for i, instance := range addressed {
+		tg, err := d.targetGroup(t, c, instance, addressBuilder)
+		if err != nil {
+			level.Warn(d.logger).Log("msg", "Skipping instance without address", "instance", instance.ID, "err", err)
+			continue
+		}
+		if !d.matchesIPFilter(tg, instance) {
+			level.Debug(d.logger).Log("msg", "Target does not match IP filter CIDRs", "instance", instance.ID, "address", tg.Targets[0][model.AddressLabel])
+			continue
+		}
+		if d.includeSecondaryIPs {
+			tg.Labels[ociIsPrimaryIP] = model.LabelValue(strconv.FormatBool(i == 0))
+			if i > 0 {
+				tg.Source = d.source(t, instance, instance.PrivateIP)
+			}
+		}
+		level.Debug(d.logger).Log("msg", "Discovered target", "instance", instance.ID, "source", tg.Source, "address", tg.Targets[0][model.AddressLabel], "labels", tg.Labels)
+		tgs = append(tgs, tg)
+	}
+	return tgs
+}
+
+// matchesIPFilter reports whether the address of a target is an IP in one of
+// the IP filter CIDRs, or there are none. Targets without an address are
+// matched by the private IP of their instance.
+func (d *Discovery) matchesIPFilter(tg *targetgroup.Group, instance Instance) bool {
+	if len(d.ipFilterNets) == 0 {
+		return true
+	}
+	host := instance.PrivateIP
+	if addr, ok := tg.Targets[0][model.AddressLabel]; ok {
+		host = string(addr)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range d.ipFilterNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshSearch discovers the targets of the instances found by the search
+// query. Instances are filtered by display name and availability domain
+// here, as the search query takes the place of the listing filters.
+func (d *Discovery) refreshSearch(ctx context.Context, t tenancy, stats *refreshStats) ([]*targetgroup.Group, error) {
+	addressBuilder := d.addressBuilder
+	if addressBuilder == nil {
+		addressBuilder = defaultAddressBuilder{}
+	}
+
+	instances, err := t.ociClientWrapper.SearchInstances(ctx, d.searchQuery)
+	if err != nil {
+		return nil, err
+	}
+	stats.instances += len(instances)
+	compartments := map[string]compartment{}
+	var tgs []*targetgroup.Group
+	for _, instance := range instances {
+		if d.displayName != "" && instance.DisplayName != d.displayName ||
+			d.availabilityDomain != "" && instance.AvailabilityDomain != d.availabilityDomain ||
+			t.availabilityDomain != "" && instance.AvailabilityDomain != t.availabilityDomain {
+			continue
+		}
+		c, ok := compartments[instance.CompartmentID]
+		if !ok {
+			compartmentID := instance.CompartmentID
+			if c, err = t.ociClientWrapper.GetCompartment(ctx, &compartmentID); err != nil {
+				return nil, fmt.Errorf("error retrieving compartment from OCI: %s", err)
+			}
+			// Search results don't tell where in the tree they are.
+			c.depth = -1
+			compartments[instance.CompartmentID] = c
+			stats.addCompartmentName(instance.CompartmentID, c.name)
+		}
+		if !d.matchesCompartmentTags(c) {
+			continue
+		}
+		tgs = append(tgs, d.instanceTargetGroups(t, c, instance, addressBuilder)...)
+	}
+	stats.compartments += len(compartments)
+	return tgs, nil
+}
+
+// refreshTenancies discovers the targets of all configured tenancies, or of
+// the implicit single tenancy if none are configured.
+func (d *Discovery) refreshTenancies(ctx context.Context, stats *refreshStats) ([]*targetgroup.Group, error) {
+	var tgs []*targetgroup.Group
+	for _, t := range d.allTenancies() {
+		var err error
+		if t.namespace, err = d.namespace(ctx, t); err != nil {
+			return nil, err
+		}
+		if t.name, err = d.tenancyName(ctx, t); err != nil {
+			return nil, err
+		}
+		if t.rootName, err = d.rootCompartmentName(ctx, t); err != nil {
+			return nil, err
+		}
+		var tenancyTgs []*targetgroup.Group
+		if t.regions != nil {
+			tenancyTgs, err = d.refreshRegions(ctx, t, stats)
+		} else if d.rotateAvailabilityDomains {
+			tenancyTgs, err = d.refreshTenancyRotating(ctx, t, stats)
+		} else {
+			tenancyTgs, err = d.refreshTenancy(ctx, t, stats)
+		}
+		if err != nil {
+			return nil, err
+		}
+		tgs = append(tgs, tenancyTgs...)
+	}
+	if d.rotateAvailabilityDomains {
+		d.state().rotation.advance()
+	}
+	return tgs, nil
+}
+
+// namespace returns the object storage namespace of the tenancy if it is to
+// be emitted as a label, looking it up on first use.
+func (d *Discovery) namespace(ctx context.Context, t tenancy) (string, error) {
+	if !d.emitNamespace {
+		return "", nil
+	}
+	state := d.state()
+	state.namespaceMtx.Lock()
+	defer state.namespaceMtx.Unlock()
+	if namespace, ok := state.namespaces[t.id]; ok {
+		return namespace, nil
+	}
+	namespace, err := t.ociClientWrapper.GetNamespace(ctx)
+	if err != nil {
+		return "", err
+	}
+	if state.namespaces == nil {
+		state.namespaces = map[string]string{}
+	}
+	state.namespaces[t.id] = namespace
+	return namespace, nil
+}
+
+// tenancyName returns the name of the tenancy if it is to be emitted as a
+// label, looking it up on first use.
+func (d *Discovery) tenancyName(ctx context.Context, t tenancy) (string, error) {
+	if !d.emitTenancyName {
+		return "", nil
+	}
+	state := d.state()
+	state.tenancyNameMtx.Lock()
+	defer state.tenancyNameMtx.Unlock()
+	if name, ok := state.tenancyNames[t.id]; ok {
+		return name, nil
+	}
+	name, err := t.ociClientWrapper.GetTenancyName(ctx)
+	if err != nil {
+		return "", err
+	}
+	if state.tenancyNames == nil {
+		state.tenancyNames = map[string]string{}
+	}
+	state.tenancyNames[t.id] = name
+	return name, nil
+}
+
+// rootCompartmentName returns the name of the compartment the tenancy is
+// scoped to if it is emitted as a label, looking it up on first use.
+func (d *Discovery) rootCompartmentName(ctx context.Context, t tenancy) (string, error) {
+	if !d.emitRootName {
+		return "", nil
+	}
+	compartmentID := t.rootCompartmentID
+	if compartmentID == "" {
+		compartmentID = t.compartmentID
+	}
+	if compartmentID == "" {
+		return "", nil
+	}
+	key := t.id + "/" + compartmentID
+	state := d.state()
+	state.rootNameMtx.Lock()
+	defer state.rootNameMtx.Unlock()
+	if name, ok := state.rootNames[key]; ok {
+		return name, nil
+	}
+	c, err := t.ociClientWrapper.GetCompartment(ctx, &compartmentID)
+	if err != nil {
+		return "", err
+	}
+	if state.rootNames == nil {
+		state.rootNames = map[string]string{}
+	}
+	state.rootNames[key] = c.name
+	return c.name, nil
+}
+
+// allTenancies returns the configured tenancies, or the single implicit one
+// when none are configured.
+func (d *Discovery) allTenancies() []tenancy {
+	if len(d.tenancies) > 0 {
+		return d.tenancies
+	}
+	return []tenancy{{
+		compartmentID:     d.compartmentID,
+		rootCompartmentID: d.rootCompartmentID,
+		homeRegion:        d.homeRegion,
+		ociClientWrapper:  d.ociClientWrapper,
+		regions:           d.regions,
+	}}
+}
+
+// validateCredentials looks up the compartment configured for each tenancy,
+// so invalid credentials are reported right away instead of on the first
+// refresh.
+func (d *Discovery) validateCredentials(ctx context.Context) error {
+	for _, t := range d.allTenancies() {
+		compartmentID := t.compartmentID
+		if compartmentID == "" {
+			compartmentID = t.rootCompartmentID
+		}
+		if compartmentID == "" {
+			compartmentID = t.id
+		}
+		if compartmentID == "" {
+			level.Debug(d.logger).Log("msg", "No compartment to validate credentials with")
+			continue
+		}
+		if _, err := t.ociClientWrapper.GetCompartment(ctx, &compartmentID); err != nil {
+			if t.id != "" {
+				return fmt.Errorf("error validating credentials of tenancy %s: %s", t.id, err)
+			}
+			return fmt.Errorf("error validating credentials: %s", err)
+		}
+	}
+	return nil
+}
+
+// forEach calls f for each index below n, running at most limit calls at the
+// same time, and returns the first error encountered. A limit below 1 runs
+// the calls one at a time.
+func forEach(n int, limit int, f func(i int) error) error {
+	if limit < 1 {
+		limit = 1
+	}
+	var (
+		wg       sync.WaitGroup
+		mtx      sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, limit)
+	)
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := f(i); err != nil {
+				mtx.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mtx.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// refreshStats collects what a single refresh has looked at.
+type refreshStats struct {
+	compartments     int
+	instances        int
+	compartmentNames map[string]string
+}
+
+// addCompartmentName records the name of a compartment looked at.
+func (s *refreshStats) addCompartmentName(id, name string) {
+	if s.compartmentNames == nil {
+		s.compartmentNames = map[string]string{}
+	}
+	s.compartmentNames[id] = name
+}
+
+// matchesCompartmentTags reports whether the compartment carries all freeform
+// tags of the compartment tag filters.
+func (d *Discovery) matchesCompartmentTags(c compartment) bool {
+	for key, value := range d.compartmentTagFilters {
+		if v, ok := c.freeformTags[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Discovery) hasFilters() bool {
+	return d.displayName != "" || d.availabilityDomain != "" || len(d.ipFilterNets) > 0 || len(d.definedTagFilters) > 0 || len(d.compartmentTagFilters) > 0
+}
+
+// setCompartmentGauges records the number and maximum depth of the
+// compartments found below the root compartment of a tenancy. Compartments
+// are global, so all regions of a tenancy share the gauges.
+func setCompartmentGauges(tenancyID string, compartments []compartmentRef) {
+	maxDepth := 0
+	for _, c := range compartments {
+		if c.depth > maxDepth {
+			maxDepth = c.depth
+		}
+	}
+	ociSDCompartments.WithLabelValues(tenancyID).Set(float64(len(compartments)))
+	ociSDCompartmentDepth.WithLabelValues(tenancyID).Set(float64(maxDepth))
+}
+
+func (d *Discovery) refreshTenancy(ctx context.Context, t tenancy, stats *refreshStats) (tgs []*targetgroup.Group, err error) {
+	if d.searchQuery != "" {
+		return d.refreshSearch(ctx, t, stats)
+	}
+
+	var compartments []compartmentRef
+	if t.rootCompartmentID != "" {
+		compartments, err = t.ociClientWrapper.GetCompartmentIDs(ctx, &t.rootCompartmentID)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving compartment ids from OCI: %s", err)
+		}
+		setCompartmentGauges(t.id, compartments)
+		if len(compartments) == 0 && d.failOnNoCompartments {
+			return nil, fmt.Errorf("found no compartments below root compartment %s", t.rootCompartmentID)
+		}
+		if d.includeRootCompartment {
+			rootCompartmentID := t.rootCompartmentID
+			compartments = append([]compartmentRef{{id: &rootCompartmentID}}, compartments...)
+		}
+	} else if d.compartmentIDsFile != "" {
+		if compartments, err = d.fileCompartments(); err != nil {
+			return nil, err
+		}
+		if len(compartments) == 0 && d.failOnNoCompartments {
+			return nil, fmt.Errorf("found no compartments in compartment ids file %s", d.compartmentIDsFile)
+		}
+	} else {
+		compartments = []compartmentRef{{id: &t.compartmentID}}
+	}
+
+	stats.compartments += len(compartments)
+	compartmentTgs := make([][]*targetgroup.Group, len(compartments))
+	compartmentStats := make([]refreshStats, len(compartments))
+	err = forEach(len(compartments), d.compartmentConcurrency, func(i int) error {
+		if d.breakerThreshold <= 0 {
+			var err error
+			compartmentTgs[i], err = d.refreshCompartment(ctx, t, compartments[i], &compartmentStats[i])
+			return err
+		}
+		key := t.id + "/" + stringValue(compartments[i].id)
+		if !d.state().breaker.allow(key, time.Now()) {
+			level.Debug(d.logger).Log("msg", "Skipping compartment that kept failing", "compartment", stringValue(compartments[i].id))
+			ociSDCompartmentsSkippedCount.Inc()
+			return nil
+		}
+		var err error
+		compartmentTgs[i], err = d.refreshCompartment(ctx, t, compartments[i], &compartmentStats[i])
+		if err != nil && ctx.Err() != nil {
+			// Failures of the refresh as a whole aren't the compartment's.
+			return err
+		}
+		opened := d.state().breaker.record(key, err, d.breakerThreshold, d.breakerCooldown, time.Now())
+		if err == nil {
+			return nil
+		}
+		// The other compartments keep their targets while this one's
+		// failures add up to opening the breaker.
+		ociSDCompartmentFailuresCount.Inc()
+		compartmentTgs[i] = nil
+		if opened {
+			level.Warn(d.logger).Log("msg", "Skipping compartment that keeps failing", "compartment", stringValue(compartments[i].id), "cooldown", d.breakerCooldown, "err", err)
+		} else {
+			level.Warn(d.logger).Log("msg", "Refreshing compartment failed", "compartment", stringValue(compartments[i].id), "err", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range compartments {
+		tgs = append(tgs, compartmentTgs[i]...)
+		stats.instances += compartmentStats[i].instances
+		for id, name := range compartmentStats[i].compartmentNames {
+			stats.addCompartmentName(id, name)
+		}
+	}
+	return tgs, nil
+}
+
+// refreshCompartment discovers the targets of a single compartment.
+func (d *Discovery) refreshCompartment(ctx context.Context, t tenancy, ref compartmentRef, stats *refreshStats) (tgs []*targetgroup.Group, err error) {
+	compartmentID := ref.id
+	addressBuilder := d.addressBuilder
+	if addressBuilder == nil {
+		addressBuilder = defaultAddressBuilder{}
+	}
+
+	var filter instanceFilter
+	if d.displayName != "" {
+		filter.displayName = &d.displayName
+	}
+	if d.availabilityDomain != "" {
+		filter.availabilityDomain = &d.availabilityDomain
+	}
+	if t.availabilityDomain != "" {
+		filter.availabilityDomain = &t.availabilityDomain
+	}
+
+	c, err := t.ociClientWrapper.GetCompartment(ctx, compartmentID)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving compartment from OCI: %s", err)
+	}
+	c.depth = ref.depth
+	stats.addCompartmentName(stringValue(compartmentID), c.name)
+	if !d.matchesCompartmentTags(c) {
+		level.Debug(d.logger).Log("msg", "Compartment does not match compartment tag filters", "compartment", stringValue(compartmentID))
+		return nil, nil
+	}
+
+	listInstancesFunc := func(compartmentID *string, filter instanceFilter) (*instanceResponse, error) {
+		return t.ociClientWrapper.ListInstances(ctx, compartmentID, filter)
+	}
+	for instanceResponse, err := listInstancesFunc(compartmentID, filter); ; instanceResponse, err = listInstancesFunc(compartmentID, filter) {
+		if err != nil {
+			return tgs, fmt.Errorf("error retrieving targets from oci: %s", err)
+		}
+		stats.instances += len(instanceResponse.instances)
+		for _, instance := range instanceResponse.instances {
+			tgs = append(tgs, d.instanceTargetGroups(t, c, instance, addressBuilder)...)
+		}
+
+		if instanceResponse.OpcNextPage != nil {
+			filter.page = instanceResponse.OpcNextPage
+		} else {
+			break
 		}
 	}
 	return tgs, nil
@@ -1,12 +1,33 @@
 package oci
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	mathrand "math/rand"
+	"net/http"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oracle/oci-go-sdk/common"
+	"github.com/oracle/oci-go-sdk/core"
+	"github.com/oracle/oci-go-sdk/identity"
+	"github.com/oracle/oci-go-sdk/objectstorage"
+	"github.com/oracle/oci-go-sdk/resourcesearch"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/discovery/targetgroup"
 	"github.com/prometheus/prometheus/util/testutil"
@@ -14,6 +35,8 @@ import (
 
 var testCompartmentName = "compartment_name1"
 var testCompartmentID = "compartment_id1"
+var testNamespace = "namespace1"
+var testTenancyName = "tenancy_name1"
 var testInstanceID = "instance_id1"
 var testInstanceDisplayName = "instance_name1"
 var testInstancePrivateIP = "127.0.0.1"
@@ -38,32 +61,76 @@ var expectedTargetGroup = &targetgroup.Group{
 }
 
 type testOciClientWrapper struct {
+	instances []Instance
 }
 
-func (f testOciClientWrapper) GetCompartmentIDs(ctx context.Context, rootCompartmentID *string) ([]*string, error) {
+func (f testOciClientWrapper) GetCompartmentIDs(ctx context.Context, rootCompartmentID *string) ([]compartmentRef, error) {
 	id := testCompartmentID
-	ids := []*string{&id}
-	return ids, nil
+	return []compartmentRef{{id: &id, depth: 1}}, nil
 }
 
-func (f testOciClientWrapper) GetCompartmentName(ctx context.Context, compartmentID *string) (string, error) {
-	return testCompartmentName, nil
+func (f testOciClientWrapper) GetCompartment(ctx context.Context, compartmentID *string) (compartment, error) {
+	return compartment{name: testCompartmentName}, nil
 }
 
-func (f testOciClientWrapper) ListInstances(ctx context.Context, compartmentID *string, displayName *string) (*instanceResponse, error) {
-	if displayName != nil && testInstanceDisplayName != *displayName {
-		return &instanceResponse{nil, nil, []instance{}}, nil
+func (f testOciClientWrapper) GetNamespace(ctx context.Context) (string, error) {
+	return testNamespace, nil
+}
+
+func (f testOciClientWrapper) GetTenancyName(ctx context.Context) (string, error) {
+	return testTenancyName, nil
+}
+
+// ListAvailabilityDomains returns the availability domains of the instances
+// in order of appearance.
+func (f testOciClientWrapper) ListAvailabilityDomains(ctx context.Context, compartmentID *string) ([]string, error) {
+	var domains []string
+	seen := map[string]bool{}
+	for _, i := range f.instances {
+		if i.AvailabilityDomain != "" && !seen[i.AvailabilityDomain] {
+			seen[i.AvailabilityDomain] = true
+			domains = append(domains, i.AvailabilityDomain)
+		}
 	}
-	instances := []instance{
-		instance{
-			ID:            testInstanceID,
-			DisplayName:   testInstanceDisplayName,
-			CompartmentID: testCompartmentID,
-			privateIP:     testInstancePrivateIP,
-		},
+	return domains, nil
+}
+
+func (f testOciClientWrapper) ListRegionSubscriptions(ctx context.Context) ([]string, error) {
+	return nil, nil
+}
+
+func (f testOciClientWrapper) SearchInstances(ctx context.Context, query string) ([]Instance, error) {
+	response, err := f.ListInstances(ctx, &testCompartmentID, instanceFilter{})
+	if err != nil {
+		return nil, err
+	}
+	return response.instances, nil
+}
+
+func (f testOciClientWrapper) ListInstances(ctx context.Context, compartmentID *string, filter instanceFilter) (*instanceResponse, error) {
+	instances := f.instances
+	if instances == nil {
+		instances = []Instance{
+			Instance{
+				ID:            testInstanceID,
+				DisplayName:   testInstanceDisplayName,
+				CompartmentID: testCompartmentID,
+				PrivateIP:     testInstancePrivateIP,
+			},
+		}
+	}
+	filtered := []Instance{}
+	for _, i := range instances {
+		if filter.displayName != nil && i.DisplayName != *filter.displayName {
+			continue
+		}
+		if filter.availabilityDomain != nil && i.AvailabilityDomain != *filter.availabilityDomain {
+			continue
+		}
+		filtered = append(filtered, i)
 	}
 	instanceResponse := &instanceResponse{
-		instances: instances,
+		instances: filtered,
 	}
 	return instanceResponse, nil
 }
@@ -71,9 +138,12 @@ func (f testOciClientWrapper) ListInstances(ctx context.Context, compartmentID *
 func TestRefresh(t *testing.T) {
 	clientWrapper := &testOciClientWrapper{}
 	discovery := Discovery{
-		compartmentID:    testCompartmentID,
-		port:             testInstancePort,
-		ociClientWrapper: clientWrapper,
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
 	}
 	tgs, _ := discovery.refresh()
 	checkTarget(t, tgs)
@@ -82,10 +152,13 @@ func TestRefresh(t *testing.T) {
 func TestRun(t *testing.T) {
 	clientWrapper := &testOciClientWrapper{}
 	discovery := Discovery{
-		compartmentID:    testCompartmentID,
-		interval:         time.Duration(60 * time.Second),
-		port:             testInstancePort,
-		ociClientWrapper: clientWrapper,
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			interval:         time.Duration(60 * time.Second),
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	ch := make(chan []*targetgroup.Group)
@@ -97,11 +170,14 @@ func TestRun(t *testing.T) {
 func TestRunFilterDisplayName(t *testing.T) {
 	clientWrapper := &testOciClientWrapper{}
 	discovery := Discovery{
-		compartmentID:    testCompartmentID,
-		displayName:      testInstanceDisplayName,
-		interval:         time.Duration(60 * time.Second),
-		port:             testInstancePort,
-		ociClientWrapper: clientWrapper,
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			displayName:      testInstanceDisplayName,
+			interval:         time.Duration(60 * time.Second),
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	ch := make(chan []*targetgroup.Group)
@@ -110,6 +186,3464 @@ func TestRunFilterDisplayName(t *testing.T) {
 	cancel()
 }
 
+func TestRefreshTenancies(t *testing.T) {
+	discovery := Discovery{
+		settings: settings{
+			port:   testInstancePort,
+			logger: log.NewNopLogger(),
+			tenancies: []tenancy{
+				{
+					id:            "tenancy_id1",
+					compartmentID: testCompartmentID,
+					ociClientWrapper: &testOciClientWrapper{instances: []Instance{
+						{ID: "instance_id1", DisplayName: "instance_name1", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1"},
+					}},
+				},
+				{
+					id:                "tenancy_id2",
+					rootCompartmentID: "root_compartment_id2",
+					ociClientWrapper: &testOciClientWrapper{instances: []Instance{
+						{ID: "instance_id2", DisplayName: "instance_name2", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.2"},
+					}},
+				},
+			},
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+	testutil.Equals(t, model.LabelValue("tenancy_id1"), tgs[0].Labels[ociTenancyID])
+	testutil.Equals(t, model.LabelValue("instance_id1"), tgs[0].Labels[ociInstanceID])
+	testutil.Equals(t, model.LabelValue("10.0.0.1:9100"), tgs[0].Labels[model.AddressLabel])
+	testutil.Equals(t, model.LabelValue("tenancy_id2"), tgs[1].Labels[ociTenancyID])
+	testutil.Equals(t, model.LabelValue("instance_id2"), tgs[1].Labels[ociInstanceID])
+	testutil.Equals(t, model.LabelValue("10.0.0.2:9100"), tgs[1].Labels[model.AddressLabel])
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		conf  SDConfig
+		valid bool
+	}{
+		{
+			name:  "single compartment",
+			conf:  SDConfig{CompartmentID: testCompartmentID},
+			valid: true,
+		},
+		{
+			name:  "vnic error labels",
+			conf:  SDConfig{CompartmentID: testCompartmentID, SkipVNICErrors: true, EmitVNICErrors: true},
+			valid: true,
+		},
+		{
+			name: "vnic error labels without skipping vnic errors",
+			conf: SDConfig{CompartmentID: testCompartmentID, EmitVNICErrors: true},
+		},
+		{
+			name: "two tenancies",
+			conf: SDConfig{Tenancies: []TenancyConfig{
+				{TenancyID: "tenancy_id1", CompartmentID: testCompartmentID},
+				{TenancyID: "tenancy_id2", RootCompartmentID: "root_compartment_id2"},
+			}},
+			valid: true,
+		},
+		{
+			name:  "accessible compartments",
+			conf:  SDConfig{CompartmentID: testCompartmentID, CompartmentAccessLevel: "ACCESSIBLE"},
+			valid: true,
+		},
+		{
+			name: "unknown compartment access level",
+			conf: SDConfig{CompartmentID: testCompartmentID, CompartmentAccessLevel: "SOME"},
+		},
+		{
+			name:  "grouped by availability domain",
+			conf:  SDConfig{CompartmentID: testCompartmentID, GroupBy: "availability_domain"},
+			valid: true,
+		},
+		{
+			name:  "root child names",
+			conf:  SDConfig{RootCompartmentID: "root_compartment_id1", RootChildNames: []string{"prod"}},
+			valid: true,
+		},
+		{
+			name: "root child names without root",
+			conf: SDConfig{CompartmentID: testCompartmentID, RootChildNames: []string{"prod"}},
+		},
+		{
+			name:  "all subscribed regions",
+			conf:  SDConfig{CompartmentID: testCompartmentID, AllSubscribedRegions: true, RegionAllowlist: []string{"us-ashburn-1"}},
+			valid: true,
+		},
+		{
+			name: "region allowlist without subscribed regions",
+			conf: SDConfig{CompartmentID: testCompartmentID, RegionAllowlist: []string{"us-ashburn-1"}},
+		},
+		{
+			name: "invalid sanitized tag key prefix",
+			conf: SDConfig{CompartmentID: testCompartmentID, SanitizedTagKeyPrefix: "oci-"},
+		},
+		{
+			name:  "compartment ids file",
+			conf:  SDConfig{CompartmentIDsFile: "compartments"},
+			valid: true,
+		},
+		{
+			name: "compartment ids file with compartment id",
+			conf: SDConfig{CompartmentID: testCompartmentID, CompartmentIDsFile: "compartments"},
+		},
+		{
+			name: "compartment ids file with search query",
+			conf: SDConfig{SearchQuery: "query instance resources", CompartmentIDsFile: "compartments"},
+		},
+		{
+			name: "negative compartment failure threshold",
+			conf: SDConfig{CompartmentID: testCompartmentID, CompartmentFailureThreshold: -1},
+		},
+		{
+			name: "compartment failure threshold without cooldown",
+			conf: SDConfig{CompartmentID: testCompartmentID, CompartmentFailureThreshold: 3},
+		},
+		{
+			name: "negative shards",
+			conf: SDConfig{CompartmentID: testCompartmentID, Shards: -1},
+		},
+		{
+			name: "negative principal bootstrap timeout",
+			conf: SDConfig{CompartmentID: testCompartmentID, PrincipalBootstrapTimeout: model.Duration(-time.Second)},
+		},
+		{
+			name: "negative principal bootstrap retries",
+			conf: SDConfig{CompartmentID: testCompartmentID, PrincipalBootstrapRetries: -1},
+		},
+		{
+			name: "negative max concurrent requests",
+			conf: SDConfig{CompartmentID: testCompartmentID, MaxConcurrentRequests: -1},
+		},
+		{
+			name:  "IP filter CIDRs",
+			conf:  SDConfig{CompartmentID: testCompartmentID, IPFilterCIDRs: []string{"10.0.1.0/24", "fd00::/8"}},
+			valid: true,
+		},
+		{
+			name: "invalid IP filter CIDR",
+			conf: SDConfig{CompartmentID: testCompartmentID, IPFilterCIDRs: []string{"10.0.1.0"}},
+		},
+		{
+			name:  "rotating availability domains",
+			conf:  SDConfig{CompartmentID: testCompartmentID, RotateAvailabilityDomains: true},
+			valid: true,
+		},
+		{
+			name: "rotating availability domains with filter",
+			conf: SDConfig{CompartmentID: testCompartmentID, RotateAvailabilityDomains: true, AvailabilityDomain: "AD-1"},
+		},
+		{
+			name:  "metadata only states",
+			conf:  SDConfig{CompartmentID: testCompartmentID, MetadataOnlyStates: []string{"STOPPED"}},
+			valid: true,
+		},
+		{
+			name: "running metadata only state",
+			conf: SDConfig{CompartmentID: testCompartmentID, MetadataOnlyStates: []string{"RUNNING"}},
+		},
+		{
+			name:  "scrapeable states",
+			conf:  SDConfig{CompartmentID: testCompartmentID, ScrapeableStates: []string{"RUNNING", "STOPPED"}, MetadataOnlyStates: []string{"TERMINATED"}},
+			valid: true,
+		},
+		{
+			name: "unknown scrapeable state",
+			conf: SDConfig{CompartmentID: testCompartmentID, ScrapeableStates: []string{"running"}},
+		},
+		{
+			name: "scrapeable and metadata only state",
+			conf: SDConfig{CompartmentID: testCompartmentID, ScrapeableStates: []string{"STOPPED"}, MetadataOnlyStates: []string{"STOPPED"}},
+		},
+		{
+			name: "unknown metadata only state",
+			conf: SDConfig{CompartmentID: testCompartmentID, MetadataOnlyStates: []string{"stopped"}},
+		},
+		{
+			name:  "utf8 label names",
+			conf:  SDConfig{CompartmentID: testCompartmentID, LabelNameMode: "utf8"},
+			valid: true,
+		},
+		{
+			name: "unknown label name mode",
+			conf: SDConfig{CompartmentID: testCompartmentID, LabelNameMode: "ascii"},
+		},
+		{
+			name: "unknown grouping",
+			conf: SDConfig{CompartmentID: testCompartmentID, GroupBy: "region"},
+		},
+		{
+			name:  "instance sorting",
+			conf:  SDConfig{CompartmentID: testCompartmentID, InstanceSortBy: "DISPLAYNAME", InstanceSortOrder: "ASC", InstancePageLimit: 50},
+			valid: true,
+		},
+		{
+			name:  "address preference",
+			conf:  SDConfig{CompartmentID: testCompartmentID, AddressPreference: []string{"public", "private"}},
+			valid: true,
+		},
+		{
+			name: "unknown address preference",
+			conf: SDConfig{CompartmentID: testCompartmentID, AddressPreference: []string{"ipv6"}},
+		},
+		{
+			name: "duplicate address preference",
+			conf: SDConfig{CompartmentID: testCompartmentID, AddressPreference: []string{"private", "private"}},
+		},
+		{
+			name:  "port from defined tag",
+			conf:  SDConfig{CompartmentID: testCompartmentID, PortFromDefinedTag: "monitoring.port"},
+			valid: true,
+		},
+		{
+			name: "port from defined tag without namespace",
+			conf: SDConfig{CompartmentID: testCompartmentID, PortFromDefinedTag: "port"},
+		},
+		{
+			name: "cost center tag without namespace",
+			conf: SDConfig{CompartmentID: testCompartmentID, CostCenterTag: "cost_center"},
+		},
+		{
+			name:  "search query",
+			conf:  SDConfig{SearchQuery: "query instance resources"},
+			valid: true,
+		},
+		{
+			name:  "search query with tenancies",
+			conf:  SDConfig{SearchQuery: "query instance resources", Tenancies: []TenancyConfig{{TenancyID: "tenancy_id1"}}},
+			valid: true,
+		},
+		{
+			name: "search query with compartment",
+			conf: SDConfig{SearchQuery: "query instance resources", CompartmentID: testCompartmentID},
+		},
+		{
+			name: "search query with tenancy compartment",
+			conf: SDConfig{SearchQuery: "query instance resources", Tenancies: []TenancyConfig{{TenancyID: "tenancy_id1", RootCompartmentID: "root_compartment_id1"}}},
+		},
+		{
+			name: "negative max targets",
+			conf: SDConfig{CompartmentID: testCompartmentID, MaxTargets: -1},
+		},
+		{
+			name: "unknown instance sort by",
+			conf: SDConfig{CompartmentID: testCompartmentID, InstanceSortBy: "NAME"},
+		},
+		{
+			name: "unknown instance sort order",
+			conf: SDConfig{CompartmentID: testCompartmentID, InstanceSortOrder: "UP"},
+		},
+		{
+			name: "negative instance page limit",
+			conf: SDConfig{CompartmentID: testCompartmentID, InstancePageLimit: -1},
+		},
+		{
+			name: "top level compartment with tenancies",
+			conf: SDConfig{CompartmentID: testCompartmentID, Tenancies: []TenancyConfig{
+				{TenancyID: "tenancy_id1", CompartmentID: testCompartmentID},
+			}},
+		},
+		{
+			name: "missing tenancy id",
+			conf: SDConfig{Tenancies: []TenancyConfig{
+				{CompartmentID: testCompartmentID},
+			}},
+		},
+		{
+			name: "duplicate tenancy id",
+			conf: SDConfig{Tenancies: []TenancyConfig{
+				{TenancyID: "tenancy_id1", CompartmentID: testCompartmentID},
+				{TenancyID: "tenancy_id1", RootCompartmentID: "root_compartment_id2"},
+			}},
+		},
+		{
+			name: "tenancy without compartment",
+			conf: SDConfig{Tenancies: []TenancyConfig{
+				{TenancyID: "tenancy_id1"},
+			}},
+		},
+	} {
+		err := tc.conf.Validate()
+		if tc.valid && err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%s: expected validation error", tc.name)
+		}
+	}
+}
+
+func TestRefreshFingerprint(t *testing.T) {
+	clientWrapper := &testOciClientWrapper{}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	fingerprint := tgs[0].Labels[ociFingerprint]
+	if fingerprint == "" {
+		t.Fatal("expected fingerprint label to be set")
+	}
+
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, fingerprint, tgs[0].Labels[ociFingerprint])
+
+	// Renaming the instance keeps the fingerprint, changing its IP does not.
+	clientWrapper.instances = []Instance{
+		{ID: testInstanceID, DisplayName: "renamed", CompartmentID: testCompartmentID, PrivateIP: testInstancePrivateIP},
+	}
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, fingerprint, tgs[0].Labels[ociFingerprint])
+
+	clientWrapper.instances = []Instance{
+		{ID: testInstanceID, DisplayName: testInstanceDisplayName, CompartmentID: testCompartmentID, PrivateIP: "127.0.0.2"},
+	}
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	if tgs[0].Labels[ociFingerprint] == fingerprint {
+		t.Errorf("expected fingerprint to change with the private IP, got %s", fingerprint)
+	}
+}
+
+// testIdentityClient records the requests it receives. It lists the
+// children of a compartment from compartments, or a single active
+// compartment below any compartment other than itself if compartments is nil.
+type testIdentityClient struct {
+	compartments             []identity.Compartment
+	listCompartmentsRequests []identity.ListCompartmentsRequest
+	availabilityDomains      []string
+	regionSubscriptions      []identity.RegionSubscription
+}
+
+func (c *testIdentityClient) ListCompartments(ctx context.Context, request identity.ListCompartmentsRequest) (identity.ListCompartmentsResponse, error) {
+	c.listCompartmentsRequests = append(c.listCompartmentsRequests, request)
+	compartments := c.compartments
+	if compartments == nil {
+		compartments = []identity.Compartment{{Id: common.String(testCompartmentID), CompartmentId: request.CompartmentId, LifecycleState: identity.CompartmentLifecycleStateActive}}
+		if *request.CompartmentId == testCompartmentID {
+			compartments = nil
+		}
+	}
+	var children []identity.Compartment
+	for _, compartment := range compartments {
+		if stringValue(compartment.CompartmentId) == stringValue(request.CompartmentId) {
+			children = append(children, compartment)
+		}
+	}
+	return identity.ListCompartmentsResponse{Items: children}, nil
+}
+
+func (c *testIdentityClient) GetCompartment(ctx context.Context, request identity.GetCompartmentRequest) (identity.GetCompartmentResponse, error) {
+	name := testCompartmentName
+	var parentID *string
+	for _, compartment := range c.compartments {
+		if stringValue(compartment.Id) == stringValue(request.CompartmentId) {
+			parentID = compartment.CompartmentId
+		}
+	}
+	return identity.GetCompartmentResponse{Compartment: identity.Compartment{Id: request.CompartmentId, Name: &name, CompartmentId: parentID}}, nil
+}
+
+func (c *testIdentityClient) ListAvailabilityDomains(ctx context.Context, request identity.ListAvailabilityDomainsRequest) (identity.ListAvailabilityDomainsResponse, error) {
+	var items []identity.AvailabilityDomain
+	for i := range c.availabilityDomains {
+		items = append(items, identity.AvailabilityDomain{Name: &c.availabilityDomains[i], CompartmentId: request.CompartmentId})
+	}
+	return identity.ListAvailabilityDomainsResponse{Items: items}, nil
+}
+
+func (c *testIdentityClient) ListRegionSubscriptions(ctx context.Context, request identity.ListRegionSubscriptionsRequest) (identity.ListRegionSubscriptionsResponse, error) {
+	return identity.ListRegionSubscriptionsResponse{Items: c.regionSubscriptions}, nil
+}
+
+func (c *testIdentityClient) GetTenancy(ctx context.Context, request identity.GetTenancyRequest) (identity.GetTenancyResponse, error) {
+	return identity.GetTenancyResponse{Tenancy: identity.Tenancy{Id: request.TenancyId, Name: common.String(*request.TenancyId + "_name")}}, nil
+}
+
+func TestGetCompartmentIDsAccessLevel(t *testing.T) {
+	for _, accessLevel := range []identity.ListCompartmentsAccessLevelEnum{
+		identity.ListCompartmentsAccessLevelAccessible,
+		identity.ListCompartmentsAccessLevelAny,
+	} {
+		identityClient := &testIdentityClient{}
+		clientWrapper := remoteOciClientWrapper{
+			ociIdentityClient:      identityClient,
+			compartmentAccessLevel: accessLevel,
+		}
+		rootCompartmentID := "root_compartment_id1"
+		ids, err := clientWrapper.GetCompartmentIDs(context.Background(), &rootCompartmentID)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(ids))
+		testutil.Equals(t, 1, len(identityClient.listCompartmentsRequests))
+		testutil.Equals(t, accessLevel, identityClient.listCompartmentsRequests[0].AccessLevel)
+	}
+}
+
+func TestParseDefinedTagFilter(t *testing.T) {
+	for _, tc := range []struct {
+		filter   string
+		expected definedTagFilter
+		valid    bool
+	}{
+		{"Monitoring.env=prod", definedTagFilter{namespace: "Monitoring", key: "env", value: "prod"}, true},
+		{"Monitoring.env=*", definedTagFilter{namespace: "Monitoring", key: "env", exists: true}, true},
+		{"Monitoring.env=", definedTagFilter{namespace: "Monitoring", key: "env", exists: true}, true},
+		{"Monitoring.env", definedTagFilter{namespace: "Monitoring", key: "env", exists: true}, true},
+		{"Monitoring=prod", definedTagFilter{}, false},
+		{".env=prod", definedTagFilter{}, false},
+		{"Monitoring.=prod", definedTagFilter{}, false},
+	} {
+		f, err := parseDefinedTagFilter(tc.filter)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("%s: expected parse error", tc.filter)
+			}
+			continue
+		}
+		testutil.Ok(t, err)
+		testutil.Equals(t, tc.expected, f)
+	}
+}
+
+func TestRefreshDefinedTagExists(t *testing.T) {
+	clientWrapper := &testOciClientWrapper{instances: []Instance{
+		{
+			ID:            "instance_id1",
+			DisplayName:   "instance_name1",
+			CompartmentID: testCompartmentID,
+			PrivateIP:     "10.0.0.1",
+			DefinedTags:   map[string]map[string]interface{}{"Monitoring": {"env": "prod"}},
+		},
+		{
+			ID:            "instance_id2",
+			DisplayName:   "instance_name2",
+			CompartmentID: testCompartmentID,
+			PrivateIP:     "10.0.0.2",
+			DefinedTags:   map[string]map[string]interface{}{"Monitoring": {"env": "dev"}},
+		},
+		{
+			ID:            "instance_id3",
+			DisplayName:   "instance_name3",
+			CompartmentID: testCompartmentID,
+			PrivateIP:     "10.0.0.3",
+			DefinedTags:   map[string]map[string]interface{}{"Operations": {"env": "prod"}},
+		},
+	}}
+	for _, tc := range []struct {
+		filter   string
+		expected []string
+	}{
+		{"Monitoring.env=*", []string{"instance_id1", "instance_id2"}},
+		{"Monitoring.env", []string{"instance_id1", "instance_id2"}},
+		{"Monitoring.env=prod", []string{"instance_id1"}},
+		{"Monitoring.owner=*", []string{}},
+	} {
+		f, err := parseDefinedTagFilter(tc.filter)
+		testutil.Ok(t, err)
+		discovery := Discovery{
+			settings: settings{
+				compartmentID:     testCompartmentID,
+				port:              testInstancePort,
+				logger:            log.NewNopLogger(),
+				ociClientWrapper:  clientWrapper,
+				definedTagFilters: []definedTagFilter{f},
+			},
+		}
+		tgs, err := discovery.refresh()
+		testutil.Ok(t, err)
+		ids := []string{}
+		for _, tg := range tgs {
+			ids = append(ids, string(tg.Labels[ociInstanceID]))
+		}
+		testutil.Equals(t, tc.expected, ids)
+	}
+}
+
+// hostnameAddressBuilder addresses instances by their display name.
+type hostnameAddressBuilder struct {
+	domain string
+}
+
+func (b hostnameAddressBuilder) BuildAddress(instance Instance, conf AddressConfig) (string, model.LabelSet, error) {
+	if instance.DisplayName == "" {
+		return "", nil, fmt.Errorf("instance %s has no display name", instance.ID)
+	}
+	hostname := fmt.Sprintf("%s.%s", instance.DisplayName, b.domain)
+	return fmt.Sprintf("%s:%d", hostname, conf.Port), model.LabelSet{"__meta_oci_hostname": model.LabelValue(hostname)}, nil
+}
+
+func TestRefreshAddressBuilder(t *testing.T) {
+	clientWrapper := &testOciClientWrapper{instances: []Instance{
+		{ID: "instance_id1", DisplayName: "instance_name1", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1"},
+		{ID: "instance_id2", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.2"},
+	}}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	discovery.addressBuilder = hostnameAddressBuilder{domain: "example.com"}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(tgs))
+	testutil.Equals(t, []model.LabelSet{{model.AddressLabel: "instance_name1.example.com:9100"}}, tgs[0].Targets)
+	testutil.Equals(t, model.LabelValue("instance_name1.example.com"), tgs[0].Labels["__meta_oci_hostname"])
+}
+
+func TestRefreshWarnsWhenFiltersMatchNothing(t *testing.T) {
+	filter, err := parseDefinedTagFilter("Monitoring.env=prod")
+	testutil.Ok(t, err)
+	for _, tc := range []struct {
+		name              string
+		displayName       string
+		definedTagFilters []definedTagFilter
+		expected          string
+	}{
+		{
+			name:        "display name",
+			displayName: "unknown",
+			expected:    "instances_before_filtering=0",
+		},
+		{
+			name:              "defined tags",
+			definedTagFilters: []definedTagFilter{filter},
+			expected:          "instances_before_filtering=1",
+		},
+	} {
+		var buf bytes.Buffer
+		discovery := Discovery{
+			settings: settings{
+				compartmentID:     testCompartmentID,
+				displayName:       tc.displayName,
+				definedTagFilters: tc.definedTagFilters,
+				port:              testInstancePort,
+				ociClientWrapper:  &testOciClientWrapper{},
+				logger:            log.NewLogfmtLogger(&buf),
+			},
+		}
+		tgs, err := discovery.refresh()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 0, len(tgs))
+		if !strings.Contains(buf.String(), "No targets match the configured filters") {
+			t.Errorf("%s: expected warning, got %q", tc.name, buf.String())
+		}
+		if !strings.Contains(buf.String(), tc.expected) {
+			t.Errorf("%s: expected %s in warning, got %q", tc.name, tc.expected, buf.String())
+		}
+	}
+
+	// Without filters an empty compartment is not worth a warning.
+	var buf bytes.Buffer
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			ociClientWrapper: &testOciClientWrapper{instances: []Instance{}},
+			logger:           log.NewLogfmtLogger(&buf),
+		},
+	}
+	_, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, "", buf.String())
+}
+
+// testComputeClient serves instances and their VNIC attachments and records
+// the list requests it receives.
+type testComputeClient struct {
+	instances             []core.Instance
+	vnicAttachments       map[string][]core.VnicAttachment
+	bootVolumeAttachments map[string][]core.BootVolumeAttachment
+	listInstancesRequests []core.ListInstancesRequest
+	mtx                   sync.Mutex
+}
+
+func (c *testComputeClient) ListInstances(ctx context.Context, request core.ListInstancesRequest) (core.ListInstancesResponse, error) {
+	c.mtx.Lock()
+	c.listInstancesRequests = append(c.listInstancesRequests, request)
+	c.mtx.Unlock()
+	if request.Limit == nil {
+		return core.ListInstancesResponse{Items: c.instances}, nil
+	}
+	// Pages are identified by the index of their first instance.
+	start := 0
+	if request.Page != nil {
+		start, _ = strconv.Atoi(*request.Page)
+	}
+	end := start + *request.Limit
+	if end >= len(c.instances) {
+		return core.ListInstancesResponse{Items: c.instances[start:]}, nil
+	}
+	return core.ListInstancesResponse{Items: c.instances[start:end], OpcNextPage: common.String(strconv.Itoa(end))}, nil
+}
+
+func (c *testComputeClient) GetInstance(ctx context.Context, request core.GetInstanceRequest) (core.GetInstanceResponse, error) {
+	for _, instance := range c.instances {
+		if *instance.Id == *request.InstanceId {
+			return core.GetInstanceResponse{Instance: instance}, nil
+		}
+	}
+	return core.GetInstanceResponse{}, fmt.Errorf("instance %s not found", *request.InstanceId)
+}
+
+func (c *testComputeClient) ListBootVolumeAttachments(ctx context.Context, request core.ListBootVolumeAttachmentsRequest) (core.ListBootVolumeAttachmentsResponse, error) {
+	return core.ListBootVolumeAttachmentsResponse{Items: c.bootVolumeAttachments[*request.InstanceId]}, nil
+}
+
+func (c *testComputeClient) ListVnicAttachments(ctx context.Context, request core.ListVnicAttachmentsRequest) (core.ListVnicAttachmentsResponse, error) {
+	return core.ListVnicAttachmentsResponse{Items: c.vnicAttachments[*request.InstanceId]}, nil
+}
+
+// testVirtualNetworkClient serves VNICs and their private IPs by VNIC id,
+// and subnets by subnet id, counting subnet lookups.
+type testVirtualNetworkClient struct {
+	vnics         map[string]core.Vnic
+	privateIPs    map[string][]core.PrivateIp
+	subnets       map[string]core.Subnet
+	subnetLookups int
+	mtx           sync.Mutex
+}
+
+func (c *testVirtualNetworkClient) GetVnic(ctx context.Context, request core.GetVnicRequest) (core.GetVnicResponse, error) {
+	vnic, ok := c.vnics[*request.VnicId]
+	if !ok {
+		return core.GetVnicResponse{}, fmt.Errorf("vnic %s not found", *request.VnicId)
+	}
+	return core.GetVnicResponse{Vnic: vnic}, nil
+}
+
+func (c *testVirtualNetworkClient) ListPrivateIps(ctx context.Context, request core.ListPrivateIpsRequest) (core.ListPrivateIpsResponse, error) {
+	return core.ListPrivateIpsResponse{Items: c.privateIPs[*request.VnicId]}, nil
+}
+
+func (c *testVirtualNetworkClient) GetSubnet(ctx context.Context, request core.GetSubnetRequest) (core.GetSubnetResponse, error) {
+	c.mtx.Lock()
+	c.subnetLookups++
+	c.mtx.Unlock()
+	subnet, ok := c.subnets[*request.SubnetId]
+	if !ok {
+		return core.GetSubnetResponse{}, fmt.Errorf("subnet %s not found", *request.SubnetId)
+	}
+	return core.GetSubnetResponse{Subnet: subnet}, nil
+}
+
+// newTestRemoteOciClientWrapper returns a remote client wrapper backed by
+// mocks serving the test instance with a single VNIC.
+func newTestRemoteOciClientWrapper() (remoteOciClientWrapper, *testComputeClient, *testVirtualNetworkClient) {
+	computeClient := &testComputeClient{
+		instances: []core.Instance{{
+			Id:            common.String(testInstanceID),
+			DisplayName:   common.String(testInstanceDisplayName),
+			CompartmentId: common.String(testCompartmentID),
+		}},
+		vnicAttachments: map[string][]core.VnicAttachment{
+			testInstanceID: {{InstanceId: common.String(testInstanceID), VnicId: common.String("vnic_id1")}},
+		},
+	}
+	virtualNetworkClient := &testVirtualNetworkClient{
+		vnics: map[string]core.Vnic{
+			"vnic_id1": {Id: common.String("vnic_id1"), PrivateIp: common.String(testInstancePrivateIP)},
+		},
+	}
+	clientWrapper := remoteOciClientWrapper{
+		ociIdentityClient:       &testIdentityClient{},
+		ociComputeClient:        computeClient,
+		ociVirtualNetworkClient: virtualNetworkClient,
+		subnets:                 &subnetCache{},
+	}
+	return clientWrapper, computeClient, virtualNetworkClient
+}
+
+func TestRefreshSecondaryPrivateIPs(t *testing.T) {
+	clientWrapper, _, virtualNetworkClient := newTestRemoteOciClientWrapper()
+	virtualNetworkClient.privateIPs = map[string][]core.PrivateIp{
+		"vnic_id1": {
+			{IpAddress: common.String(testInstancePrivateIP), IsPrimary: common.Bool(true)},
+			{IpAddress: common.String("127.0.0.2"), IsPrimary: common.Bool(false)},
+		},
+	}
+	clientWrapper.includeSecondaryIPs = true
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:       testCompartmentID,
+			port:                testInstancePort,
+			logger:              log.NewNopLogger(),
+			ociClientWrapper:    clientWrapper,
+			includeSecondaryIPs: true,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+	checkTarget(t, tgs[:1])
+	testutil.Equals(t, model.LabelValue("true"), tgs[0].Labels[ociIsPrimaryIP])
+	testutil.Equals(t, []model.LabelSet{{model.AddressLabel: "127.0.0.2:9100"}}, tgs[1].Targets)
+	testutil.Equals(t, model.LabelValue("false"), tgs[1].Labels[ociIsPrimaryIP])
+	testutil.Equals(t, model.LabelValue(testInstanceID), tgs[1].Labels[ociInstanceID])
+	if tgs[0].Source == tgs[1].Source {
+		t.Errorf("expected distinct sources per private IP, got %s twice", tgs[0].Source)
+	}
+
+	// Secondary IPs are not looked up unless asked for.
+	clientWrapper.includeSecondaryIPs = false
+	discovery.ociClientWrapper = clientWrapper
+	discovery.includeSecondaryIPs = false
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	checkTarget(t, tgs)
+	testutil.Equals(t, model.LabelValue(""), tgs[0].Labels[ociIsPrimaryIP])
+}
+
+func TestRefreshRoleTag(t *testing.T) {
+	clientWrapper := &testOciClientWrapper{instances: []Instance{
+		{ID: "instance_id1", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1", FreeformTags: map[string]string{"k8s-role": "worker"}},
+		{ID: "instance_id2", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.2"},
+	}}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+			roleTag:          "k8s-role",
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+	testutil.Equals(t, model.LabelValue("worker"), tgs[0].Labels[ociRole])
+	_, ok := tgs[1].Labels[ociRole]
+	testutil.Equals(t, false, ok)
+}
+
+func TestRefreshDisplayNameFilterLabel(t *testing.T) {
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			displayName:      testInstanceDisplayName,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: &testOciClientWrapper{},
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	checkTarget(t, tgs)
+	_, ok := tgs[0].Labels[ociDisplayNameFilter]
+	testutil.Equals(t, false, ok)
+
+	discovery.displayNameFilterLabel = true
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelValue(testInstanceDisplayName), tgs[0].Labels[ociDisplayNameFilter])
+}
+
+func TestRefreshAddressPreference(t *testing.T) {
+	clientWrapper := &testOciClientWrapper{instances: []Instance{
+		{ID: "instance_id1", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1", PublicIP: "203.0.113.1"},
+		{ID: "instance_id2", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.2"},
+	}}
+	for _, tc := range []struct {
+		preference []string
+		expected   []model.LabelValue
+	}{
+		{
+			expected: []model.LabelValue{"10.0.0.1:9100", "10.0.0.2:9100"},
+		},
+		{
+			preference: []string{"private", "public"},
+			expected:   []model.LabelValue{"10.0.0.1:9100", "10.0.0.2:9100"},
+		},
+		{
+			preference: []string{"public", "private"},
+			expected:   []model.LabelValue{"203.0.113.1:9100", "10.0.0.2:9100"},
+		},
+		{
+			preference: []string{"public"},
+			expected:   []model.LabelValue{"203.0.113.1:9100"},
+		},
+	} {
+		discovery := Discovery{
+			settings: settings{
+				compartmentID:     testCompartmentID,
+				port:              testInstancePort,
+				logger:            log.NewNopLogger(),
+				ociClientWrapper:  clientWrapper,
+				addressPreference: tc.preference,
+			},
+		}
+		tgs, err := discovery.refresh()
+		testutil.Ok(t, err)
+		var addresses []model.LabelValue
+		for _, tg := range tgs {
+			addresses = append(addresses, tg.Targets[0][model.AddressLabel])
+		}
+		testutil.Equals(t, tc.expected, addresses)
+		testutil.Equals(t, model.LabelValue("10.0.0.1"), tgs[0].Labels[ociPrivateIP])
+		testutil.Equals(t, model.LabelValue("203.0.113.1"), tgs[0].Labels[ociPublicIP])
+	}
+}
+
+func TestParseScrapeHint(t *testing.T) {
+	for _, tc := range []struct {
+		hint     string
+		expected scrapeHint
+		valid    bool
+	}{
+		{hint: "https:9443/metrics", expected: scrapeHint{scheme: "https", port: 9443, path: "/metrics"}, valid: true},
+		{hint: "http:8080", expected: scrapeHint{scheme: "http", port: 8080}, valid: true},
+		{hint: "9100/probe", expected: scrapeHint{port: 9100, path: "/probe"}, valid: true},
+		{hint: "9100", expected: scrapeHint{port: 9100}, valid: true},
+		{hint: "ftp:21"},
+		{hint: "https:/metrics"},
+		{hint: "https:70000"},
+		{hint: ""},
+	} {
+		hint, err := parseScrapeHint(tc.hint)
+		if tc.valid {
+			testutil.Ok(t, err)
+			testutil.Equals(t, tc.expected, hint)
+		} else if err == nil {
+			t.Errorf("expected scrape hint %q to be invalid", tc.hint)
+		}
+	}
+}
+
+func TestRefreshScrapeHint(t *testing.T) {
+	clientWrapper := &testOciClientWrapper{instances: []Instance{
+		{ID: "instance_id1", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1", FreeformTags: map[string]string{"prometheus": "https:9443/metrics"}},
+		{ID: "instance_id2", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.2", FreeformTags: map[string]string{"prometheus": "bogus"}},
+		{ID: "instance_id3", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.3"},
+	}}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+			scrapeHintTag:    "prometheus",
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, len(tgs))
+
+	testutil.Equals(t, model.LabelValue("10.0.0.1:9443"), tgs[0].Targets[0][model.AddressLabel])
+	testutil.Equals(t, model.LabelValue("https"), tgs[0].Labels[model.SchemeLabel])
+	testutil.Equals(t, model.LabelValue("/metrics"), tgs[0].Labels[model.MetricsPathLabel])
+	for _, tg := range tgs[1:] {
+		testutil.Equals(t, model.LabelValue(fmt.Sprintf("%s:%d", tg.Labels[ociPrivateIP], testInstancePort)), tg.Targets[0][model.AddressLabel])
+		_, ok := tg.Labels[model.SchemeLabel]
+		testutil.Equals(t, false, ok)
+		_, ok = tg.Labels[model.MetricsPathLabel]
+		testutil.Equals(t, false, ok)
+	}
+}
+
+func TestRefreshPortFromDefinedTag(t *testing.T) {
+	clientWrapper := &testOciClientWrapper{instances: []Instance{
+		{ID: "instance_id1", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1", DefinedTags: map[string]map[string]interface{}{"monitoring": {"port": "9182"}}},
+		{ID: "instance_id2", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.2", DefinedTags: map[string]map[string]interface{}{"monitoring": {"port": "http"}}},
+		{ID: "instance_id3", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.3", DefinedTags: map[string]map[string]interface{}{"monitoring": {"port": "70000"}}},
+		{ID: "instance_id4", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.4"},
+	}}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	testutil.Ok(t, discovery.applyConfig(SDConfig{CompartmentID: testCompartmentID, Port: testInstancePort, PortFromDefinedTag: "monitoring.port"}))
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	var addresses []model.LabelValue
+	for _, tg := range tgs {
+		addresses = append(addresses, tg.Targets[0][model.AddressLabel])
+	}
+	testutil.Equals(t, []model.LabelValue{"10.0.0.1:9182", "10.0.0.2:9100", "10.0.0.3:9100", "10.0.0.4:9100"}, addresses)
+}
+
+func TestRefreshCostCenterTag(t *testing.T) {
+	clientWrapper := &testOciClientWrapper{instances: []Instance{
+		{ID: "instance_id1", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1", DefinedTags: map[string]map[string]interface{}{"finance": {"cost_center": "CC-1234"}}},
+		{ID: "instance_id2", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.2", DefinedTags: map[string]map[string]interface{}{"finance": {"owner": "ops"}}},
+		{ID: "instance_id3", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.3"},
+	}}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	_, ok := tgs[0].Labels[ociCostCenter]
+	testutil.Assert(t, !ok, "expected no cost center label unless configured")
+
+	testutil.Ok(t, discovery.applyConfig(SDConfig{CompartmentID: testCompartmentID, Port: testInstancePort, CostCenterTag: "finance.cost_center"}))
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelValue("CC-1234"), tgs[0].Labels[ociCostCenter])
+	for _, tg := range tgs[1:] {
+		_, ok := tg.Labels[ociCostCenter]
+		testutil.Assert(t, !ok, "expected no cost center label without the tag")
+	}
+}
+
+func TestRefreshPortOptional(t *testing.T) {
+	clientWrapper := &testOciClientWrapper{instances: []Instance{
+		{ID: "instance_id1", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1"},
+		{ID: "instance_id2", CompartmentID: testCompartmentID, PrivateIP: "fd00::2"},
+		{ID: "instance_id3", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.3", FreeformTags: map[string]string{"prometheus": "9182"}},
+	}}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+			scrapeHintTag:    "prometheus",
+			portOptional:     true,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	var addresses []model.LabelValue
+	for _, tg := range tgs {
+		addresses = append(addresses, tg.Targets[0][model.AddressLabel])
+	}
+	testutil.Equals(t, []model.LabelValue{"10.0.0.1", "fd00::2", "10.0.0.3:9182"}, addresses)
+
+	discovery.portOptional = false
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelValue("[fd00::2]:9100"), tgs[1].Targets[0][model.AddressLabel])
+}
+
+func TestHostPort(t *testing.T) {
+	for _, tc := range []struct {
+		conf AddressConfig
+		addr string
+	}{
+		{conf: AddressConfig{Port: 9100}, addr: "10.0.0.1:9100"},
+		{conf: AddressConfig{Port: 9100, PortOptional: true}, addr: "10.0.0.1:9100"},
+		// A port of 0 is only left out if the port is optional.
+		{conf: AddressConfig{Port: 0}, addr: "10.0.0.1:0"},
+		{conf: AddressConfig{Port: 0, PortOptional: true}, addr: "10.0.0.1"},
+	} {
+		testutil.Equals(t, tc.addr, hostPort("10.0.0.1", tc.conf))
+	}
+}
+
+func TestListInstancesAvailabilityDomain(t *testing.T) {
+	clientWrapper, computeClient, _ := newTestRemoteOciClientWrapper()
+	displayName := testInstanceDisplayName
+	availabilityDomain := "Uocm:PHX-AD-1"
+	_, err := clientWrapper.ListInstances(context.Background(), &testCompartmentID, instanceFilter{
+		displayName:        &displayName,
+		availabilityDomain: &availabilityDomain,
+	})
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(computeClient.listInstancesRequests))
+	request := computeClient.listInstancesRequests[0]
+	testutil.Equals(t, &availabilityDomain, request.AvailabilityDomain)
+	testutil.Equals(t, &displayName, request.DisplayName)
+}
+
+func TestRefreshFilterAvailabilityDomain(t *testing.T) {
+	clientWrapper := &testOciClientWrapper{instances: []Instance{
+		{ID: "instance_id1", DisplayName: "instance_name1", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1", AvailabilityDomain: "Uocm:PHX-AD-1"},
+		{ID: "instance_id2", DisplayName: "instance_name1", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.2", AvailabilityDomain: "Uocm:PHX-AD-2"},
+		{ID: "instance_id3", DisplayName: "instance_name3", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.3", AvailabilityDomain: "Uocm:PHX-AD-1"},
+	}}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:      testCompartmentID,
+			displayName:        "instance_name1",
+			availabilityDomain: "Uocm:PHX-AD-1",
+			port:               testInstancePort,
+			logger:             log.NewNopLogger(),
+			ociClientWrapper:   clientWrapper,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(tgs))
+	testutil.Equals(t, model.LabelValue("instance_id1"), tgs[0].Labels[ociInstanceID])
+}
+
+func TestRefreshSkipVNICErrors(t *testing.T) {
+	clientWrapper, computeClient, virtualNetworkClient := newTestRemoteOciClientWrapper()
+	computeClient.instances = append(computeClient.instances, core.Instance{
+		Id:            common.String("instance_id2"),
+		DisplayName:   common.String("instance_name2"),
+		CompartmentId: common.String(testCompartmentID),
+	})
+	// The second VNIC fails after the first one resolved.
+	computeClient.vnicAttachments["instance_id2"] = []core.VnicAttachment{
+		{InstanceId: common.String("instance_id2"), VnicId: common.String("vnic_id2")},
+		{InstanceId: common.String("instance_id2"), VnicId: common.String("unknown_vnic_id")},
+	}
+	virtualNetworkClient.vnics["vnic_id2"] = core.Vnic{Id: common.String("vnic_id2"), PrivateIp: common.String("10.0.0.2"), PublicIp: common.String("192.0.2.2")}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	_, err := discovery.refresh()
+	if err == nil {
+		t.Fatal("expected refresh to fail on vnic errors by default")
+	}
+
+	clientWrapper.skipVNICErrors = true
+	discovery.ociClientWrapper = clientWrapper
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	checkTarget(t, tgs)
+
+	// Instances whose VNICs failed are kept without an address.
+	discovery.emitVNICErrors = true
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+	testutil.Equals(t, 0, len(tgs[0].Labels[ociVNICError]))
+	testutil.Equals(t, model.LabelValue("instance_id2"), tgs[1].Labels[ociInstanceID])
+	testutil.Equals(t, 0, len(tgs[1].Targets[0][model.AddressLabel]))
+	testutil.Equals(t, 0, len(tgs[1].Labels[ociPrivateIP]))
+	testutil.Equals(t, 0, len(tgs[1].Labels[ociPublicIP]))
+	testutil.Assert(t, strings.HasPrefix(string(tgs[1].Labels[ociVNICError]), "error retrieving vnic from OCI"), "unexpected vnic error label %q", tgs[1].Labels[ociVNICError])
+}
+
+// attachmentFailingComputeClient fails to list the VNIC attachments of a
+// single instance.
+type attachmentFailingComputeClient struct {
+	*testComputeClient
+	instanceID string
+}
+
+func (c attachmentFailingComputeClient) ListVnicAttachments(ctx context.Context, request core.ListVnicAttachmentsRequest) (core.ListVnicAttachmentsResponse, error) {
+	if *request.InstanceId == c.instanceID {
+		return core.ListVnicAttachmentsResponse{}, errors.New("service unavailable")
+	}
+	return c.testComputeClient.ListVnicAttachments(ctx, request)
+}
+
+func TestRefreshSkipVNICAttachmentErrors(t *testing.T) {
+	clientWrapper, computeClient, _ := newTestRemoteOciClientWrapper()
+	computeClient.instances = append(computeClient.instances, core.Instance{
+		Id:            common.String("instance_id2"),
+		DisplayName:   common.String("instance_name2"),
+		CompartmentId: common.String(testCompartmentID),
+	})
+	clientWrapper.ociComputeClient = attachmentFailingComputeClient{testComputeClient: computeClient, instanceID: "instance_id2"}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	_, err := discovery.refresh()
+	testutil.NotOk(t, err, "expected refresh to fail on vnic attachment errors by default")
+
+	clientWrapper.skipVNICErrors = true
+	discovery.ociClientWrapper = clientWrapper
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	checkTarget(t, tgs)
+
+	discovery.emitVNICErrors = true
+	discovery.unresolvedAddress = "unresolved.invalid:9100"
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+	testutil.Equals(t, model.LabelValue("unresolved.invalid:9100"), tgs[1].Targets[0][model.AddressLabel])
+	testutil.Equals(t, model.LabelValue("false"), tgs[1].Labels[ociAddressResolved])
+	testutil.Equals(t, model.LabelValue("error retrieving vnic attachments from OCI: service unavailable"), tgs[1].Labels[ociVNICError])
+}
+
+func TestClose(t *testing.T) {
+	clientWrapper, _, _ := newTestRemoteOciClientWrapper()
+	clientWrapper.transport = newTransport(SDConfig{})
+	discovery := &Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			interval:         time.Duration(60 * time.Second),
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	ch := make(chan []*targetgroup.Group)
+	done := make(chan struct{})
+	go func() {
+		discovery.Run(context.Background(), ch)
+		close(done)
+	}()
+	checkTarget(t, <-ch)
+
+	testutil.Ok(t, discovery.Close())
+	testutil.Ok(t, discovery.Close())
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+}
+
+// blockingOciClientWrapper blocks listing instances until release is closed,
+// reporting on listing that it started.
+type blockingOciClientWrapper struct {
+	testOciClientWrapper
+	listing chan struct{}
+	release chan struct{}
+}
+
+func (w blockingOciClientWrapper) ListInstances(ctx context.Context, compartmentID *string, filter instanceFilter) (*instanceResponse, error) {
+	w.listing <- struct{}{}
+	<-w.release
+	return w.testOciClientWrapper.ListInstances(ctx, compartmentID, filter)
+}
+
+func TestUpdateConfigDuringRefresh(t *testing.T) {
+	clientWrapper := blockingOciClientWrapper{listing: make(chan struct{}, 1), release: make(chan struct{})}
+	discovery := &Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	var running []*targetgroup.Group
+	done := make(chan error)
+	go func() {
+		var err error
+		running, err = discovery.refresh()
+		done <- err
+	}()
+	<-clientWrapper.listing
+
+	updated := make(chan error)
+	go func() {
+		updated <- discovery.UpdateConfig(SDConfig{CompartmentID: testCompartmentID, RefreshInterval: model.Duration(time.Minute), Port: 9182})
+	}()
+	select {
+	case err := <-updated:
+		testutil.Ok(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the configuration update not to wait for the refresh")
+	}
+
+	// The running refresh keeps the settings it started with.
+	close(clientWrapper.release)
+	testutil.Ok(t, <-done)
+	testutil.Equals(t, model.LabelValue(testInstancePrivateIP+":"+strconv.Itoa(testInstancePort)), running[0].Targets[0][model.AddressLabel])
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelValue(testInstancePrivateIP+":9182"), tgs[0].Targets[0][model.AddressLabel])
+}
+
+func TestUpdateConfig(t *testing.T) {
+	clientWrapper := &testOciClientWrapper{instances: []Instance{
+		{ID: "instance_id1", DisplayName: "instance_name1", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1"},
+		{ID: "instance_id2", DisplayName: "instance_name2", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.2"},
+	}}
+	discovery := &Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			displayName:      "instance_name1",
+			interval:         10 * time.Millisecond,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan []*targetgroup.Group)
+	go discovery.Run(ctx, ch)
+
+	tgs := <-ch
+	testutil.Equals(t, 1, len(tgs))
+	testutil.Equals(t, model.LabelValue("instance_id1"), tgs[0].Labels[ociInstanceID])
+
+	testutil.Ok(t, discovery.UpdateConfig(SDConfig{
+		CompartmentID:   testCompartmentID,
+		DisplayName:     "instance_name2",
+		RefreshInterval: model.Duration(20 * time.Millisecond),
+		Port:            testInstancePort,
+	}))
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case tgs = <-ch:
+		case <-timeout:
+			t.Fatal("updated display name filter was not applied")
+		}
+		if len(tgs) == 1 && tgs[0].Labels[ociInstanceID] == "instance_id2" {
+			break
+		}
+	}
+	testutil.Equals(t, 20*time.Millisecond, discovery.refreshInterval())
+
+	// Changes requiring new clients are rejected and leave the running
+	// configuration untouched.
+	err := discovery.UpdateConfig(SDConfig{
+		CompartmentID:         testCompartmentID,
+		DisplayName:           "instance_name1",
+		RefreshInterval:       model.Duration(20 * time.Millisecond),
+		UseInstancePrincipals: true,
+	})
+	if err == nil {
+		t.Fatal("expected switching to instance principals to be rejected")
+	}
+	err = discovery.UpdateConfig(SDConfig{RefreshInterval: model.Duration(20 * time.Millisecond)})
+	if err == nil {
+		t.Fatal("expected invalid configuration to be rejected")
+	}
+	testutil.Equals(t, "instance_name2", discovery.conf.DisplayName)
+}
+
+func TestRefreshRegionalSource(t *testing.T) {
+	instances := []Instance{
+		{ID: "instance_id1", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1", Region: "us-phoenix-1"},
+		{ID: "instance_id2", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.2", Region: "eu-frankfurt-1"},
+	}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: &testOciClientWrapper{instances: instances},
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, "OCI_instance_id1_", tgs[0].Source)
+	testutil.Equals(t, "OCI_instance_id2_", tgs[1].Source)
+
+	discovery.regionalSource = true
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, "OCI_us-phoenix-1_instance_id1_", tgs[0].Source)
+	testutil.Equals(t, "OCI_eu-frankfurt-1_instance_id2_", tgs[1].Source)
+
+	discovery = Discovery{
+		settings: settings{
+			port:           testInstancePort,
+			logger:         log.NewNopLogger(),
+			regionalSource: true,
+			tenancies: []tenancy{
+				{id: "tenancy_id1", compartmentID: testCompartmentID, ociClientWrapper: &testOciClientWrapper{instances: instances[:1]}},
+				{id: "tenancy_id2", compartmentID: testCompartmentID, ociClientWrapper: &testOciClientWrapper{instances: instances[1:]}},
+			},
+		},
+	}
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, "OCI_tenancy_id1_us-phoenix-1_instance_id1_", tgs[0].Source)
+	testutil.Equals(t, "OCI_tenancy_id2_eu-frankfurt-1_instance_id2_", tgs[1].Source)
+}
+
+func TestRefreshInstanceSortAndLimit(t *testing.T) {
+	clientWrapper, computeClient, virtualNetworkClient := newTestRemoteOciClientWrapper()
+	for _, id := range []string{"instance_id2", "instance_id3"} {
+		computeClient.instances = append(computeClient.instances, core.Instance{
+			Id:            common.String(id),
+			DisplayName:   common.String(id),
+			CompartmentId: common.String(testCompartmentID),
+		})
+		computeClient.vnicAttachments[id] = []core.VnicAttachment{{InstanceId: common.String(id), VnicId: common.String("vnic_" + id)}}
+		virtualNetworkClient.vnics["vnic_"+id] = core.Vnic{PrivateIp: common.String("10.0.0.1")}
+	}
+	clientWrapper.instanceSortBy = core.ListInstancesSortByDisplayname
+	clientWrapper.instanceSortOrder = core.ListInstancesSortOrderDesc
+	clientWrapper.instancePageLimit = 2
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, len(tgs))
+
+	testutil.Equals(t, 2, len(computeClient.listInstancesRequests))
+	for i, request := range computeClient.listInstancesRequests {
+		testutil.Equals(t, core.ListInstancesSortByDisplayname, request.SortBy)
+		testutil.Equals(t, core.ListInstancesSortOrderDesc, request.SortOrder)
+		testutil.Equals(t, 2, *request.Limit)
+		if i == 0 && request.Page != nil {
+			t.Errorf("expected first request without page, got %s", *request.Page)
+		}
+	}
+	testutil.Equals(t, "2", *computeClient.listInstancesRequests[1].Page)
+}
+
+func TestRefreshDebugLogging(t *testing.T) {
+	instances := []Instance{
+		{
+			ID:            testInstanceID,
+			PrivateIP:     testInstancePrivateIP,
+			DisplayName:   testInstanceDisplayName,
+			CompartmentID: testCompartmentID,
+			DefinedTags:   map[string]map[string]interface{}{"ops": {"env": "prod"}},
+		},
+		{
+			ID:            "filtered_instance_id",
+			PrivateIP:     "127.0.0.2",
+			DisplayName:   "filtered",
+			CompartmentID: testCompartmentID,
+		},
+	}
+	filter, err := parseDefinedTagFilter("ops.env=prod")
+	testutil.Ok(t, err)
+
+	var buf bytes.Buffer
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:     testCompartmentID,
+			port:              testInstancePort,
+			logger:            level.NewFilter(log.NewLogfmtLogger(&buf), level.AllowDebug()),
+			definedTagFilters: []definedTagFilter{filter},
+			ociClientWrapper:  &testOciClientWrapper{instances: instances},
+		},
+	}
+	_, err = discovery.refresh()
+	testutil.Ok(t, err)
+
+	output := buf.String()
+	for _, expected := range []string{
+		`msg="Considering instance" instance=` + testInstanceID,
+		`msg="Considering instance" instance=filtered_instance_id`,
+		`msg="Instance does not match defined tag filters" instance=filtered_instance_id`,
+		`msg="Discovered target" instance=` + testInstanceID,
+		`address=127.0.0.1:9100`,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("expected debug output to contain %q, got:\n%s", expected, output)
+		}
+	}
+	if strings.Contains(output, `msg="Discovered target" instance=filtered_instance_id`) {
+		t.Errorf("did not expect filtered instance to be discovered, got:\n%s", output)
+	}
+
+	buf.Reset()
+	discovery.logger = level.NewFilter(log.NewLogfmtLogger(&buf), level.AllowInfo())
+	_, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, "", buf.String())
+}
+
+func TestRunSkipsUnchangedTargets(t *testing.T) {
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			interval:         10 * time.Millisecond,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: &testOciClientWrapper{},
+		},
+	}
+	skipped := promtestutil.ToFloat64(ociSDSkippedUpdatesCount)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan []*targetgroup.Group)
+	go discovery.Run(ctx, ch)
+	checkTarget(t, <-ch)
+
+	deadline := time.After(time.Second)
+	for promtestutil.ToFloat64(ociSDSkippedUpdatesCount) < skipped+2 {
+		select {
+		case tgs := <-ch:
+			t.Fatalf("expected unchanged targets not to be sent again, got %v", tgs)
+		case <-deadline:
+			t.Fatal("timed out waiting for skipped updates")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestRunSendsChangedSources(t *testing.T) {
+	discovery := &Discovery{
+		settings: settings{
+			compartmentID: testCompartmentID,
+			interval:      10 * time.Millisecond,
+			port:          testInstancePort,
+			logger:        log.NewNopLogger(),
+			ociClientWrapper: &testOciClientWrapper{instances: []Instance{
+				{ID: "instance_id1", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1", Region: "us-phoenix-1"},
+			}},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan []*targetgroup.Group)
+	go discovery.Run(ctx, ch)
+	tgs := <-ch
+	testutil.Equals(t, "OCI_instance_id1_", tgs[0].Source)
+
+	// Only the source of the group changes, which the file_sd format
+	// doesn't show.
+	testutil.Ok(t, discovery.UpdateConfig(SDConfig{
+		CompartmentID:   testCompartmentID,
+		RefreshInterval: model.Duration(10 * time.Millisecond),
+		Port:            testInstancePort,
+		RegionalSource:  true,
+	}))
+	select {
+	case tgs = <-ch:
+		testutil.Equals(t, "OCI_us-phoenix-1_instance_id1_", tgs[0].Source)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the changed sources")
+	}
+}
+
+func TestGetCompartmentIDsLifecycleState(t *testing.T) {
+	identityClient := &testIdentityClient{compartments: []identity.Compartment{
+		{Id: common.String("active_compartment_id"), CompartmentId: common.String("root_compartment_id1"), LifecycleState: identity.CompartmentLifecycleStateActive},
+		{Id: common.String("deleting_compartment_id"), CompartmentId: common.String("root_compartment_id1"), LifecycleState: identity.CompartmentLifecycleStateDeleting},
+		{Id: common.String("active_compartment_id2"), CompartmentId: common.String("root_compartment_id1"), LifecycleState: identity.CompartmentLifecycleStateActive},
+	}}
+	clientWrapper := remoteOciClientWrapper{ociIdentityClient: identityClient}
+	rootCompartmentID := "root_compartment_id1"
+
+	ids, err := clientWrapper.GetCompartmentIDs(context.Background(), &rootCompartmentID)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"active_compartment_id", "active_compartment_id2"}, compartmentRefIDs(ids))
+
+	clientWrapper.includeInactiveCompartments = true
+	ids, err = clientWrapper.GetCompartmentIDs(context.Background(), &rootCompartmentID)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"active_compartment_id", "deleting_compartment_id", "active_compartment_id2"}, compartmentRefIDs(ids))
+}
+
+func TestGetCompartmentIDsTree(t *testing.T) {
+	compartment := func(id, parentID string) identity.Compartment {
+		return identity.Compartment{Id: common.String(id), CompartmentId: common.String(parentID), LifecycleState: identity.CompartmentLifecycleStateActive}
+	}
+	identityClient := &testIdentityClient{compartments: []identity.Compartment{
+		compartment("a", "root"),
+		compartment("a1", "a"),
+		compartment("a1x", "a1"),
+		compartment("b", "root"),
+	}}
+	clientWrapper := remoteOciClientWrapper{ociIdentityClient: identityClient}
+	ids, err := clientWrapper.GetCompartmentIDs(context.Background(), common.String("root"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"a", "b"}, compartmentRefIDs(ids))
+	testutil.Equals(t, 1, len(identityClient.listCompartmentsRequests))
+
+	clientWrapper.recurseCompartments = true
+	ids, err = clientWrapper.GetCompartmentIDs(context.Background(), common.String("root"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"a", "a1", "a1x", "b"}, compartmentRefIDs(ids))
+	testutil.Equals(t, []int{1, 2, 3, 1}, compartmentRefDepths(ids))
+}
+
+func TestRefreshCompartmentGauges(t *testing.T) {
+	discovery := Discovery{
+		settings: settings{
+			port:   testInstancePort,
+			logger: log.NewNopLogger(),
+			tenancies: []tenancy{
+				{
+					id:                "tenancy_id1",
+					rootCompartmentID: "root_compartment_id1",
+					ociClientWrapper: treeOciClientWrapper{
+						compartmentIDs: []string{"a", "a1", "a1x", "b"},
+						depths:         map[string]int{"a1": 2, "a1x": 3},
+					},
+				},
+				{
+					id:                "tenancy_id2",
+					rootCompartmentID: "root_compartment_id2",
+					ociClientWrapper:  treeOciClientWrapper{compartmentIDs: []string{"c"}},
+				},
+			},
+		},
+	}
+	_, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 4.0, promtestutil.ToFloat64(ociSDCompartments.WithLabelValues("tenancy_id1")))
+	testutil.Equals(t, 3.0, promtestutil.ToFloat64(ociSDCompartmentDepth.WithLabelValues("tenancy_id1")))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(ociSDCompartments.WithLabelValues("tenancy_id2")))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(ociSDCompartmentDepth.WithLabelValues("tenancy_id2")))
+}
+
+func compartmentRefIDs(refs []compartmentRef) []string {
+	ids := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		ids = append(ids, stringValue(ref.id))
+	}
+	return ids
+}
+
+func compartmentRefDepths(refs []compartmentRef) []int {
+	depths := make([]int, 0, len(refs))
+	for _, ref := range refs {
+		depths = append(depths, ref.depth)
+	}
+	return depths
+}
+
+// treeOciClientWrapper serves a fixed compartment tree with instances and
+// freeform tags per compartment.
+type treeOciClientWrapper struct {
+	compartmentIDs []string
+	instances      map[string][]Instance
+	tags           map[string]map[string]string
+	// depths defaults to 1 for compartments not listed.
+	depths  map[string]int
+	parents map[string]string
+}
+
+func (w treeOciClientWrapper) GetCompartmentIDs(ctx context.Context, rootCompartmentID *string) ([]compartmentRef, error) {
+	refs := []compartmentRef{}
+	for i, id := range w.compartmentIDs {
+		depth, ok := w.depths[id]
+		if !ok {
+			depth = 1
+		}
+		refs = append(refs, compartmentRef{id: &w.compartmentIDs[i], depth: depth})
+	}
+	return refs, nil
+}
+
+func (w treeOciClientWrapper) GetCompartment(ctx context.Context, compartmentID *string) (compartment, error) {
+	return compartment{name: *compartmentID + "_name", freeformTags: w.tags[*compartmentID], parentID: w.parents[*compartmentID]}, nil
+}
+
+func (w treeOciClientWrapper) GetNamespace(ctx context.Context) (string, error) {
+	return testNamespace, nil
+}
+
+func (w treeOciClientWrapper) GetTenancyName(ctx context.Context) (string, error) {
+	return testTenancyName, nil
+}
+
+func (w treeOciClientWrapper) ListAvailabilityDomains(ctx context.Context, compartmentID *string) ([]string, error) {
+	return nil, nil
+}
+
+func (w treeOciClientWrapper) ListRegionSubscriptions(ctx context.Context) ([]string, error) {
+	return nil, nil
+}
+
+func (w treeOciClientWrapper) SearchInstances(ctx context.Context, query string) ([]Instance, error) {
+	var instances []Instance
+	for _, id := range append([]string{"root_compartment_id1"}, w.compartmentIDs...) {
+		instances = append(instances, w.instances[id]...)
+	}
+	return instances, nil
+}
+
+func (w treeOciClientWrapper) ListInstances(ctx context.Context, compartmentID *string, filter instanceFilter) (*instanceResponse, error) {
+	return &instanceResponse{instances: w.instances[*compartmentID]}, nil
+}
+
+func TestRefreshIncludeRootCompartment(t *testing.T) {
+	clientWrapper := treeOciClientWrapper{
+		compartmentIDs: []string{"child_compartment_id"},
+		instances: map[string][]Instance{
+			"tenancy_id":           {{ID: "root_instance_id", CompartmentID: "tenancy_id", PrivateIP: "10.0.0.1"}},
+			"child_compartment_id": {{ID: "child_instance_id", CompartmentID: "child_compartment_id", PrivateIP: "10.0.0.2"}},
+		},
+	}
+	discovery := Discovery{
+		settings: settings{
+			rootCompartmentID:      "tenancy_id",
+			port:                   testInstancePort,
+			logger:                 log.NewNopLogger(),
+			ociClientWrapper:       clientWrapper,
+			includeRootCompartment: true,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+	testutil.Equals(t, model.LabelValue("root_instance_id"), tgs[0].Labels[ociInstanceID])
+	testutil.Equals(t, model.LabelValue("tenancy_id_name"), tgs[0].Labels[ociCompartmentName])
+	testutil.Equals(t, model.LabelValue("child_instance_id"), tgs[1].Labels[ociInstanceID])
+
+	discovery.includeRootCompartment = false
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(tgs))
+	testutil.Equals(t, model.LabelValue("child_instance_id"), tgs[0].Labels[ociInstanceID])
+}
+
+func TestRefreshMaxTargets(t *testing.T) {
+	var instances []Instance
+	for i := 1; i <= 5; i++ {
+		instances = append(instances, Instance{ID: fmt.Sprintf("instance_id%d", i), CompartmentID: testCompartmentID, PrivateIP: fmt.Sprintf("10.0.0.%d", i)})
+	}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: &testOciClientWrapper{instances: instances},
+			maxTargets:       3,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, len(tgs))
+	testutil.Equals(t, model.LabelValue("instance_id3"), tgs[2].Labels[ociInstanceID])
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(ociSDTargetsOverLimit))
+
+	discovery.failOnMaxTargets = true
+	_, err = discovery.refresh()
+	testutil.NotOk(t, err, "expected refresh beyond max targets to fail")
+
+	discovery.maxTargets = 5
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 5, len(tgs))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(ociSDTargetsOverLimit))
+}
+
+func TestNewRemoteOciClientWrapperHomeRegion(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	testutil.Ok(t, err)
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	config := common.NewRawConfigurationProvider("tenancy_id1", "user_id1", "us-phoenix-1", "fingerprint", string(privateKey), nil)
+
+	clientWrapper, err := newRemoteOciClientWrapper(config, SDConfig{}, "eu-frankfurt-1", "us-ashburn-1")
+	testutil.Ok(t, err)
+	testutil.Equals(t, common.StringToRegion("us-ashburn-1").Endpoint("identity"), clientWrapper.ociIdentityClient.(*identity.IdentityClient).Host)
+	testutil.Equals(t, common.StringToRegion("eu-frankfurt-1").Endpoint("iaas"), clientWrapper.ociComputeClient.(*core.ComputeClient).Host)
+	testutil.Equals(t, common.StringToRegion("eu-frankfurt-1").Endpoint("iaas"), clientWrapper.ociVirtualNetworkClient.(*core.VirtualNetworkClient).Host)
+
+	clientWrapper, err = newRemoteOciClientWrapper(config, SDConfig{}, "eu-frankfurt-1", "")
+	testutil.Ok(t, err)
+	testutil.Equals(t, common.StringToRegion("eu-frankfurt-1").Endpoint("identity"), clientWrapper.ociIdentityClient.(*identity.IdentityClient).Host)
+}
+
+func TestNewRemoteOciClientWrapperIdleConns(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	testutil.Ok(t, err)
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	config := common.NewRawConfigurationProvider("tenancy_id1", "user_id1", "us-phoenix-1", "fingerprint", string(privateKey), nil)
+
+	clientWrapper, err := newRemoteOciClientWrapper(config, SDConfig{MaxIdleConns: 200, MaxIdleConnsPerHost: 50}, "us-phoenix-1", "")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 200, clientWrapper.transport.MaxIdleConns)
+	testutil.Equals(t, 50, clientWrapper.transport.MaxIdleConnsPerHost)
+	httpClient := clientWrapper.ociComputeClient.(*core.ComputeClient).HTTPClient.(*http.Client)
+	testutil.Equals(t, clientWrapper.transport, httpClient.Transport)
+
+	clientWrapper, err = newRemoteOciClientWrapper(config, SDConfig{}, "us-phoenix-1", "")
+	testutil.Ok(t, err)
+	testutil.Equals(t, 100, clientWrapper.transport.MaxIdleConns)
+	testutil.Equals(t, 0, clientWrapper.transport.MaxIdleConnsPerHost)
+}
+
+func TestNewRemoteOciClientWrapperRealm(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	testutil.Ok(t, err)
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	config := common.NewRawConfigurationProvider("tenancy_id1", "user_id1", "us-langley-1", "fingerprint", string(privateKey), nil)
+
+	clientWrapper, err := newRemoteOciClientWrapper(config, SDConfig{Realm: "oraclegovcloud.com"}, "us-langley-1", "us-langley-1")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "iaas.us-langley-1.oraclegovcloud.com", clientWrapper.ociComputeClient.(*core.ComputeClient).Host)
+	testutil.Equals(t, "iaas.us-langley-1.oraclegovcloud.com", clientWrapper.ociVirtualNetworkClient.(*core.VirtualNetworkClient).Host)
+	testutil.Equals(t, "identity.us-langley-1.oraclegovcloud.com", clientWrapper.ociIdentityClient.(*identity.IdentityClient).Host)
+	testutil.Equals(t, "query.us-langley-1.oraclegovcloud.com", clientWrapper.ociResourceSearchClient.(*resourcesearch.ResourceSearchClient).Host)
+	testutil.Equals(t, "objectstorage.us-langley-1.oraclegovcloud.com", clientWrapper.ociObjectStorageClient.(*objectstorage.ObjectStorageClient).Host)
+
+	clientWrapper, err = newRemoteOciClientWrapper(config, SDConfig{}, "us-phoenix-1", "")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "iaas.us-phoenix-1.oraclecloud.com", clientWrapper.ociComputeClient.(*core.ComputeClient).Host)
+}
+
+// staticCredentialProvider hands out a fixed configuration provider and
+// records the tenancies it was asked for.
+type staticCredentialProvider struct {
+	config    common.ConfigurationProvider
+	err       error
+	tenancies []TenancyConfig
+}
+
+func (p *staticCredentialProvider) ConfigurationProvider(t TenancyConfig) (common.ConfigurationProvider, error) {
+	p.tenancies = append(p.tenancies, t)
+	return p.config, p.err
+}
+
+func TestWithCredentialProvider(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	testutil.Ok(t, err)
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	credentials := &staticCredentialProvider{
+		config: common.NewRawConfigurationProvider("tenancy_id1", "user_id1", "us-phoenix-1", "fingerprint", string(privateKey), nil),
+	}
+	conf := DefaultSDConfig
+	conf.Tenancies = []TenancyConfig{
+		{TenancyID: "tenancy_id1", CompartmentID: "compartment_id1"},
+		{TenancyID: "tenancy_id2", CompartmentID: "compartment_id2", ConfigFile: "/etc/oci/config"},
+	}
+	discovery, err := NewDiscovery(conf, nil, WithCredentialProvider(credentials))
+	testutil.Ok(t, err)
+	testutil.Equals(t, conf.Tenancies, credentials.tenancies)
+	testutil.Equals(t, 2, len(discovery.tenancies))
+	_, ok := discovery.tenancies[0].ociClientWrapper.(remoteOciClientWrapper)
+	testutil.Assert(t, ok, "expected remote clients")
+
+	credentials = &staticCredentialProvider{err: errors.New("secret manager unavailable")}
+	_, err = NewDiscovery(conf, nil, WithCredentialProvider(credentials))
+	testutil.NotOk(t, err, "expected credential errors to fail the discovery")
+}
+
+func newSingleCompartmentDiscovery(instances int) *Discovery {
+	clientWrapper := &testOciClientWrapper{instances: []Instance{}}
+	for i := 0; i < instances; i++ {
+		clientWrapper.instances = append(clientWrapper.instances, Instance{
+			ID:            fmt.Sprintf("instance_id%d", i),
+			DisplayName:   fmt.Sprintf("instance_name%d", i),
+			CompartmentID: testCompartmentID,
+			PrivateIP:     fmt.Sprintf("10.0.%d.%d", i/256, i%256),
+			FreeformTags:  map[string]string{"team": "sre"},
+		})
+	}
+	return &Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+}
+
+func TestRefreshSingleCompartmentFastPath(t *testing.T) {
+	discovery := newSingleCompartmentDiscovery(10)
+	fast, err := discovery.refresh()
+	testutil.Ok(t, err)
+	general, err := discovery.refreshTenancies(context.Background(), &refreshStats{})
+	testutil.Ok(t, err)
+	testutil.Equals(t, 10, len(fast))
+	testutil.Equals(t, general, fast)
+}
+
+func BenchmarkRefreshSingleCompartment(b *testing.B) {
+	discovery := newSingleCompartmentDiscovery(100)
+	t := tenancy{compartmentID: discovery.compartmentID, ociClientWrapper: discovery.ociClientWrapper}
+	b.Run("fast", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := discovery.refreshCompartment(context.Background(), t, compartmentRef{id: &t.compartmentID}, &refreshStats{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("general", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := discovery.refreshTenancies(context.Background(), &refreshStats{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestRefreshCompartmentTags(t *testing.T) {
+	clientWrapper := treeOciClientWrapper{
+		compartmentIDs: []string{"tagged_compartment_id", "untagged_compartment_id"},
+		instances: map[string][]Instance{
+			"tagged_compartment_id":   {{ID: "instance_id1", CompartmentID: "tagged_compartment_id", PrivateIP: "10.0.0.1", FreeformTags: map[string]string{"app": "web"}}},
+			"untagged_compartment_id": {{ID: "instance_id2", CompartmentID: "untagged_compartment_id", PrivateIP: "10.0.0.2"}},
+		},
+		tags: map[string]map[string]string{
+			"tagged_compartment_id": {"cost-center": "1234"},
+		},
+	}
+	discovery := Discovery{
+		settings: settings{
+			rootCompartmentID:   "root_compartment_id1",
+			port:                testInstancePort,
+			logger:              log.NewNopLogger(),
+			ociClientWrapper:    clientWrapper,
+			emitCompartmentTags: true,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+	testutil.Equals(t, model.LabelValue("1234"), tgs[0].Labels[ociCompartmentTagLabel+"cost_center"])
+	testutil.Equals(t, model.LabelValue("web"), tgs[0].Labels[ociTagLabel+"app"])
+	_, ok := tgs[1].Labels[ociCompartmentTagLabel+"cost_center"]
+	testutil.Equals(t, false, ok)
+
+	discovery.emitCompartmentTags = false
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	_, ok = tgs[0].Labels[ociCompartmentTagLabel+"cost_center"]
+	testutil.Equals(t, false, ok)
+}
+
+func TestRefreshCompartmentTagFilters(t *testing.T) {
+	clientWrapper := treeOciClientWrapper{
+		compartmentIDs: []string{"payments_compartment_id", "search_compartment_id", "untagged_compartment_id"},
+		instances: map[string][]Instance{
+			"payments_compartment_id": {{ID: "instance_id1", CompartmentID: "payments_compartment_id", PrivateIP: "10.0.0.1"}},
+			"search_compartment_id":   {{ID: "instance_id2", CompartmentID: "search_compartment_id", PrivateIP: "10.0.0.2"}},
+			"untagged_compartment_id": {{ID: "instance_id3", CompartmentID: "untagged_compartment_id", PrivateIP: "10.0.0.3"}},
+		},
+		tags: map[string]map[string]string{
+			"payments_compartment_id": {"team": "payments", "env": "prod"},
+			"search_compartment_id":   {"team": "search", "env": "prod"},
+		},
+	}
+	discovery := Discovery{
+		settings: settings{
+			rootCompartmentID: "root_compartment_id1",
+			port:              testInstancePort,
+			logger:            log.NewNopLogger(),
+			ociClientWrapper:  clientWrapper,
+		},
+	}
+	for _, tc := range []struct {
+		filters  map[string]string
+		expected []model.LabelValue
+	}{
+		{filters: nil, expected: []model.LabelValue{"instance_id1", "instance_id2", "instance_id3"}},
+		{filters: map[string]string{"team": "payments"}, expected: []model.LabelValue{"instance_id1"}},
+		{filters: map[string]string{"env": "prod"}, expected: []model.LabelValue{"instance_id1", "instance_id2"}},
+		{filters: map[string]string{"team": "payments", "env": "dev"}, expected: nil},
+	} {
+		discovery.compartmentTagFilters = tc.filters
+		tgs, err := discovery.refresh()
+		testutil.Ok(t, err)
+		var ids []model.LabelValue
+		for _, tg := range tgs {
+			ids = append(ids, tg.Labels[ociInstanceID])
+		}
+		testutil.Equals(t, tc.expected, ids)
+	}
+}
+
+// testResourceSearchClient serves search results one item per page.
+type testResourceSearchClient struct {
+	items    []resourcesearch.ResourceSummary
+	requests []resourcesearch.SearchResourcesRequest
+}
+
+func (c *testResourceSearchClient) SearchResources(ctx context.Context, request resourcesearch.SearchResourcesRequest) (resourcesearch.SearchResourcesResponse, error) {
+	c.requests = append(c.requests, request)
+	i := 0
+	if request.Page != nil {
+		i, _ = strconv.Atoi(*request.Page)
+	}
+	response := resourcesearch.SearchResourcesResponse{}
+	if i < len(c.items) {
+		response.Items = c.items[i : i+1]
+	}
+	if i+1 < len(c.items) {
+		response.OpcNextPage = common.String(strconv.Itoa(i + 1))
+	}
+	return response, nil
+}
+
+func TestSearchInstances(t *testing.T) {
+	clientWrapper, _, _ := newTestRemoteOciClientWrapper()
+	searchClient := &testResourceSearchClient{items: []resourcesearch.ResourceSummary{
+		{ResourceType: common.String("Instance"), Identifier: common.String(testInstanceID), LifecycleState: common.String("Running")},
+		{ResourceType: common.String("Vcn"), Identifier: common.String("vcn_id1"), LifecycleState: common.String("Available")},
+		{ResourceType: common.String("Instance"), Identifier: common.String("stopped_instance_id"), LifecycleState: common.String("Stopped")},
+	}}
+	clientWrapper.ociResourceSearchClient = searchClient
+	query := "query instance resources where definedTags.namespace = 'ops'"
+
+	instances, err := clientWrapper.SearchInstances(context.Background(), query)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(instances))
+	testutil.Equals(t, testInstanceID, instances[0].ID)
+	testutil.Equals(t, testInstancePrivateIP, instances[0].PrivateIP)
+	testutil.Equals(t, testCompartmentID, instances[0].CompartmentID)
+
+	testutil.Equals(t, 3, len(searchClient.requests))
+	details, ok := searchClient.requests[0].SearchDetails.(resourcesearch.StructuredSearchDetails)
+	testutil.Equals(t, true, ok)
+	testutil.Equals(t, query, *details.Query)
+}
+
+func TestRefreshSearchQuery(t *testing.T) {
+	clientWrapper := treeOciClientWrapper{
+		compartmentIDs: []string{"compartment_id1", "compartment_id2"},
+		instances: map[string][]Instance{
+			"compartment_id1": {
+				{ID: "instance_id1", DisplayName: "web", CompartmentID: "compartment_id1", PrivateIP: "10.0.0.1"},
+				{ID: "instance_id2", DisplayName: "db", CompartmentID: "compartment_id1", PrivateIP: "10.0.0.2"},
+			},
+			"compartment_id2": {{ID: "instance_id3", DisplayName: "web", CompartmentID: "compartment_id2", PrivateIP: "10.0.0.3"}},
+		},
+	}
+	discovery := Discovery{
+		settings: settings{
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+			searchQuery:      "query instance resources",
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, len(tgs))
+	testutil.Equals(t, model.LabelValue("compartment_id1_name"), tgs[0].Labels[ociCompartmentName])
+	testutil.Equals(t, model.LabelValue("compartment_id2_name"), tgs[2].Labels[ociCompartmentName])
+
+	discovery.displayName = "web"
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+	testutil.Equals(t, model.LabelValue("instance_id1"), tgs[0].Labels[ociInstanceID])
+	testutil.Equals(t, model.LabelValue("instance_id3"), tgs[1].Labels[ociInstanceID])
+}
+
+// inFlight tracks the maximum number of concurrent calls.
+type inFlight struct {
+	mtx     sync.Mutex
+	current int
+	max     int
+}
+
+func (f *inFlight) enter() {
+	f.mtx.Lock()
+	f.current++
+	if f.current > f.max {
+		f.max = f.current
+	}
+	f.mtx.Unlock()
+	time.Sleep(5 * time.Millisecond)
+}
+
+func (f *inFlight) leave() {
+	f.mtx.Lock()
+	f.current--
+	f.mtx.Unlock()
+}
+
+// countingOciClientWrapper counts concurrent instance listings.
+type countingOciClientWrapper struct {
+	treeOciClientWrapper
+	listings *inFlight
+}
+
+func (w countingOciClientWrapper) ListInstances(ctx context.Context, compartmentID *string, filter instanceFilter) (*instanceResponse, error) {
+	w.listings.enter()
+	defer w.listings.leave()
+	return w.treeOciClientWrapper.ListInstances(ctx, compartmentID, filter)
+}
+
+func TestRefreshCompartmentConcurrency(t *testing.T) {
+	clientWrapper := countingOciClientWrapper{
+		treeOciClientWrapper: treeOciClientWrapper{instances: map[string][]Instance{}},
+		listings:             &inFlight{},
+	}
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("compartment_id%d", i)
+		clientWrapper.compartmentIDs = append(clientWrapper.compartmentIDs, id)
+		clientWrapper.instances[id] = []Instance{{ID: fmt.Sprintf("instance_id%d", i), CompartmentID: id, PrivateIP: fmt.Sprintf("10.0.0.%d", i)}}
+	}
+	for _, limit := range []int{1, 3} {
+		clientWrapper.listings.max = 0
+		discovery := Discovery{
+			settings: settings{
+				rootCompartmentID:      "root_compartment_id1",
+				port:                   testInstancePort,
+				logger:                 log.NewNopLogger(),
+				ociClientWrapper:       clientWrapper,
+				compartmentConcurrency: limit,
+			},
+		}
+		tgs, err := discovery.refresh()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 10, len(tgs))
+		for i, tg := range tgs {
+			testutil.Equals(t, model.LabelValue(fmt.Sprintf("instance_id%d", i)), tg.Labels[ociInstanceID])
+		}
+		testutil.Equals(t, limit, clientWrapper.listings.max)
+	}
+}
+
+// countingComputeClient counts concurrent VNIC attachment lookups.
+type countingComputeClient struct {
+	*testComputeClient
+	lookups *inFlight
+}
+
+func (c countingComputeClient) ListVnicAttachments(ctx context.Context, request core.ListVnicAttachmentsRequest) (core.ListVnicAttachmentsResponse, error) {
+	c.lookups.enter()
+	defer c.lookups.leave()
+	return c.testComputeClient.ListVnicAttachments(ctx, request)
+}
+
+func TestListInstancesInstanceConcurrency(t *testing.T) {
+	clientWrapper, computeClient, virtualNetworkClient := newTestRemoteOciClientWrapper()
+	for i := 2; i <= 10; i++ {
+		id := fmt.Sprintf("instance_id%d", i)
+		computeClient.instances = append(computeClient.instances, core.Instance{
+			Id:            common.String(id),
+			DisplayName:   common.String(id),
+			CompartmentId: common.String(testCompartmentID),
+		})
+		computeClient.vnicAttachments[id] = []core.VnicAttachment{{InstanceId: common.String(id), VnicId: common.String("vnic_" + id)}}
+		virtualNetworkClient.vnics["vnic_"+id] = core.Vnic{PrivateIp: common.String(fmt.Sprintf("10.0.0.%d", i))}
+	}
+	lookups := &inFlight{}
+	clientWrapper.ociComputeClient = countingComputeClient{testComputeClient: computeClient, lookups: lookups}
+	for _, limit := range []int{1, 4} {
+		lookups.max = 0
+		clientWrapper.instanceConcurrency = limit
+		response, err := clientWrapper.ListInstances(context.Background(), &testCompartmentID, instanceFilter{})
+		testutil.Ok(t, err)
+		testutil.Equals(t, 10, len(response.instances))
+		testutil.Equals(t, testInstanceID, response.instances[0].ID)
+		testutil.Equals(t, "10.0.0.10", response.instances[9].PrivateIP)
+		testutil.Equals(t, limit, lookups.max)
+	}
+}
+
+// requestCountingComputeClient counts concurrent instance listings and VNIC
+// lookups alike.
+type requestCountingComputeClient struct {
+	*testComputeClient
+	requests *inFlight
+}
+
+func (c requestCountingComputeClient) ListInstances(ctx context.Context, request core.ListInstancesRequest) (core.ListInstancesResponse, error) {
+	c.requests.enter()
+	defer c.requests.leave()
+	return c.testComputeClient.ListInstances(ctx, request)
+}
+
+func (c requestCountingComputeClient) ListVnicAttachments(ctx context.Context, request core.ListVnicAttachmentsRequest) (core.ListVnicAttachmentsResponse, error) {
+	c.requests.enter()
+	defer c.requests.leave()
+	return c.testComputeClient.ListVnicAttachments(ctx, request)
+}
+
+func TestRefreshMaxConcurrentRequests(t *testing.T) {
+	clientWrapper, computeClient, virtualNetworkClient := newTestRemoteOciClientWrapper()
+	for i := 2; i <= 10; i++ {
+		id := fmt.Sprintf("instance_id%d", i)
+		computeClient.instances = append(computeClient.instances, core.Instance{
+			Id:            common.String(id),
+			DisplayName:   common.String(id),
+			CompartmentId: common.String(testCompartmentID),
+		})
+		computeClient.vnicAttachments[id] = []core.VnicAttachment{{InstanceId: common.String(id), VnicId: common.String("vnic_" + id)}}
+		virtualNetworkClient.vnics["vnic_"+id] = core.Vnic{PrivateIp: common.String(fmt.Sprintf("10.0.0.%d", i))}
+	}
+	var compartments []identity.Compartment
+	for i := 1; i <= 4; i++ {
+		compartments = append(compartments, identity.Compartment{
+			Id:             common.String(fmt.Sprintf("compartment_id%d", i)),
+			CompartmentId:  common.String("root_compartment_id1"),
+			LifecycleState: identity.CompartmentLifecycleStateActive,
+		})
+	}
+	clientWrapper.ociIdentityClient = &testIdentityClient{compartments: compartments}
+	requests := &inFlight{}
+	clientWrapper.ociComputeClient = requestCountingComputeClient{testComputeClient: computeClient, requests: requests}
+	clientWrapper.instanceConcurrency = 8
+
+	discovery := Discovery{
+		settings: settings{
+			rootCompartmentID:      "root_compartment_id1",
+			port:                   testInstancePort,
+			logger:                 log.NewNopLogger(),
+			ociClientWrapper:       clientWrapper.withRequestLimiter(newRequestLimiter(3)),
+			compartmentConcurrency: 4,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 40, len(tgs))
+	testutil.Assert(t, requests.max <= 3, "expected at most 3 requests in flight, got %d", requests.max)
+
+	// Without a limit compartment and instance fan-out multiply.
+	requests.max = 0
+	discovery.ociClientWrapper = clientWrapper
+	_, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Assert(t, requests.max > 3, "expected more than 3 requests in flight, got %d", requests.max)
+}
+
+func TestRefreshVNICCount(t *testing.T) {
+	clientWrapper, computeClient, virtualNetworkClient := newTestRemoteOciClientWrapper()
+	computeClient.vnicAttachments[testInstanceID] = append(computeClient.vnicAttachments[testInstanceID],
+		core.VnicAttachment{InstanceId: common.String(testInstanceID), VnicId: common.String("vnic_id2")})
+	virtualNetworkClient.vnics["vnic_id2"] = core.Vnic{PrivateIp: common.String("10.0.1.1")}
+
+	response, err := clientWrapper.ListInstances(context.Background(), &testCompartmentID, instanceFilter{})
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, response.instances[0].VNICCount)
+
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelValue("2"), tgs[0].Labels[ociVNICCount])
+}
+
+func TestRefreshTagCollisions(t *testing.T) {
+	discovery := newSingleCompartmentDiscovery(1)
+	discovery.ociClientWrapper.(*testOciClientWrapper).instances[0].FreeformTags = map[string]string{
+		"app-name":   "dash",
+		"app.name":   "dot",
+		"app_name_2": "underscore",
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelValue("dash"), tgs[0].Labels[ociTagLabel+"app_name"])
+	testutil.Equals(t, model.LabelValue("dot"), tgs[0].Labels[ociTagLabel+"app_name_3"])
+	testutil.Equals(t, model.LabelValue("underscore"), tgs[0].Labels[ociTagLabel+"app_name_2"])
+}
+
+func TestRefreshSanitizedTagKeyPrefix(t *testing.T) {
+	tags := map[string]string{
+		"1foo":     "digit",
+		"$cost":    "special",
+		"app.name": "inner",
+	}
+	discovery := newSingleCompartmentDiscovery(1)
+	discovery.ociClientWrapper.(*testOciClientWrapper).instances[0].FreeformTags = tags
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelValue("digit"), tgs[0].Labels[ociTagLabel+"1foo"])
+	testutil.Equals(t, model.LabelValue("special"), tgs[0].Labels[ociTagLabel+"_cost"])
+
+	discovery.sanitizedTagKeyPrefix = "oci_"
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelValue("digit"), tgs[0].Labels[ociTagLabel+"oci_1foo"])
+	testutil.Equals(t, model.LabelValue("special"), tgs[0].Labels[ociTagLabel+"oci__cost"])
+	testutil.Equals(t, model.LabelValue("inner"), tgs[0].Labels[ociTagLabel+"app_name"])
+	_, ok := tgs[0].Labels[ociTagLabel+"1foo"]
+	testutil.Assert(t, !ok, "expected no unprefixed label")
+
+	// Keys are used as they are in utf8 mode.
+	discovery.labelNameMode = labelNameModeUTF8
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelValue("digit"), tgs[0].Labels[ociTagLabel+"1foo"])
+}
+
+func TestRefreshLowercaseTagValues(t *testing.T) {
+	discovery := newSingleCompartmentDiscovery(1)
+	discovery.ociClientWrapper.(*testOciClientWrapper).instances[0].FreeformTags = map[string]string{"Env": "Production"}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelValue("Production"), tgs[0].Labels[ociTagLabel+"Env"])
+
+	discovery.lowercaseTagValues = true
+	for _, mode := range []string{labelNameModeSanitize, labelNameModeUTF8} {
+		discovery.labelNameMode = mode
+		tgs, err = discovery.refresh()
+		testutil.Ok(t, err)
+		testutil.Equals(t, model.LabelValue("production"), tgs[0].Labels[ociTagLabel+"Env"])
+	}
+}
+
+func TestRefreshCompartmentTargetCount(t *testing.T) {
+	clientWrapper := treeOciClientWrapper{
+		compartmentIDs: []string{"a", "b"},
+		instances: map[string][]Instance{
+			"a": {
+				{ID: "instance_id1", CompartmentID: "a", PrivateIP: "10.0.0.1"},
+				{ID: "instance_id2", CompartmentID: "a", PrivateIP: "10.0.0.2"},
+			},
+			"b": {{ID: "instance_id3", CompartmentID: "b", PrivateIP: "10.0.0.3"}},
+		},
+	}
+	discovery := Discovery{
+		settings: settings{
+			rootCompartmentID: "root_compartment_id1",
+			port:              testInstancePort,
+			logger:            log.NewNopLogger(),
+			ociClientWrapper:  clientWrapper,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	_, ok := tgs[0].Labels[ociCompartmentSize]
+	testutil.Assert(t, !ok, "expected no compartment target count unless enabled")
+
+	discovery.emitCompartmentSize = true
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, len(tgs))
+	testutil.Equals(t, model.LabelValue("2"), tgs[0].Labels[ociCompartmentSize])
+	testutil.Equals(t, model.LabelValue("2"), tgs[1].Labels[ociCompartmentSize])
+	testutil.Equals(t, model.LabelValue("1"), tgs[2].Labels[ociCompartmentSize])
+}
+
+// shufflingOciClientWrapper lists compartments and instances in random
+// order.
+type shufflingOciClientWrapper struct {
+	testOciClientWrapper
+	compartments map[string][]Instance
+}
+
+func (w shufflingOciClientWrapper) GetCompartmentIDs(ctx context.Context, rootCompartmentID *string) ([]compartmentRef, error) {
+	var compartments []compartmentRef
+	for _, i := range mathrand.Perm(len(w.compartments)) {
+		id := fmt.Sprintf("compartment_id%d", i+1)
+		compartments = append(compartments, compartmentRef{id: &id, depth: 1})
+	}
+	return compartments, nil
+}
+
+func (w shufflingOciClientWrapper) ListInstances(ctx context.Context, compartmentID *string, filter instanceFilter) (*instanceResponse, error) {
+	instances := w.compartments[*compartmentID]
+	shuffled := make([]Instance, len(instances))
+	for i, j := range mathrand.Perm(len(instances)) {
+		shuffled[i] = instances[j]
+	}
+	return &instanceResponse{instances: shuffled}, nil
+}
+
+func TestRefreshSortTargets(t *testing.T) {
+	compartments := map[string][]Instance{}
+	for _, id := range []string{
+		"ocid1.instance.oc1.phx.b",
+		"ocid1.instance.oc1.iad.c",
+		"ocid1.instance.oc1.phx.a",
+		"ocid1.instance.oc1.iad.d",
+	} {
+		for _, compartmentID := range []string{"compartment_id1", "compartment_id2", "compartment_id3"} {
+			compartments[compartmentID] = append(compartments[compartmentID], Instance{ID: id + compartmentID, CompartmentID: compartmentID, PrivateIP: "10.0.0.1"})
+		}
+	}
+	discovery := Discovery{
+		settings: settings{
+			rootCompartmentID:      "root_compartment_id",
+			port:                   testInstancePort,
+			logger:                 log.NewNopLogger(),
+			ociClientWrapper:       shufflingOciClientWrapper{compartments: compartments},
+			compartmentConcurrency: 3,
+			sortTargets:            true,
+		},
+	}
+	var first []model.LabelValue
+	for i := 0; i < 10; i++ {
+		tgs, err := discovery.refresh()
+		testutil.Ok(t, err)
+		var ids []model.LabelValue
+		for _, tg := range tgs {
+			ids = append(ids, tg.Labels[ociInstanceID])
+		}
+		if first == nil {
+			first = ids
+		}
+		testutil.Equals(t, first, ids)
+	}
+	testutil.Equals(t, 12, len(first))
+	testutil.Equals(t, model.LabelValue("ocid1.instance.oc1.iad.ccompartment_id1"), first[0])
+	testutil.Equals(t, model.LabelValue("ocid1.instance.oc1.iad.dcompartment_id1"), first[1])
+	testutil.Equals(t, model.LabelValue("ocid1.instance.oc1.iad.ccompartment_id2"), first[2])
+	testutil.Equals(t, model.LabelValue("ocid1.instance.oc1.phx.bcompartment_id3"), first[11])
+}
+
+func TestShapeFamily(t *testing.T) {
+	for shape, family := range map[string]string{
+		"VM.Standard2.1":      "Standard",
+		"VM.Standard.E4.Flex": "Standard",
+		"BM.Standard.A1.160":  "Standard",
+		"VM.DenseIO2.8":       "DenseIO",
+		"BM.DenseIO.E4.128":   "DenseIO",
+		"BM.GPU3.8":           "GPU",
+		"VM.GPU.A10.1":        "GPU",
+		"BM.HPC2.36":          "HPC",
+		"VM.Optimized3.Flex":  "Optimized",
+		"VM.Custom.1":         "unknown",
+		"Exadata.Quarter1.84": "unknown",
+		"Standard":            "unknown",
+	} {
+		testutil.Equals(t, family, shapeFamily(shape))
+	}
+}
+
+func TestRefreshShape(t *testing.T) {
+	discovery := newSingleCompartmentDiscovery(2)
+	discovery.ociClientWrapper.(*testOciClientWrapper).instances[0].Shape = "VM.DenseIO2.8"
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelValue("VM.DenseIO2.8"), tgs[0].Labels[ociShape])
+	testutil.Equals(t, model.LabelValue("DenseIO"), tgs[0].Labels[ociShapeFamily])
+	_, ok := tgs[1].Labels[ociShapeFamily]
+	testutil.Assert(t, !ok, "expected no shape family without a shape")
+}
+
+func TestRefreshUnresolvedAddressPlaceholder(t *testing.T) {
+	clientWrapper := &testOciClientWrapper{instances: []Instance{
+		{ID: "instance_id1", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1", PublicIP: "192.0.2.1"},
+		{ID: "instance_id2", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.2"},
+		{ID: "instance_id3", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.3"},
+	}}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:     testCompartmentID,
+			port:              testInstancePort,
+			logger:            log.NewNopLogger(),
+			ociClientWrapper:  clientWrapper,
+			addressPreference: []string{addressPublic},
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(tgs))
+	_, ok := tgs[0].Labels[ociAddressResolved]
+	testutil.Assert(t, !ok, "expected no resolution label without placeholder")
+
+	discovery.unresolvedAddress = "unresolved.invalid:9100"
+	discovery.dedupKey = []string{dedupKeyAddress}
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, len(tgs))
+	testutil.Equals(t, model.LabelValue("192.0.2.1:9100"), tgs[0].Targets[0][model.AddressLabel])
+	testutil.Equals(t, model.LabelValue("true"), tgs[0].Labels[ociAddressResolved])
+	for _, tg := range tgs[1:] {
+		testutil.Equals(t, model.LabelValue("unresolved.invalid:9100"), tg.Targets[0][model.AddressLabel])
+		testutil.Equals(t, model.LabelValue("false"), tg.Labels[ociAddressResolved])
+	}
+}
+
+func TestRefreshSubnetPublic(t *testing.T) {
+	clientWrapper, computeClient, virtualNetworkClient := newTestRemoteOciClientWrapper()
+	computeClient.instances = nil
+	for i, subnetID := range []string{"public_subnet_id", "private_subnet_id", "public_subnet_id"} {
+		instanceID := fmt.Sprintf("instance_id%d", i+1)
+		vnicID := fmt.Sprintf("vnic_id%d", i+1)
+		computeClient.instances = append(computeClient.instances, core.Instance{
+			Id:            common.String(instanceID),
+			DisplayName:   common.String(instanceID),
+			CompartmentId: common.String(testCompartmentID),
+		})
+		computeClient.vnicAttachments[instanceID] = []core.VnicAttachment{{InstanceId: common.String(instanceID), VnicId: common.String(vnicID)}}
+		virtualNetworkClient.vnics[vnicID] = core.Vnic{Id: common.String(vnicID), PrivateIp: common.String(fmt.Sprintf("10.0.0.%d", i+1)), SubnetId: common.String(subnetID)}
+	}
+	virtualNetworkClient.subnets = map[string]core.Subnet{
+		"public_subnet_id":  {Id: common.String("public_subnet_id"), ProhibitPublicIpOnVnic: common.Bool(false)},
+		"private_subnet_id": {Id: common.String("private_subnet_id"), ProhibitPublicIpOnVnic: common.Bool(true)},
+	}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	_, ok := tgs[0].Labels[ociSubnetPublic]
+	testutil.Assert(t, !ok, "expected no subnet label unless enabled")
+	testutil.Equals(t, 0, virtualNetworkClient.subnetLookups)
+
+	clientWrapper.emitSubnetPublic = true
+	discovery.ociClientWrapper = clientWrapper
+	for i := 0; i < 2; i++ {
+		tgs, err = discovery.refresh()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 3, len(tgs))
+		testutil.Equals(t, model.LabelValue("true"), tgs[0].Labels[ociSubnetPublic])
+		testutil.Equals(t, model.LabelValue("false"), tgs[1].Labels[ociSubnetPublic])
+		testutil.Equals(t, model.LabelValue("true"), tgs[2].Labels[ociSubnetPublic])
+	}
+	// Each subnet is looked up once.
+	testutil.Equals(t, 2, virtualNetworkClient.subnetLookups)
+}
+
+// countingNamespaceClientWrapper counts namespace lookups.
+type countingNamespaceClientWrapper struct {
+	testOciClientWrapper
+	lookups *int
+}
+
+func (w countingNamespaceClientWrapper) GetNamespace(ctx context.Context) (string, error) {
+	*w.lookups++
+	return w.testOciClientWrapper.GetNamespace(ctx)
+}
+
+func TestRefreshNamespace(t *testing.T) {
+	lookups := 0
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: countingNamespaceClientWrapper{lookups: &lookups},
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	_, ok := tgs[0].Labels[ociNamespace]
+	testutil.Assert(t, !ok, "expected no namespace label unless enabled")
+	testutil.Equals(t, 0, lookups)
+
+	discovery.emitNamespace = true
+	for i := 0; i < 2; i++ {
+		tgs, err = discovery.refresh()
+		testutil.Ok(t, err)
+		testutil.Equals(t, model.LabelValue(testNamespace), tgs[0].Labels[ociNamespace])
+	}
+	testutil.Equals(t, 1, lookups)
+}
+
+// countingTenancyNameClientWrapper counts tenancy name lookups.
+type countingTenancyNameClientWrapper struct {
+	testOciClientWrapper
+	lookups *int
+}
+
+func (w countingTenancyNameClientWrapper) GetTenancyName(ctx context.Context) (string, error) {
+	*w.lookups++
+	return w.testOciClientWrapper.GetTenancyName(ctx)
+}
+
+func TestRefreshTenancyName(t *testing.T) {
+	lookups := 0
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: countingTenancyNameClientWrapper{lookups: &lookups},
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	_, ok := tgs[0].Labels[ociTenancyName]
+	testutil.Assert(t, !ok, "expected no tenancy name label unless enabled")
+	testutil.Equals(t, 0, lookups)
+
+	discovery.emitTenancyName = true
+	for i := 0; i < 2; i++ {
+		tgs, err = discovery.refresh()
+		testutil.Ok(t, err)
+		testutil.Equals(t, model.LabelValue(testTenancyName), tgs[0].Labels[ociTenancyName])
+	}
+	testutil.Equals(t, 1, lookups)
+
+	clientWrapper := remoteOciClientWrapper{ociIdentityClient: &testIdentityClient{}, tenancyID: "tenancy_id1"}
+	name, err := clientWrapper.GetTenancyName(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, "tenancy_id1_name", name)
+}
+
+// countingRootClientWrapper counts lookups of the root compartment.
+type countingRootClientWrapper struct {
+	treeOciClientWrapper
+	lookups *int
+}
+
+func (w countingRootClientWrapper) GetCompartment(ctx context.Context, compartmentID *string) (compartment, error) {
+	if *compartmentID == "root_compartment_id1" {
+		*w.lookups++
+	}
+	return w.treeOciClientWrapper.GetCompartment(ctx, compartmentID)
+}
+
+func TestRefreshRootCompartmentName(t *testing.T) {
+	lookups := 0
+	clientWrapper := countingRootClientWrapper{
+		treeOciClientWrapper: treeOciClientWrapper{
+			compartmentIDs: []string{"a", "b", "c"},
+			instances: map[string][]Instance{
+				"a": {{ID: "instance_id1", CompartmentID: "a", PrivateIP: "10.0.0.1"}},
+				"b": {{ID: "instance_id2", CompartmentID: "b", PrivateIP: "10.0.0.2"}},
+				"c": {{ID: "instance_id3", CompartmentID: "c", PrivateIP: "10.0.0.3"}},
+			},
+			depths:  map[string]int{"c": 2},
+			parents: map[string]string{"a": "root_compartment_id1", "b": "root_compartment_id1", "c": "b"},
+		},
+		lookups: &lookups,
+	}
+	discovery := Discovery{
+		settings: settings{
+			rootCompartmentID: "root_compartment_id1",
+			port:              testInstancePort,
+			logger:            log.NewNopLogger(),
+			ociClientWrapper:  clientWrapper,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	_, ok := tgs[0].Labels[ociRootName]
+	testutil.Assert(t, !ok, "expected no root compartment name label unless enabled")
+	testutil.Equals(t, 0, lookups)
+
+	discovery.emitRootName = true
+	for i := 0; i < 2; i++ {
+		tgs, err = discovery.refresh()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 3, len(tgs))
+		for _, tg := range tgs {
+			testutil.Equals(t, model.LabelValue("root_compartment_id1_name"), tg.Labels[ociRootName])
+		}
+		testutil.Equals(t, model.LabelValue("a_name"), tgs[0].Labels[ociCompartmentName])
+		testutil.Equals(t, model.LabelValue("c_name"), tgs[2].Labels[ociCompartmentName])
+	}
+	testutil.Equals(t, 1, lookups)
+}
+
+func TestRefreshGroupByAvailabilityDomain(t *testing.T) {
+	discovery := newSingleCompartmentDiscovery(3)
+	instances := discovery.ociClientWrapper.(*testOciClientWrapper).instances
+	instances[0].AvailabilityDomain = "AD-1"
+	instances[1].AvailabilityDomain = "AD-2"
+	instances[2].AvailabilityDomain = "AD-1"
+	discovery.groupBy = groupByAvailabilityDomain
+
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+	testutil.Equals(t, "OCI_AD_AD-1", tgs[0].Source)
+	testutil.Equals(t, model.LabelSet{ociAvailabilityDomain: "AD-1"}, tgs[0].Labels)
+	testutil.Equals(t, 2, len(tgs[0].Targets))
+	testutil.Equals(t, model.LabelValue("instance_id0"), tgs[0].Targets[0][ociInstanceID])
+	testutil.Equals(t, model.LabelValue(fmt.Sprintf("10.0.0.0:%d", testInstancePort)), tgs[0].Targets[0][model.AddressLabel])
+	testutil.Equals(t, model.LabelValue("instance_id2"), tgs[0].Targets[1][ociInstanceID])
+	_, ok := tgs[0].Targets[0][ociAvailabilityDomain]
+	testutil.Assert(t, !ok, "expected the availability domain label only on the group")
+	testutil.Equals(t, "OCI_AD_AD-2", tgs[1].Source)
+	testutil.Equals(t, 1, len(tgs[1].Targets))
+	testutil.Equals(t, model.LabelValue("instance_id1"), tgs[1].Targets[0][ociInstanceID])
+}
+
+func TestRefreshIsHomeRegion(t *testing.T) {
+	discovery := newSingleCompartmentDiscovery(3)
+	instances := discovery.ociClientWrapper.(*testOciClientWrapper).instances
+	instances[0].Region = "phx"
+	instances[1].Region = "us-ashburn-1"
+	instances[2].Region = "us-phoenix-1"
+
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	_, ok := tgs[0].Labels[ociIsHomeRegion]
+	testutil.Assert(t, !ok, "expected no home region label without a home region")
+
+	discovery.homeRegion = "us-phoenix-1"
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelValue("true"), tgs[0].Labels[ociIsHomeRegion])
+	testutil.Equals(t, model.LabelValue("false"), tgs[1].Labels[ociIsHomeRegion])
+	testutil.Equals(t, model.LabelValue("true"), tgs[2].Labels[ociIsHomeRegion])
+}
+
+type contextKey string
+
+// contextOciClientWrapper records the context instances are listed with.
+type contextOciClientWrapper struct {
+	testOciClientWrapper
+	ctx *context.Context
+}
+
+func (w contextOciClientWrapper) ListInstances(ctx context.Context, compartmentID *string, filter instanceFilter) (*instanceResponse, error) {
+	*w.ctx = ctx
+	return w.testOciClientWrapper.ListInstances(ctx, compartmentID, filter)
+}
+
+func TestRunRefreshDeadline(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		refreshTimeout time.Duration
+		maxDeadline    time.Duration
+	}{
+		{name: "run context deadline", maxDeadline: time.Hour},
+		{name: "refresh timeout", refreshTimeout: time.Minute, maxDeadline: time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var listCtx context.Context
+			discovery := Discovery{
+				settings: settings{
+					compartmentID:    testCompartmentID,
+					interval:         time.Hour,
+					port:             testInstancePort,
+					logger:           log.NewNopLogger(),
+					ociClientWrapper: contextOciClientWrapper{ctx: &listCtx},
+					refreshTimeout:   tc.refreshTimeout,
+				},
+			}
+			ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), contextKey("run"), "value"), time.Hour)
+			defer cancel()
+			ch := make(chan []*targetgroup.Group)
+			go discovery.Run(ctx, ch)
+			checkTarget(t, <-ch)
+
+			testutil.Equals(t, "value", listCtx.Value(contextKey("run")))
+			deadline, ok := listCtx.Deadline()
+			testutil.Assert(t, ok, "expected refreshes to have a deadline")
+			remaining := time.Until(deadline)
+			testutil.Assert(t, remaining <= tc.maxDeadline, "expected a deadline within %s, got %s", tc.maxDeadline, remaining)
+			testutil.Assert(t, remaining > tc.maxDeadline-time.Minute/2, "expected a deadline close to %s, got %s", tc.maxDeadline, remaining)
+		})
+	}
+}
+
+func TestRefreshCompartmentDepth(t *testing.T) {
+	clientWrapper := treeOciClientWrapper{
+		compartmentIDs: []string{"a", "a1", "a1x"},
+		instances: map[string][]Instance{
+			"root_compartment_id1": {{ID: "instance_id0", CompartmentID: "root_compartment_id1", PrivateIP: "10.0.0.0"}},
+			"a":                    {{ID: "instance_id1", CompartmentID: "a", PrivateIP: "10.0.0.1"}},
+			"a1":                   {{ID: "instance_id2", CompartmentID: "a1", PrivateIP: "10.0.0.2"}},
+			"a1x":                  {{ID: "instance_id3", CompartmentID: "a1x", PrivateIP: "10.0.0.3"}},
+		},
+		depths: map[string]int{"a1": 2, "a1x": 3},
+	}
+	discovery := Discovery{
+		settings: settings{
+			rootCompartmentID:      "root_compartment_id1",
+			port:                   testInstancePort,
+			logger:                 log.NewNopLogger(),
+			ociClientWrapper:       clientWrapper,
+			includeRootCompartment: true,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 4, len(tgs))
+	for i, tg := range tgs {
+		testutil.Equals(t, model.LabelValue(strconv.Itoa(i)), tg.Labels[ociCompartmentDepth])
+	}
+
+	discovery = Discovery{
+		settings: settings{
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+			searchQuery:      "query instance resources",
+		},
+	}
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	_, ok := tgs[0].Labels[ociCompartmentDepth]
+	testutil.Assert(t, !ok, "expected no compartment depth for search results")
+}
+
+// flakyOciClientWrapper lists no instances for the calls marked empty.
+type flakyOciClientWrapper struct {
+	testOciClientWrapper
+	calls *int
+	empty map[int]bool
+}
+
+func (w flakyOciClientWrapper) ListInstances(ctx context.Context, compartmentID *string, filter instanceFilter) (*instanceResponse, error) {
+	*w.calls++
+	if w.empty[*w.calls] {
+		return &instanceResponse{}, nil
+	}
+	return w.testOciClientWrapper.ListInstances(ctx, compartmentID, filter)
+}
+
+func TestRefreshRetryOnEmpty(t *testing.T) {
+	calls := 0
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:     testCompartmentID,
+			port:              testInstancePort,
+			logger:            log.NewNopLogger(),
+			ociClientWrapper:  flakyOciClientWrapper{calls: &calls, empty: map[int]bool{1: true, 3: true, 5: true, 6: true, 7: true}},
+			retryOnEmpty:      2,
+			retryOnEmptyDelay: time.Millisecond,
+		},
+	}
+
+	// Without targets found before, empty results are accepted right away.
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(tgs))
+	testutil.Equals(t, 1, calls)
+
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	checkTarget(t, tgs)
+	testutil.Equals(t, 2, calls)
+
+	// A transiently empty result is retried.
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	checkTarget(t, tgs)
+	testutil.Equals(t, 4, calls)
+
+	// Empty results are accepted after the maximum number of retries.
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(tgs))
+	testutil.Equals(t, 7, calls)
+}
+
+func TestRefreshLabelNameMode(t *testing.T) {
+	discovery := newSingleCompartmentDiscovery(1)
+	discovery.ociClientWrapper.(*testOciClientWrapper).instances[0].FreeformTags = map[string]string{"app.kubernetes.io/name": "web"}
+
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelValue("web"), tgs[0].Labels[ociTagLabel+"app_kubernetes_io_name"])
+	_, ok := tgs[0].Labels[ociTagLabel+"app.kubernetes.io/name"]
+	testutil.Assert(t, !ok, "expected tag keys to be sanitized by default")
+
+	discovery.labelNameMode = labelNameModeUTF8
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelValue("web"), tgs[0].Labels[ociTagLabel+"app.kubernetes.io/name"])
+	_, ok = tgs[0].Labels[ociTagLabel+"app_kubernetes_io_name"]
+	testutil.Assert(t, !ok, "expected tag keys to be kept in utf8 mode")
+}
+
+// histogramSampleCount returns the number of observations of the named
+// histogram registered with the default registry.
+func histogramSampleCount(t *testing.T, name string) uint64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	testutil.Ok(t, err)
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()[0].GetHistogram().GetSampleCount()
+		}
+	}
+	t.Fatalf("histogram %s not registered", name)
+	return 0
+}
+
+func TestListInstancesVNICResolutionDuration(t *testing.T) {
+	clientWrapper, computeClient, _ := newTestRemoteOciClientWrapper()
+	computeClient.instances = append(computeClient.instances, core.Instance{
+		Id:            common.String("instance_id2"),
+		DisplayName:   common.String("instance_name2"),
+		CompartmentId: common.String(testCompartmentID),
+	})
+	before := histogramSampleCount(t, "prometheus_sd_oci_vnic_resolution_duration_seconds")
+	_, err := clientWrapper.ListInstances(context.Background(), &testCompartmentID, instanceFilter{})
+	testutil.Ok(t, err)
+	testutil.Equals(t, before+2, histogramSampleCount(t, "prometheus_sd_oci_vnic_resolution_duration_seconds"))
+}
+
+func TestGetCompartmentIDsRootChildNames(t *testing.T) {
+	compartment := func(id, name, parentID string) identity.Compartment {
+		return identity.Compartment{Id: common.String(id), Name: common.String(name), CompartmentId: common.String(parentID), LifecycleState: identity.CompartmentLifecycleStateActive}
+	}
+	identityClient := &testIdentityClient{compartments: []identity.Compartment{
+		compartment("prod_id", "prod", "root"),
+		compartment("prod_web_id", "web", "prod_id"),
+		compartment("staging_id", "staging", "root"),
+		compartment("staging_prod_id", "prod", "staging_id"),
+		compartment("dev_id", "dev", "root"),
+		compartment("dev_web_id", "web", "dev_id"),
+	}}
+	clientWrapper := remoteOciClientWrapper{
+		ociIdentityClient:   identityClient,
+		recurseCompartments: true,
+		rootChildNames:      map[string]bool{"prod": true, "staging": true},
+	}
+	ids, err := clientWrapper.GetCompartmentIDs(context.Background(), common.String("root"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"prod_id", "prod_web_id", "staging_id", "staging_prod_id"}, compartmentRefIDs(ids))
+	for _, request := range identityClient.listCompartmentsRequests {
+		testutil.Assert(t, stringValue(request.CompartmentId) != "dev_id", "expected the dev branch not to be walked")
+	}
+}
+
+func TestRefreshBootVolumeID(t *testing.T) {
+	clientWrapper, computeClient, virtualNetworkClient := newTestRemoteOciClientWrapper()
+	computeClient.instances = append(computeClient.instances, core.Instance{
+		Id:            common.String("instance_id2"),
+		DisplayName:   common.String("instance_name2"),
+		CompartmentId: common.String(testCompartmentID),
+	})
+	computeClient.vnicAttachments["instance_id2"] = []core.VnicAttachment{{InstanceId: common.String("instance_id2"), VnicId: common.String("vnic_id2")}}
+	virtualNetworkClient.vnics["vnic_id2"] = core.Vnic{PrivateIp: common.String("10.0.0.2")}
+	computeClient.bootVolumeAttachments = map[string][]core.BootVolumeAttachment{
+		testInstanceID: {
+			{BootVolumeId: common.String("old_boot_volume_id"), LifecycleState: core.BootVolumeAttachmentLifecycleStateDetached},
+			{BootVolumeId: common.String("boot_volume_id1"), LifecycleState: core.BootVolumeAttachmentLifecycleStateAttached},
+		},
+	}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	_, ok := tgs[0].Labels[ociBootVolumeID]
+	testutil.Assert(t, !ok, "expected no boot volume id unless enabled")
+
+	clientWrapper.emitBootVolumeID = true
+	discovery.ociClientWrapper = clientWrapper
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+	testutil.Equals(t, model.LabelValue("boot_volume_id1"), tgs[0].Labels[ociBootVolumeID])
+	// Instances without a boot volume attachment have no label.
+	_, ok = tgs[1].Labels[ociBootVolumeID]
+	testutil.Assert(t, !ok, "expected no boot volume id without an attachment")
+}
+
+func TestRefreshMetadataOnlyStates(t *testing.T) {
+	clientWrapper, computeClient, virtualNetworkClient := newTestRemoteOciClientWrapper()
+	computeClient.instances[0].LifecycleState = core.InstanceLifecycleStateRunning
+	for _, instance := range []core.Instance{
+		{Id: common.String("instance_id2"), LifecycleState: core.InstanceLifecycleStateStopped},
+		{Id: common.String("instance_id3"), LifecycleState: core.InstanceLifecycleStateTerminated},
+	} {
+		instance.DisplayName = instance.Id
+		instance.CompartmentId = common.String(testCompartmentID)
+		computeClient.instances = append(computeClient.instances, instance)
+		vnicID := "vnic_" + *instance.Id
+		computeClient.vnicAttachments[*instance.Id] = []core.VnicAttachment{{InstanceId: instance.Id, VnicId: common.String(vnicID)}}
+		virtualNetworkClient.vnics[vnicID] = core.Vnic{PrivateIp: common.String("10.0.0.2")}
+	}
+	clientWrapper.metadataOnlyStates = stringSet([]string{"STOPPED"})
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:           testCompartmentID,
+			port:                    testInstancePort,
+			logger:                  log.NewNopLogger(),
+			ociClientWrapper:        clientWrapper,
+			metadataOnly:            true,
+			metadataOnlyOmitAddress: true,
+		},
+	}
+
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+	testutil.Equals(t, core.InstanceLifecycleStateEnum(""), computeClient.listInstancesRequests[0].LifecycleState)
+	testutil.Equals(t, model.LabelValue("true"), tgs[0].Labels[ociScrapeable])
+	testutil.Equals(t, model.LabelValue("RUNNING"), tgs[0].Labels[ociInstanceState])
+	testutil.Equals(t, model.LabelValue(testInstancePrivateIP+":"+strconv.Itoa(testInstancePort)), tgs[0].Targets[0][model.AddressLabel])
+
+	testutil.Equals(t, model.LabelValue("instance_id2"), tgs[1].Labels[ociInstanceID])
+	testutil.Equals(t, model.LabelValue("false"), tgs[1].Labels[ociScrapeable])
+	testutil.Equals(t, model.LabelValue("STOPPED"), tgs[1].Labels[ociInstanceState])
+	testutil.Equals(t, model.LabelValue("10.0.0.2"), tgs[1].Labels[ociPrivateIP])
+	_, ok := tgs[1].Targets[0][model.AddressLabel]
+	testutil.Assert(t, !ok, "expected no address for metadata only instance")
+	_, ok = tgs[1].Labels[model.AddressLabel]
+	testutil.Assert(t, !ok, "expected no address label for metadata only instance")
+
+	discovery.metadataOnlyOmitAddress = false
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelValue("false"), tgs[1].Labels[ociScrapeable])
+	testutil.Equals(t, model.LabelValue("10.0.0.2:"+strconv.Itoa(testInstancePort)), tgs[1].Targets[0][model.AddressLabel])
+}
+
+func TestRefreshScrapeableStates(t *testing.T) {
+	clientWrapper, computeClient, virtualNetworkClient := newTestRemoteOciClientWrapper()
+	computeClient.instances[0].LifecycleState = core.InstanceLifecycleStateRunning
+	for _, instance := range []core.Instance{
+		{Id: common.String("instance_id2"), LifecycleState: core.InstanceLifecycleStateStopped},
+		{Id: common.String("instance_id3"), LifecycleState: core.InstanceLifecycleStateTerminated},
+		{Id: common.String("instance_id4"), LifecycleState: core.InstanceLifecycleStateStarting},
+	} {
+		instance.DisplayName = instance.Id
+		instance.CompartmentId = common.String(testCompartmentID)
+		computeClient.instances = append(computeClient.instances, instance)
+		vnicID := "vnic_" + *instance.Id
+		computeClient.vnicAttachments[*instance.Id] = []core.VnicAttachment{{InstanceId: instance.Id, VnicId: common.String(vnicID)}}
+		virtualNetworkClient.vnics[vnicID] = core.Vnic{PrivateIp: common.String("10.0.0.2")}
+	}
+
+	for _, tc := range []struct {
+		name         string
+		scrapeable   []string
+		metadataOnly []string
+		// expected maps the discovered instances to whether they are
+		// scrapeable.
+		expected map[string]bool
+	}{
+		{
+			name:       "stopped instances scrapeable",
+			scrapeable: []string{"RUNNING", "STOPPED"},
+			expected:   map[string]bool{testInstanceID: true, "instance_id2": true},
+		},
+		{
+			name:         "running instances metadata only",
+			scrapeable:   []string{"STARTING"},
+			metadataOnly: []string{"TERMINATED"},
+			expected:     map[string]bool{testInstanceID: false, "instance_id3": false, "instance_id4": true},
+		},
+		{
+			name:         "running instances scrapeable",
+			scrapeable:   []string{"RUNNING"},
+			metadataOnly: []string{"STOPPED", "STARTING"},
+			expected:     map[string]bool{testInstanceID: true, "instance_id2": false, "instance_id4": false},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clientWrapper.scrapeableStates = stringSet(tc.scrapeable)
+			clientWrapper.metadataOnlyStates = stringSet(tc.metadataOnly)
+			discovery := Discovery{
+				settings: settings{
+					compartmentID:    testCompartmentID,
+					port:             testInstancePort,
+					logger:           log.NewNopLogger(),
+					ociClientWrapper: clientWrapper,
+					metadataOnly:     true,
+					scrapeableStates: stringSet(tc.scrapeable),
+				},
+			}
+			tgs, err := discovery.refresh()
+			testutil.Ok(t, err)
+			testutil.Equals(t, len(tc.expected), len(tgs))
+			for _, tg := range tgs {
+				scrapeable, ok := tc.expected[string(tg.Labels[ociInstanceID])]
+				testutil.Assert(t, ok, "unexpected instance %s", tg.Labels[ociInstanceID])
+				testutil.Equals(t, model.LabelValue(strconv.FormatBool(scrapeable)), tg.Labels[ociScrapeable])
+				_, ok = tg.Targets[0][model.AddressLabel]
+				testutil.Equals(t, scrapeable, ok)
+			}
+		})
+	}
+}
+
+func TestCompartmentNames(t *testing.T) {
+	clientWrapper := treeOciClientWrapper{
+		compartmentIDs: []string{"a", "b"},
+		instances: map[string][]Instance{
+			"a": {{ID: "instance_id1", CompartmentID: "a", PrivateIP: "10.0.0.1"}},
+		},
+	}
+	discovery := Discovery{
+		settings: settings{
+			rootCompartmentID:      "root_compartment_id1",
+			port:                   testInstancePort,
+			logger:                 log.NewNopLogger(),
+			ociClientWrapper:       clientWrapper,
+			includeRootCompartment: true,
+		},
+	}
+	testutil.Equals(t, map[string]string{}, discovery.CompartmentNames())
+
+	_, err := discovery.refresh()
+	testutil.Ok(t, err)
+	// Compartments without instances are included.
+	testutil.Equals(t, map[string]string{
+		"root_compartment_id1": "root_compartment_id1_name",
+		"a":                    "a_name",
+		"b":                    "b_name",
+	}, discovery.CompartmentNames())
+
+	// Callers get a copy.
+	discovery.CompartmentNames()["c"] = "c_name"
+	testutil.Equals(t, 3, len(discovery.CompartmentNames()))
+}
+
+func TestListAvailabilityDomains(t *testing.T) {
+	clientWrapper := remoteOciClientWrapper{
+		ociIdentityClient: &testIdentityClient{availabilityDomains: []string{"AD-1", "AD-2"}},
+	}
+	domains, err := clientWrapper.ListAvailabilityDomains(context.Background(), common.String("tenancy_id1"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"AD-1", "AD-2"}, domains)
+}
+
+func TestRefreshMaintenanceRebootDue(t *testing.T) {
+	clientWrapper, computeClient, virtualNetworkClient := newTestRemoteOciClientWrapper()
+	due := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	computeClient.instances[0].TimeMaintenanceRebootDue = &common.SDKTime{Time: due}
+	computeClient.instances = append(computeClient.instances, core.Instance{
+		Id:            common.String("instance_id2"),
+		DisplayName:   common.String("instance_id2"),
+		CompartmentId: common.String(testCompartmentID),
+	})
+	computeClient.vnicAttachments["instance_id2"] = []core.VnicAttachment{{InstanceId: common.String("instance_id2"), VnicId: common.String("vnic_id2")}}
+	virtualNetworkClient.vnics["vnic_id2"] = core.Vnic{Id: common.String("vnic_id2"), PrivateIp: common.String("10.0.0.2")}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+	testutil.Equals(t, model.LabelValue("2019-03-01T12:00:00Z"), tgs[0].Labels[ociRebootDue])
+	_, ok := tgs[1].Labels[ociRebootDue]
+	testutil.Assert(t, !ok, "expected no reboot label without a scheduled reboot")
+}
+
+func TestRefreshRotateAvailabilityDomains(t *testing.T) {
+	clientWrapper := &testOciClientWrapper{instances: []Instance{
+		{ID: "instance_id1", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1", AvailabilityDomain: "AD-1"},
+		{ID: "instance_id2", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.2", AvailabilityDomain: "AD-2"},
+		{ID: "instance_id3", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.3", AvailabilityDomain: "AD-3"},
+	}}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:             testCompartmentID,
+			port:                      testInstancePort,
+			logger:                    log.NewNopLogger(),
+			ociClientWrapper:          clientWrapper,
+			rotateAvailabilityDomains: true,
+		},
+	}
+	instanceIDs := func(tgs []*targetgroup.Group) []string {
+		var ids []string
+		for _, tg := range tgs {
+			ids = append(ids, string(tg.Labels[ociInstanceID]))
+		}
+		return ids
+	}
+
+	// Each refresh adds the targets of one more availability domain.
+	for _, expected := range [][]string{
+		{"instance_id1"},
+		{"instance_id1", "instance_id2"},
+		{"instance_id1", "instance_id2", "instance_id3"},
+	} {
+		tgs, err := discovery.refresh()
+		testutil.Ok(t, err)
+		testutil.Equals(t, expected, instanceIDs(tgs))
+	}
+
+	// Changes in an availability domain show once it is refreshed again.
+	clientWrapper.instances = clientWrapper.instances[1:]
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"instance_id2", "instance_id3"}, instanceIDs(tgs))
+}
+
+func TestRefreshIPFilterCIDRs(t *testing.T) {
+	clientWrapper := &testOciClientWrapper{instances: []Instance{
+		{ID: "instance_id1", CompartmentID: testCompartmentID, PrivateIP: "10.0.1.5", PublicIP: "203.0.113.5"},
+		{ID: "instance_id2", CompartmentID: testCompartmentID, PrivateIP: "10.0.2.5", PublicIP: "203.0.113.6"},
+		{ID: "instance_id3", CompartmentID: testCompartmentID, PrivateIP: "10.0.3.5"},
+	}}
+	ipFilterNets, err := parseCIDRs([]string{"10.0.1.0/24", "10.0.3.0/24"})
+	testutil.Ok(t, err)
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+			ipFilterNets:     ipFilterNets,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+	testutil.Equals(t, model.LabelValue("instance_id1"), tgs[0].Labels[ociInstanceID])
+	testutil.Equals(t, model.LabelValue("instance_id3"), tgs[1].Labels[ociInstanceID])
+
+	// The filter applies to the address scraped.
+	discovery.addressPreference = []string{addressPublic, addressPrivate}
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(tgs))
+	testutil.Equals(t, model.LabelValue("instance_id3"), tgs[0].Labels[ociInstanceID])
+}
+
+func TestRefreshParentCompartmentID(t *testing.T) {
+	clientWrapper := treeOciClientWrapper{
+		compartmentIDs: []string{"a", "a1"},
+		instances: map[string][]Instance{
+			"root_compartment_id1": {{ID: "instance_id0", CompartmentID: "root_compartment_id1", PrivateIP: "10.0.0.0"}},
+			"a":                    {{ID: "instance_id1", CompartmentID: "a", PrivateIP: "10.0.0.1"}},
+			"a1":                   {{ID: "instance_id2", CompartmentID: "a1", PrivateIP: "10.0.0.2"}},
+		},
+		parents: map[string]string{"a": "root_compartment_id1", "a1": "a"},
+	}
+	discovery := Discovery{
+		settings: settings{
+			rootCompartmentID:      "root_compartment_id1",
+			port:                   testInstancePort,
+			logger:                 log.NewNopLogger(),
+			ociClientWrapper:       clientWrapper,
+			includeRootCompartment: true,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, len(tgs))
+	_, ok := tgs[0].Labels[ociParentCompartment]
+	testutil.Assert(t, !ok, "expected no parent compartment id for the root compartment")
+	testutil.Equals(t, model.LabelValue("root_compartment_id1"), tgs[1].Labels[ociParentCompartment])
+	testutil.Equals(t, model.LabelValue("a"), tgs[2].Labels[ociParentCompartment])
+}
+
+func TestGetCompartmentParentID(t *testing.T) {
+	clientWrapper := remoteOciClientWrapper{
+		ociIdentityClient: &testIdentityClient{compartments: []identity.Compartment{
+			{Id: common.String("a"), CompartmentId: common.String("root")},
+		}},
+	}
+	c, err := clientWrapper.GetCompartment(context.Background(), common.String("a"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, "root", c.parentID)
+	c, err = clientWrapper.GetCompartment(context.Background(), common.String("root"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, "", c.parentID)
+}
+
+func TestListInstancesPreferredSubnet(t *testing.T) {
+	clientWrapper, computeClient, virtualNetworkClient := newTestRemoteOciClientWrapper()
+	computeClient.vnicAttachments[testInstanceID] = []core.VnicAttachment{
+		{InstanceId: common.String(testInstanceID), VnicId: common.String("vnic_mgmt")},
+		{InstanceId: common.String(testInstanceID), VnicId: common.String("vnic_data")},
+	}
+	virtualNetworkClient.vnics["vnic_mgmt"] = core.Vnic{Id: common.String("vnic_mgmt"), SubnetId: common.String("subnet_mgmt"), PrivateIp: common.String("10.0.1.5")}
+	virtualNetworkClient.vnics["vnic_data"] = core.Vnic{Id: common.String("vnic_data"), SubnetId: common.String("subnet_data"), PrivateIp: common.String("10.0.2.5"), PublicIp: common.String("203.0.113.5")}
+
+	response, err := clientWrapper.ListInstances(context.Background(), common.String(testCompartmentID), instanceFilter{})
+	testutil.Ok(t, err)
+	testutil.Equals(t, "10.0.2.5", response.instances[0].PrivateIP)
+
+	clientWrapper.preferredSubnetID = "subnet_mgmt"
+	response, err = clientWrapper.ListInstances(context.Background(), common.String(testCompartmentID), instanceFilter{})
+	testutil.Ok(t, err)
+	testutil.Equals(t, "10.0.1.5", response.instances[0].PrivateIP)
+	testutil.Equals(t, "", response.instances[0].PublicIP)
+	testutil.Assert(t, !response.instances[0].missingPreferredSubnet, "expected the preferred subnet to be found")
+
+	// Instances without a VNIC on the preferred subnet keep their default
+	// address.
+	clientWrapper.preferredSubnetID = "subnet_other"
+	response, err = clientWrapper.ListInstances(context.Background(), common.String(testCompartmentID), instanceFilter{})
+	testutil.Ok(t, err)
+	testutil.Equals(t, "10.0.2.5", response.instances[0].PrivateIP)
+	testutil.Assert(t, response.instances[0].missingPreferredSubnet, "expected the preferred subnet to be missing")
+}
+
+func TestRefreshFailOnNoCompartments(t *testing.T) {
+	clientWrapper := treeOciClientWrapper{
+		instances: map[string][]Instance{
+			"root_compartment_id1": {{ID: "instance_id0", CompartmentID: "root_compartment_id1", PrivateIP: "10.0.0.0"}},
+		},
+	}
+	discovery := Discovery{
+		settings: settings{
+			rootCompartmentID: "root_compartment_id1",
+			port:              testInstancePort,
+			logger:            log.NewNopLogger(),
+			ociClientWrapper:  clientWrapper,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(tgs))
+
+	failing := Discovery{
+		settings: settings{
+			rootCompartmentID:    "root_compartment_id1",
+			port:                 testInstancePort,
+			logger:               log.NewNopLogger(),
+			ociClientWrapper:     clientWrapper,
+			failOnNoCompartments: true,
+		},
+	}
+	failures := promtestutil.ToFloat64(ociSDRefreshFailuresCount)
+	_, err = failing.refresh()
+	testutil.NotOk(t, err, "expected the refresh to fail without compartments")
+	testutil.Equals(t, failures+1, promtestutil.ToFloat64(ociSDRefreshFailuresCount))
+
+	// The root compartment doesn't count.
+	failing.includeRootCompartment = true
+	_, err = failing.refresh()
+	testutil.NotOk(t, err, "expected the refresh to fail without compartments")
+}
+
+func TestRefreshConsoleURL(t *testing.T) {
+	clientWrapper := &testOciClientWrapper{instances: []Instance{
+		{ID: "ocid1.instance.oc1.phx.abc", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1", Region: "phx"},
+		{ID: "instance_id2", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.2"},
+	}}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	_, ok := tgs[0].Labels[ociConsoleURL]
+	testutil.Assert(t, !ok, "expected no console URL unless enabled")
+
+	discovery.emitConsoleURL = true
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelValue("https://cloud.oracle.com/compute/instances/ocid1.instance.oc1.phx.abc?region=us-phoenix-1"), tgs[0].Labels[ociConsoleURL])
+	// Without a region there is no URL to link to.
+	_, ok = tgs[1].Labels[ociConsoleURL]
+	testutil.Assert(t, !ok, "expected no console URL without a region")
+}
+
+func TestRefreshShard(t *testing.T) {
+	clientWrapper := &testOciClientWrapper{instances: []Instance{
+		{ID: "ocid1.instance.oc1.phx.abc", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1"},
+		{ID: "ocid1.instance.oc1.phx.def", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.2"},
+		{ID: "ocid1.instance.oc1.phx.ghi", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.3"},
+	}}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	_, ok := tgs[0].Labels[ociShard]
+	testutil.Assert(t, !ok, "expected no shard unless enabled")
+
+	discovery.shards = 3
+	// Shards are fixed values rather than computed here, so a change of hash
+	// that would reshuffle targets between replicas shows.
+	expected := []model.LabelValue{"1", "0", "2"}
+	for i := 0; i < 2; i++ {
+		tgs, err = discovery.refresh()
+		testutil.Ok(t, err)
+		for j, tg := range tgs {
+			testutil.Equals(t, expected[j], tg.Labels[ociShard])
+		}
+	}
+}
+
+type testServiceError struct {
+	statusCode int
+	code       string
+}
+
+func (e testServiceError) Error() string {
+	return fmt.Sprintf("service error %d: %s", e.statusCode, e.code)
+}
+func (e testServiceError) GetHTTPStatusCode() int  { return e.statusCode }
+func (e testServiceError) GetMessage() string      { return e.code }
+func (e testServiceError) GetCode() string         { return e.code }
+func (e testServiceError) GetOpcRequestID() string { return "" }
+
+// expiringOciClientWrapper rejects every call as unauthenticated.
+type expiringOciClientWrapper struct {
+	testOciClientWrapper
+}
+
+func (f expiringOciClientWrapper) ListInstances(ctx context.Context, compartmentID *string, filter instanceFilter) (*instanceResponse, error) {
+	return nil, testServiceError{statusCode: 401, code: "NotAuthenticated"}
+}
+
+// unauthorizedOciClientWrapper rejects looking up compartments as
+// unauthorized.
+type unauthorizedOciClientWrapper struct {
+	testOciClientWrapper
+}
+
+func (f unauthorizedOciClientWrapper) GetCompartment(ctx context.Context, compartmentID *string) (compartment, error) {
+	return compartment{}, testServiceError{statusCode: 401, code: "NotAuthenticated"}
+}
+
+func TestValidateCredentials(t *testing.T) {
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: unauthorizedOciClientWrapper{},
+		},
+	}
+	testutil.NotOk(t, discovery.validateCredentials(context.Background()), "expected invalid credentials to be reported")
+
+	discovery.ociClientWrapper = testOciClientWrapper{}
+	testutil.Ok(t, discovery.validateCredentials(context.Background()))
+
+	discovery = Discovery{
+		settings: settings{
+			logger: log.NewNopLogger(),
+			tenancies: []tenancy{
+				{id: "tenancy_id1", compartmentID: testCompartmentID, ociClientWrapper: testOciClientWrapper{}},
+				{id: "tenancy_id2", rootCompartmentID: "root_compartment_id2", ociClientWrapper: unauthorizedOciClientWrapper{}},
+			},
+		},
+	}
+	err := discovery.validateCredentials(context.Background())
+	testutil.NotOk(t, err, "expected invalid credentials of a tenancy to be reported")
+	testutil.Assert(t, strings.Contains(err.Error(), "tenancy_id2"), "expected the error to name the tenancy, got %s", err)
+
+	// Without a compartment to look up there is nothing to validate.
+	discovery = Discovery{
+		settings: settings{
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: unauthorizedOciClientWrapper{},
+			searchQuery:      "query instance resources",
+		},
+	}
+	testutil.Ok(t, discovery.validateCredentials(context.Background()))
+}
+
+func TestRefreshExpiredInstancePrincipals(t *testing.T) {
+	refreshes := 0
+	clientWrapper := &reauthenticatingClientWrapper{
+		current: expiringOciClientWrapper{},
+		newClientWrapper: func() (ociClientWrapper, error) {
+			refreshes++
+			return testOciClientWrapper{}, nil
+		},
+		logger: log.NewNopLogger(),
+	}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, refreshes)
+	checkTarget(t, tgs)
+
+	// Subsequent refreshes keep using the refreshed clients.
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, refreshes)
+	checkTarget(t, tgs)
+}
+
+func TestRefreshExpiredInstancePrincipalsFails(t *testing.T) {
+	clientWrapper := &reauthenticatingClientWrapper{
+		current: expiringOciClientWrapper{},
+		newClientWrapper: func() (ociClientWrapper, error) {
+			return expiringOciClientWrapper{}, nil
+		},
+		logger: log.NewNopLogger(),
+	}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	_, err := discovery.refresh()
+	if err == nil {
+		t.Fatal("expected refresh to fail when the token keeps being rejected")
+	}
+}
+
+// concurrentlyExpiringOciClientWrapper rejects calls as unauthenticated once
+// all expected calls are in flight.
+type concurrentlyExpiringOciClientWrapper struct {
+	testOciClientWrapper
+	calls *sync.WaitGroup
+}
+
+func (f concurrentlyExpiringOciClientWrapper) ListInstances(ctx context.Context, compartmentID *string, filter instanceFilter) (*instanceResponse, error) {
+	f.calls.Done()
+	f.calls.Wait()
+	return nil, testServiceError{statusCode: 401, code: "NotAuthenticated"}
+}
+
+func TestRefreshExpiredInstancePrincipalsConcurrently(t *testing.T) {
+	const calls = 8
+	var (
+		expired   sync.WaitGroup
+		refreshes int32
+	)
+	expired.Add(calls)
+	clientWrapper := &reauthenticatingClientWrapper{
+		current: concurrentlyExpiringOciClientWrapper{calls: &expired},
+		newClientWrapper: func() (ociClientWrapper, error) {
+			atomic.AddInt32(&refreshes, 1)
+			return testOciClientWrapper{}, nil
+		},
+		logger: log.NewNopLogger(),
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := clientWrapper.ListInstances(context.Background(), &testCompartmentID, instanceFilter{})
+			testutil.Ok(t, err)
+		}()
+	}
+	wg.Wait()
+	testutil.Equals(t, int32(1), atomic.LoadInt32(&refreshes))
+}
+
+// idleClosingOciClientWrapper records whether its idle connections were
+// closed.
+type idleClosingOciClientWrapper struct {
+	ociClientWrapper
+	closed *int32
+}
+
+func (w idleClosingOciClientWrapper) closeIdleConnections() {
+	atomic.AddInt32(w.closed, 1)
+}
+
+func TestRefreshExpiredInstancePrincipalsClosesConnections(t *testing.T) {
+	var closed int32
+	clientWrapper := &reauthenticatingClientWrapper{
+		current: idleClosingOciClientWrapper{ociClientWrapper: expiringOciClientWrapper{}, closed: &closed},
+		newClientWrapper: func() (ociClientWrapper, error) {
+			return testOciClientWrapper{}, nil
+		},
+		logger: log.NewNopLogger(),
+	}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	_, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, int32(1), atomic.LoadInt32(&closed))
+}
+
 func checkTarget(t *testing.T, targetGroups []*targetgroup.Group) {
 	testutil.Equals(t, 1, len(targetGroups))
 	target := targetGroups[0]
@@ -0,0 +1,197 @@
+// Package ocitest provides a mock of the OCI APIs to test discovery with,
+// without an OCI account.
+package ocitest
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/neumayer/ocidiscover/oci"
+)
+
+// The methods of oci.Client, to inject errors into.
+const (
+	ListCompartments = "ListCompartments"
+	GetCompartment   = "GetCompartment"
+	ListInstances    = "ListInstances"
+)
+
+// Client is a mock oci.Client serving the compartments and instances added
+// to it. Compartments that weren't added are served with their id only. It
+// is safe for concurrent use.
+type Client struct {
+	mtx          sync.Mutex
+	compartments []oci.Compartment
+	instances    map[string][]oci.Instance
+	pageSize     int
+	errs         map[string]error
+	calls        map[string]int
+}
+
+// NewClient returns an empty mock.
+func NewClient() *Client {
+	return &Client{
+		instances: map[string][]oci.Instance{},
+		errs:      map[string]error{},
+		calls:     map[string]int{},
+	}
+}
+
+// SingleCompartment returns a mock serving n running instances, with ids
+// instance_id1 to instance_idn and private IPs 10.0.0.1 to 10.0.0.n, in the
+// given compartment.
+func SingleCompartment(compartmentID string, n int) *Client {
+	c := NewClient().AddCompartment(oci.Compartment{ID: compartmentID, Name: compartmentID})
+	for i := 1; i <= n; i++ {
+		c.AddInstances(compartmentID, NewInstance(fmt.Sprintf("instance_id%d", i), compartmentID, fmt.Sprintf("10.0.0.%d", i)))
+	}
+	return c
+}
+
+// CompartmentTree returns a mock serving the given number of compartments
+// directly below the root compartment, with ids compartment_id1 and so on,
+// each holding perCompartment instances.
+func CompartmentTree(rootCompartmentID string, compartments, perCompartment int) *Client {
+	c := NewClient()
+	for i := 1; i <= compartments; i++ {
+		compartmentID := fmt.Sprintf("compartment_id%d", i)
+		c.AddCompartment(oci.Compartment{ID: compartmentID, Name: compartmentID, ParentID: rootCompartmentID})
+		for j := 1; j <= perCompartment; j++ {
+			c.AddInstances(compartmentID, NewInstance(fmt.Sprintf("instance_id%d_%d", i, j), compartmentID, fmt.Sprintf("10.0.%d.%d", i, j)))
+		}
+	}
+	return c
+}
+
+// NewInstance returns a running instance with the given id and private IP,
+// named after its id.
+func NewInstance(id, compartmentID, privateIP string) oci.Instance {
+	return oci.Instance{ID: id, DisplayName: id, CompartmentID: compartmentID, PrivateIP: privateIP, LifecycleState: "RUNNING"}
+}
+
+// AddCompartment adds a compartment below its parent. Its depth is derived
+// from its parents.
+func (c *Client) AddCompartment(compartment oci.Compartment) *Client {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.compartments = append(c.compartments, compartment)
+	return c
+}
+
+// AddInstances adds instances to a compartment.
+func (c *Client) AddInstances(compartmentID string, instances ...oci.Instance) *Client {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.instances[compartmentID] = append(c.instances[compartmentID], instances...)
+	return c
+}
+
+// SetPageSize makes instances be listed in pages of n. Values below 1 list
+// all instances of a compartment at once, which is the default.
+func (c *Client) SetPageSize(n int) *Client {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.pageSize = n
+	return c
+}
+
+// SetError makes all calls of the given method fail with err, or succeed
+// again if err is nil.
+func (c *Client) SetError(method string, err error) *Client {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if err == nil {
+		delete(c.errs, method)
+	} else {
+		c.errs[method] = err
+	}
+	return c
+}
+
+// Calls returns the number of calls of the given method so far.
+func (c *Client) Calls(method string) int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.calls[method]
+}
+
+// call counts a call of method and returns its injected error. The caller
+// must hold the lock.
+func (c *Client) call(method string) error {
+	c.calls[method]++
+	return c.errs[method]
+}
+
+// ListCompartments implements oci.Client.
+func (c *Client) ListCompartments(ctx context.Context, rootCompartmentID string) ([]oci.Compartment, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if err := c.call(ListCompartments); err != nil {
+		return nil, err
+	}
+	var below []oci.Compartment
+	parents := []string{rootCompartmentID}
+	for depth := 1; len(parents) > 0; depth++ {
+		var children []string
+		for _, parent := range parents {
+			for _, compartment := range c.compartments {
+				if compartment.ParentID == parent {
+					compartment.Depth = depth
+					below = append(below, compartment)
+					children = append(children, compartment.ID)
+				}
+			}
+		}
+		parents = children
+	}
+	return below, nil
+}
+
+// GetCompartment implements oci.Client.
+func (c *Client) GetCompartment(ctx context.Context, compartmentID string) (oci.Compartment, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if err := c.call(GetCompartment); err != nil {
+		return oci.Compartment{}, err
+	}
+	for _, compartment := range c.compartments {
+		if compartment.ID == compartmentID {
+			return compartment, nil
+		}
+	}
+	return oci.Compartment{ID: compartmentID}, nil
+}
+
+// ListInstances implements oci.Client. Page tokens are offsets into the
+// instances of the compartment matching the filter.
+func (c *Client) ListInstances(ctx context.Context, compartmentID string, filter oci.InstanceFilter) ([]oci.Instance, string, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if err := c.call(ListInstances); err != nil {
+		return nil, "", err
+	}
+	var matching []oci.Instance
+	for _, instance := range c.instances[compartmentID] {
+		if filter.DisplayName != "" && instance.DisplayName != filter.DisplayName {
+			continue
+		}
+		if filter.AvailabilityDomain != "" && instance.AvailabilityDomain != filter.AvailabilityDomain {
+			continue
+		}
+		matching = append(matching, instance)
+	}
+	start := 0
+	if filter.Page != "" {
+		var err error
+		if start, err = strconv.Atoi(filter.Page); err != nil || start < 0 || start > len(matching) {
+			return nil, "", fmt.Errorf("invalid page %q", filter.Page)
+		}
+	}
+	if c.pageSize < 1 || start+c.pageSize >= len(matching) {
+		return matching[start:], "", nil
+	}
+	end := start + c.pageSize
+	return matching[start:end], strconv.Itoa(end), nil
+}
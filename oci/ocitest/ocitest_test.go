@@ -0,0 +1,167 @@
+package ocitest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/neumayer/ocidiscover/oci"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestClientPagination(t *testing.T) {
+	client := SingleCompartment("compartment_id1", 5).SetPageSize(2)
+	instances, next, err := client.ListInstances(context.Background(), "compartment_id1", oci.InstanceFilter{})
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(instances))
+	testutil.Equals(t, "2", next)
+
+	conf := oci.DefaultSDConfig
+	conf.CompartmentID = "compartment_id1"
+	conf.Port = 9100
+	d, err := oci.NewDiscovery(conf, nil, oci.WithClient(client))
+	testutil.Ok(t, err)
+	tgs, err := d.Refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 5, len(tgs))
+	testutil.Equals(t, model.LabelValue("10.0.0.5:9100"), tgs[4].Targets[0][model.AddressLabel])
+	// The call above and three pages for the refresh.
+	testutil.Equals(t, 4, client.Calls(ListInstances))
+}
+
+func TestClientErrors(t *testing.T) {
+	client := CompartmentTree("root_compartment_id", 2, 2)
+	conf := oci.DefaultSDConfig
+	conf.RootCompartmentID = "root_compartment_id"
+	conf.Port = 9100
+	d, err := oci.NewDiscovery(conf, nil, oci.WithClient(client))
+	testutil.Ok(t, err)
+	tgs, err := d.Refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 4, len(tgs))
+	testutil.Equals(t, model.LabelValue("compartment_id2"), tgs[2].Labels["__meta_oci_compartment_name"])
+
+	for _, method := range []string{ListCompartments, GetCompartment, ListInstances} {
+		client.SetError(method, errors.New("service unavailable"))
+		_, err = d.Refresh()
+		testutil.NotOk(t, err, "expected the refresh to fail on "+method)
+		client.SetError(method, nil)
+	}
+	_, err = d.Refresh()
+	testutil.Ok(t, err)
+}
+
+func TestClientRecurseCompartments(t *testing.T) {
+	client := NewClient().
+		AddCompartment(oci.Compartment{ID: "child", ParentID: "root"}).
+		AddCompartment(oci.Compartment{ID: "grandchild", ParentID: "child"}).
+		AddInstances("child", NewInstance("instance_id1", "child", "10.0.0.1")).
+		AddInstances("grandchild", NewInstance("instance_id2", "grandchild", "10.0.0.2"))
+	conf := oci.DefaultSDConfig
+	conf.RootCompartmentID = "root"
+	conf.Port = 9100
+	d, err := oci.NewDiscovery(conf, nil, oci.WithClient(client))
+	testutil.Ok(t, err)
+	tgs, err := d.Refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(tgs))
+
+	conf.RecurseCompartments = true
+	d, err = oci.NewDiscovery(conf, nil, oci.WithClient(client))
+	testutil.Ok(t, err)
+	tgs, err = d.Refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+}
+
+func TestClientCompartmentDepth(t *testing.T) {
+	client := NewClient().
+		AddCompartment(oci.Compartment{ID: "child", ParentID: "root"}).
+		AddCompartment(oci.Compartment{ID: "grandchild", ParentID: "child"}).
+		AddCompartment(oci.Compartment{ID: "other", ParentID: "other_root"})
+	compartments, err := client.ListCompartments(context.Background(), "root")
+	testutil.Ok(t, err)
+	testutil.Equals(t, []oci.Compartment{
+		{ID: "child", ParentID: "root", Depth: 1},
+		{ID: "grandchild", ParentID: "child", Depth: 2},
+	}, compartments)
+}
+
+// hostnameAddressBuilder scrapes instances by their display name.
+type hostnameAddressBuilder struct{}
+
+func (hostnameAddressBuilder) BuildAddress(instance oci.Instance, conf oci.AddressConfig) (string, model.LabelSet, error) {
+	return fmt.Sprintf("%s.example.com:%d", instance.DisplayName, conf.Port), nil, nil
+}
+
+func TestNewDiscoveryOptions(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	var events []oci.RefreshEvent
+	conf := oci.DefaultSDConfig
+	conf.CompartmentID = "compartment_id1"
+	conf.Port = 9100
+	d, err := oci.NewDiscovery(conf, nil,
+		oci.WithClient(SingleCompartment("compartment_id1", 3)),
+		oci.WithRegisterer(registry),
+		oci.WithAddressBuilder(hostnameAddressBuilder{}),
+		oci.WithPostProcessor(func(tgs []*targetgroup.Group) []*targetgroup.Group {
+			return tgs[1:]
+		}),
+		oci.WithRefreshEventHandler(func(e oci.RefreshEvent) {
+			events = append(events, e)
+		}),
+	)
+	testutil.Ok(t, err)
+	tgs, err := d.Refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+	testutil.Equals(t, 1, len(events))
+	testutil.Equals(t, 2, events[0].Targets)
+	testutil.Equals(t, model.LabelValue("instance_id2.example.com:9100"), tgs[0].Targets[0][model.AddressLabel])
+
+	families, err := registry.Gather()
+	testutil.Ok(t, err)
+	var registered bool
+	for _, family := range families {
+		if family.GetName() == "prometheus_sd_oci_refresh_duration" {
+			registered = true
+		}
+	}
+	testutil.Assert(t, registered, "expected the OCI SD metrics to be registered")
+
+	// Metrics may be registered with the same registry again.
+	_, err = oci.NewDiscovery(conf, nil,
+		oci.WithClient(SingleCompartment("compartment_id1", 3)),
+		oci.WithRegisterer(registry),
+	)
+	testutil.Ok(t, err)
+}
+
+func TestNewDiscoveryValidateCredentials(t *testing.T) {
+	conf := oci.DefaultSDConfig
+	conf.CompartmentID = "compartment_id1"
+	conf.Port = 9100
+	conf.ValidateCredentialsOnStartup = true
+	client := SingleCompartment("compartment_id1", 1)
+	_, err := oci.NewDiscovery(conf, nil, oci.WithClient(client))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, client.Calls(GetCompartment))
+
+	client.SetError(GetCompartment, errors.New("not authorized"))
+	_, err = oci.NewDiscovery(conf, nil, oci.WithClient(client))
+	testutil.NotOk(t, err, "expected the credential check to fail")
+	_, err = oci.NewDiscoveryWithClient(conf, nil, client)
+	testutil.NotOk(t, err, "expected the deprecated constructor to check credentials too")
+}
+
+func TestNewDiscoveryInvalidConfig(t *testing.T) {
+	conf := oci.DefaultSDConfig
+	conf.CompartmentID = "compartment_id1"
+	conf.InstanceConcurrency = -1
+	_, err := oci.NewDiscovery(conf, nil, oci.WithClient(SingleCompartment("compartment_id1", 1)))
+	testutil.NotOk(t, err, "expected an invalid configuration to be rejected")
+}
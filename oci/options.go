@@ -0,0 +1,136 @@
+package oci
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+)
+
+// Option customizes a Discovery created by NewDiscovery, for settings that
+// don't belong in the configuration, such as code to run.
+type Option func(*options)
+
+type options struct {
+	client         Client
+	registerer     prometheus.Registerer
+	addressBuilder AddressBuilder
+	postProcessor  func([]*targetgroup.Group) []*targetgroup.Group
+	credentials    CredentialProvider
+	refreshEvent   func(RefreshEvent)
+}
+
+// WithClient discovers instances through client instead of the OCI APIs.
+// Settings needing other APIs, such as tenancies, search queries or
+// namespaces, fail.
+func WithClient(client Client) Option {
+	return func(o *options) {
+		o.client = client
+	}
+}
+
+// WithRegisterer registers the OCI SD metrics with r too, e.g. with the
+// registry of an embedding application that doesn't serve the default
+// registry. Metrics are shared by all discoveries, so they may be registered
+// with r already.
+func WithRegisterer(r prometheus.Registerer) Option {
+	return func(o *options) {
+		o.registerer = r
+	}
+}
+
+// WithAddressBuilder replaces the way scrape addresses are built for
+// discovered instances, e.g. for hostname based or NAT mapped addressing.
+func WithAddressBuilder(b AddressBuilder) Option {
+	return func(o *options) {
+		o.addressBuilder = b
+	}
+}
+
+// WithPostProcessor passes the targets of every successful refresh through
+// f, e.g. to add or drop targets, before they are served. It is called
+// synchronously from the refresh.
+func WithPostProcessor(f func([]*targetgroup.Group) []*targetgroup.Group) Option {
+	return func(o *options) {
+		o.postProcessor = f
+	}
+}
+
+// WithCredentialProvider accesses OCI with the credentials supplied by p, e.g.
+// from a secret manager, instead of the built-in authentication methods.
+func WithCredentialProvider(p CredentialProvider) Option {
+	return func(o *options) {
+		o.credentials = p
+	}
+}
+
+// WithRefreshEventHandler registers a function called with an event after
+// every refresh. It is called synchronously from the refresh, so it should
+// hand slow work off.
+func WithRefreshEventHandler(f func(RefreshEvent)) Option {
+	return func(o *options) {
+		o.refreshEvent = f
+	}
+}
+
+// NewDiscovery returns a new Discovery which periodically refreshes its
+// targets, customized by opts. Unlike a configuration read from YAML, conf is
+// not filled in with defaults, so it should start from DefaultSDConfig; it is
+// validated like one read from YAML.
+func NewDiscovery(conf SDConfig, logger log.Logger, opts ...Option) (*Discovery, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.registerer != nil {
+		for _, c := range ociSDMetrics {
+			if err := o.registerer.Register(c); err != nil {
+				if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+					return nil, err
+				}
+			}
+		}
+	}
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	d := &Discovery{
+		settings: settings{
+			logger:              logger,
+			includeSecondaryIPs: conf.IncludeSecondaryIPs,
+			addressBuilder:      o.addressBuilder,
+			postProcessor:       o.postProcessor,
+		},
+		conf:         conf,
+		refreshEvent: o.refreshEvent,
+	}
+	if err := d.applyConfig(conf); err != nil {
+		return nil, err
+	}
+	if o.client != nil {
+		if err := d.setClient(conf, o.client); err != nil {
+			return nil, err
+		}
+	} else {
+		credentials := o.credentials
+		if credentials == nil {
+			credentials = defaultCredentialProvider{principals: newPrincipalBootstrap(conf)}
+		}
+		if err := d.setCredentials(conf, credentials); err != nil {
+			return nil, err
+		}
+	}
+	if conf.ValidateCredentialsOnStartup {
+		ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+		defer cancel()
+		if err := d.validateCredentials(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,84 @@
+package oci
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/common"
+	"github.com/oracle/oci-go-sdk/common/auth"
+)
+
+// principalBootstrap fetches instance principal credentials from the
+// instance metadata service, which can be slow to answer on a freshly
+// started instance.
+type principalBootstrap struct {
+	// timeout bounds each attempt, 0 means no limit. The SDK can't cancel
+	// an attempt, so one timing out or cancelled is left to finish in the
+	// background.
+	timeout time.Duration
+	// retries is the number of times a failed attempt is repeated, delay
+	// apart.
+	retries  int
+	delay    time.Duration
+	provider func() (common.ConfigurationProvider, error)
+}
+
+func newPrincipalBootstrap(conf SDConfig) principalBootstrap {
+	return principalBootstrap{
+		timeout:  time.Duration(conf.PrincipalBootstrapTimeout),
+		retries:  conf.PrincipalBootstrapRetries,
+		delay:    principalRefreshRetryDelay,
+		provider: auth.InstancePrincipalConfigurationProvider,
+	}
+}
+
+// configurationProvider returns the instance principal credentials once an
+// attempt succeeds, or the error of the last attempt. It gives up early once
+// ctx is done.
+func (b principalBootstrap) configurationProvider(ctx context.Context) (common.ConfigurationProvider, error) {
+	var err error
+	for i := 0; i <= b.retries; i++ {
+		if i > 0 {
+			timer := time.NewTimer(b.delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, fmt.Errorf("error connecting to api using instance principals: %s", ctx.Err())
+			}
+		}
+		var config common.ConfigurationProvider
+		config, err = b.attempt(ctx)
+		if err == nil {
+			return config, nil
+		}
+	}
+	return nil, fmt.Errorf("error connecting to api using instance principals: %s", err)
+}
+
+func (b principalBootstrap) attempt(ctx context.Context) (common.ConfigurationProvider, error) {
+	type result struct {
+		config common.ConfigurationProvider
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		config, err := b.provider()
+		done <- result{config, err}
+	}()
+	var timeout <-chan time.Time
+	if b.timeout > 0 {
+		timer := time.NewTimer(b.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case r := <-done:
+		return r.config, r.err
+	case <-timeout:
+		return nil, fmt.Errorf("no credentials from the instance metadata service within %s", b.timeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,65 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/common"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestPrincipalBootstrapRetriesSlowAttempt(t *testing.T) {
+	config := common.NewRawConfigurationProvider("tenancy_id1", "user_id1", "us-phoenix-1", "fingerprint", "", nil)
+	var attempts int32
+	release := make(chan struct{})
+	defer close(release)
+	b := principalBootstrap{
+		timeout: 10 * time.Millisecond,
+		retries: 1,
+		provider: func() (common.ConfigurationProvider, error) {
+			if atomic.AddInt32(&attempts, 1) == 1 {
+				// The metadata service doesn't answer the first attempt in time.
+				<-release
+			}
+			return config, nil
+		},
+	}
+	got, err := b.configurationProvider(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, config, got)
+	testutil.Equals(t, int32(2), atomic.LoadInt32(&attempts))
+}
+
+func TestPrincipalBootstrapFails(t *testing.T) {
+	attempts := 0
+	b := principalBootstrap{
+		retries: 2,
+		provider: func() (common.ConfigurationProvider, error) {
+			attempts++
+			return nil, errors.New("metadata service unavailable")
+		},
+	}
+	_, err := b.configurationProvider(context.Background())
+	testutil.NotOk(t, err, "bootstrap should fail once retries are exhausted")
+	testutil.Equals(t, 3, attempts)
+}
+
+func TestPrincipalBootstrapCancelled(t *testing.T) {
+	attempts := 0
+	b := principalBootstrap{
+		retries: 2,
+		delay:   time.Hour,
+		provider: func() (common.ConfigurationProvider, error) {
+			attempts++
+			return nil, errors.New("metadata service unavailable")
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := b.configurationProvider(ctx)
+	testutil.NotOk(t, err, "bootstrap should give up once the context is done")
+	testutil.Equals(t, 1, attempts)
+}
@@ -0,0 +1,64 @@
+package oci
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// prometheusTagNamespace is the defined tag namespace in which instances
+// describe how to scrape them when UsePrometheusTagNamespace is set.
+const prometheusTagNamespace = "prometheus"
+
+var (
+	prometheusTagPort    = definedTagKey{namespace: prometheusTagNamespace, key: "port"}
+	prometheusTagScheme  = definedTagKey{namespace: prometheusTagNamespace, key: "scheme"}
+	prometheusTagPath    = definedTagKey{namespace: prometheusTagNamespace, key: "path"}
+	prometheusTagEnabled = definedTagKey{namespace: prometheusTagNamespace, key: "enabled"}
+)
+
+// prometheusTagsEnabled reports whether the instance is to be scraped
+// according to its prometheus.enabled defined tag. Instances without the tag
+// or with an invalid value are.
+func (d *Discovery) prometheusTagsEnabled(instance Instance) bool {
+	value, ok := prometheusTagEnabled.lookup(instance.DefinedTags)
+	if !ok {
+		return true
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		level.Warn(d.logger).Log("msg", "Ignoring invalid defined tag", "instance", instance.ID, "tag", prometheusTagNamespace+".enabled", "value", value)
+		return true
+	}
+	return enabled
+}
+
+// prometheusTagHint returns the scrape parameters set through the prometheus
+// defined tag namespace of the instance. Invalid values are logged and
+// ignored, keeping the configured defaults.
+func (d *Discovery) prometheusTagHint(instance Instance) scrapeHint {
+	var hint scrapeHint
+	if value, ok := prometheusTagPort.lookup(instance.DefinedTags); ok {
+		if p, err := strconv.Atoi(value); err == nil && p >= 1 && p <= 65535 {
+			hint.port = p
+		} else {
+			level.Warn(d.logger).Log("msg", "Ignoring invalid defined tag", "instance", instance.ID, "tag", prometheusTagNamespace+".port", "value", value)
+		}
+	}
+	if value, ok := prometheusTagScheme.lookup(instance.DefinedTags); ok {
+		if value == "http" || value == "https" {
+			hint.scheme = value
+		} else {
+			level.Warn(d.logger).Log("msg", "Ignoring invalid defined tag", "instance", instance.ID, "tag", prometheusTagNamespace+".scheme", "value", value)
+		}
+	}
+	if value, ok := prometheusTagPath.lookup(instance.DefinedTags); ok {
+		if strings.HasPrefix(value, "/") {
+			hint.path = value
+		} else {
+			level.Warn(d.logger).Log("msg", "Ignoring invalid defined tag", "instance", instance.ID, "tag", prometheusTagNamespace+".path", "value", value)
+		}
+	}
+	return hint
+}
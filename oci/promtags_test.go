@@ -0,0 +1,50 @@
+package oci
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestRefreshPrometheusTagNamespace(t *testing.T) {
+	clientWrapper := &testOciClientWrapper{instances: []Instance{
+		{ID: "instance_id1", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1", DefinedTags: map[string]map[string]interface{}{
+			"prometheus": {"port": "9443", "scheme": "https", "path": "/custom/metrics", "enabled": "true"},
+		}},
+		{ID: "instance_id2", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.2", DefinedTags: map[string]map[string]interface{}{
+			"prometheus": {"enabled": "false"},
+		}},
+		{ID: "instance_id3", CompartmentID: testCompartmentID, PrivateIP: "10.0.0.3", DefinedTags: map[string]map[string]interface{}{
+			"prometheus": {"port": "99999", "scheme": "ftp", "path": "metrics", "enabled": "maybe"},
+		}},
+	}}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, len(tgs))
+	testutil.Equals(t, model.LabelValue("10.0.0.1:9100"), tgs[0].Targets[0][model.AddressLabel])
+
+	discovery.usePrometheusTagNamespace = true
+	tgs, err = discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+	testutil.Equals(t, model.LabelValue("10.0.0.1:9443"), tgs[0].Targets[0][model.AddressLabel])
+	testutil.Equals(t, model.LabelValue("https"), tgs[0].Labels[model.SchemeLabel])
+	testutil.Equals(t, model.LabelValue("/custom/metrics"), tgs[0].Labels[model.MetricsPathLabel])
+	// Invalid values fall back to the defaults.
+	testutil.Equals(t, model.LabelValue("instance_id3"), tgs[1].Labels[ociInstanceID])
+	testutil.Equals(t, model.LabelValue("10.0.0.3:9100"), tgs[1].Targets[0][model.AddressLabel])
+	_, ok := tgs[1].Labels[model.SchemeLabel]
+	testutil.Assert(t, !ok, "expected no scheme from an invalid tag")
+	_, ok = tgs[1].Labels[model.MetricsPathLabel]
+	testutil.Assert(t, !ok, "expected no metrics path from an invalid tag")
+}
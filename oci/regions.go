@@ -0,0 +1,89 @@
+package oci
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+)
+
+// regionalClients sets up client wrappers for the subscribed regions of a
+// tenancy on first use.
+type regionalClients struct {
+	// allowlist limits the regions discovered if not empty.
+	allowlist        map[string]bool
+	newClientWrapper func(region string) (ociClientWrapper, error)
+
+	mtx     sync.Mutex
+	clients map[string]ociClientWrapper
+}
+
+func newRegionalClients(allowlist []string, newClientWrapper func(region string) (ociClientWrapper, error)) *regionalClients {
+	return &regionalClients{
+		allowlist:        stringSet(allowlist),
+		newClientWrapper: newClientWrapper,
+		clients:          map[string]ociClientWrapper{},
+	}
+}
+
+// allowed reports whether instances in the region are discovered.
+func (r *regionalClients) allowed(region string) bool {
+	return len(r.allowlist) == 0 || r.allowlist[region]
+}
+
+// client returns the client wrapper for the region, setting it up on first
+// use.
+func (r *regionalClients) client(region string) (ociClientWrapper, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if clientWrapper, ok := r.clients[region]; ok {
+		return clientWrapper, nil
+	}
+	clientWrapper, err := r.newClientWrapper(region)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up clients for region %s: %s", region, err)
+	}
+	r.clients[region] = clientWrapper
+	return clientWrapper, nil
+}
+
+// closeIdleConnections releases the idle connections of the clients set up
+// so far.
+func (r *regionalClients) closeIdleConnections() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, clientWrapper := range r.clients {
+		if c, ok := clientWrapper.(idleConnectionsCloser); ok {
+			c.closeIdleConnections()
+		}
+	}
+}
+
+// refreshRegions discovers the targets of a tenancy in each of its allowed
+// subscribed regions.
+func (d *Discovery) refreshRegions(ctx context.Context, t tenancy, stats *refreshStats) ([]*targetgroup.Group, error) {
+	regions, err := t.ociClientWrapper.ListRegionSubscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var tgs []*targetgroup.Group
+	for _, region := range regions {
+		if !t.regions.allowed(region) {
+			continue
+		}
+		clientWrapper, err := t.regions.client(region)
+		if err != nil {
+			return nil, err
+		}
+		regional := t
+		regional.ociClientWrapper = clientWrapper
+		regional.regions = nil
+		regionTgs, err := d.refreshTenancy(ctx, regional, stats)
+		if err != nil {
+			return nil, err
+		}
+		tgs = append(tgs, regionTgs...)
+	}
+	return tgs, nil
+}
@@ -0,0 +1,92 @@
+package oci
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oracle/oci-go-sdk/common"
+	"github.com/oracle/oci-go-sdk/identity"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+// subscribedOciClientWrapper is subscribed to a fixed set of regions.
+type subscribedOciClientWrapper struct {
+	testOciClientWrapper
+	regions []string
+}
+
+func (w subscribedOciClientWrapper) ListRegionSubscriptions(ctx context.Context) ([]string, error) {
+	return w.regions, nil
+}
+
+func TestRefreshSubscribedRegions(t *testing.T) {
+	var setUp []string
+	regions := newRegionalClients([]string{"us-ashburn-1"}, func(region string) (ociClientWrapper, error) {
+		setUp = append(setUp, region)
+		return &testOciClientWrapper{instances: []Instance{
+			{ID: "instance_id_" + region, CompartmentID: testCompartmentID, PrivateIP: "10.0.0.1", Region: region},
+		}}, nil
+	})
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: subscribedOciClientWrapper{regions: []string{"us-phoenix-1", "us-ashburn-1"}},
+			regions:          regions,
+		},
+	}
+	for i := 0; i < 2; i++ {
+		tgs, err := discovery.refresh()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(tgs))
+		testutil.Equals(t, model.LabelValue("instance_id_us-ashburn-1"), tgs[0].Labels[ociInstanceID])
+	}
+	// Clients are only set up for allowed regions, once.
+	testutil.Equals(t, []string{"us-ashburn-1"}, setUp)
+
+	// Without an allowlist all subscribed regions are discovered.
+	discovery.regions = newRegionalClients(nil, regions.newClientWrapper)
+	tgs, err := discovery.refresh()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+	testutil.Equals(t, model.LabelValue("instance_id_us-phoenix-1"), tgs[0].Labels[ociInstanceID])
+}
+
+func TestListRegionSubscriptions(t *testing.T) {
+	identityClient := &testIdentityClient{regionSubscriptions: []identity.RegionSubscription{
+		{RegionName: common.String("us-phoenix-1"), Status: identity.RegionSubscriptionStatusReady},
+		{RegionName: common.String("eu-frankfurt-1"), Status: identity.RegionSubscriptionStatusInProgress},
+		{RegionName: common.String("us-ashburn-1"), Status: identity.RegionSubscriptionStatusReady},
+	}}
+	clientWrapper := remoteOciClientWrapper{ociIdentityClient: identityClient, tenancyID: "tenancy_id1"}
+	regions, err := clientWrapper.ListRegionSubscriptions(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"us-phoenix-1", "us-ashburn-1"}, regions)
+}
+
+func TestCloseRegionalClients(t *testing.T) {
+	var closed int32
+	newClientWrapper := func(region string) (ociClientWrapper, error) {
+		return idleClosingOciClientWrapper{ociClientWrapper: &testOciClientWrapper{}, closed: &closed}, nil
+	}
+	discovery := &Discovery{
+		settings: settings{
+			logger:  log.NewNopLogger(),
+			regions: newRegionalClients(nil, newClientWrapper),
+			tenancies: []tenancy{
+				{id: "tenancy_id1", regions: newRegionalClients(nil, newClientWrapper)},
+			},
+		},
+	}
+	for _, regions := range []*regionalClients{discovery.regions, discovery.tenancies[0].regions} {
+		for _, region := range []string{"us-ashburn-1", "us-phoenix-1"} {
+			_, err := regions.client(region)
+			testutil.Ok(t, err)
+		}
+	}
+	testutil.Ok(t, discovery.Close())
+	testutil.Equals(t, int32(4), closed)
+}
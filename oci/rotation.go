@@ -0,0 +1,105 @@
+package oci
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+)
+
+// adRotation tracks whose turn it is when rotating through availability
+// domains, along with the targets last found in each of them.
+type adRotation struct {
+	mtx  sync.Mutex
+	turn int
+	// domains caches the availability domains of each tenancy by tenancy
+	// id, targets the targets by tenancy id and availability domain.
+	domains map[string][]string
+	targets map[string]map[string][]*targetgroup.Group
+}
+
+// next returns the availability domain whose turn it is among domains.
+func (r *adRotation) next(domains []string) string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return domains[r.turn%len(domains)]
+}
+
+// advance moves on to the next availability domain.
+func (r *adRotation) advance() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.turn++
+}
+
+// update records the targets just found in an availability domain of a
+// tenancy and returns those last found in all of its availability domains.
+func (r *adRotation) update(tenancyID string, domains []string, domain string, tgs []*targetgroup.Group) []*targetgroup.Group {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.targets == nil {
+		r.targets = map[string]map[string][]*targetgroup.Group{}
+	}
+	if r.targets[tenancyID] == nil {
+		r.targets[tenancyID] = map[string][]*targetgroup.Group{}
+	}
+	r.targets[tenancyID][domain] = tgs
+	var all []*targetgroup.Group
+	for _, d := range domains {
+		all = append(all, r.targets[tenancyID][d]...)
+	}
+	return all
+}
+
+// availabilityDomains returns the availability domains of the tenancy,
+// looking them up on first use.
+func (d *Discovery) availabilityDomains(ctx context.Context, t tenancy) ([]string, error) {
+	rotation := &d.state().rotation
+	rotation.mtx.Lock()
+	domains, ok := rotation.domains[t.id]
+	rotation.mtx.Unlock()
+	if ok {
+		return domains, nil
+	}
+
+	// Availability domains are listed for the tenancy, which is the root
+	// compartment if known.
+	compartmentID := t.id
+	if compartmentID == "" {
+		compartmentID = t.rootCompartmentID
+	}
+	if compartmentID == "" {
+		compartmentID = t.compartmentID
+	}
+	domains, err := t.ociClientWrapper.ListAvailabilityDomains(ctx, &compartmentID)
+	if err != nil {
+		return nil, err
+	}
+
+	rotation.mtx.Lock()
+	defer rotation.mtx.Unlock()
+	if rotation.domains == nil {
+		rotation.domains = map[string][]string{}
+	}
+	rotation.domains[t.id] = domains
+	return domains, nil
+}
+
+// refreshTenancyRotating discovers the targets of the availability domain of
+// the tenancy whose turn it is, and serves those of the others from their
+// last refresh.
+func (d *Discovery) refreshTenancyRotating(ctx context.Context, t tenancy, stats *refreshStats) ([]*targetgroup.Group, error) {
+	domains, err := d.availabilityDomains(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	if len(domains) == 0 {
+		return d.refreshTenancy(ctx, t, stats)
+	}
+	t.availabilityDomain = d.state().rotation.next(domains)
+	tgs, err := d.refreshTenancy(ctx, t, stats)
+	if err != nil {
+		return nil, err
+	}
+	return d.state().rotation.update(t.id, domains, t.availabilityDomain, tgs), nil
+}
@@ -0,0 +1,72 @@
+package oci
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Scope describes what to discover: the compartments to look in and the
+// filters instances in them have to match. It is kept apart from the rest of
+// the configuration so it can be versioned and templated per environment.
+// Fields left out of a scope keep their configured values.
+type Scope struct {
+	CompartmentID               string            `yaml:"compartment_id,omitempty"`
+	RootCompartmentID           string            `yaml:"root_compartment_id,omitempty"`
+	RootChildNames              []string          `yaml:"root_child_names,omitempty"`
+	IncludeRootCompartment      *bool             `yaml:"include_root_compartment,omitempty"`
+	IncludeInactiveCompartments *bool             `yaml:"include_inactive_compartments,omitempty"`
+	SearchQuery                 string            `yaml:"search_query,omitempty"`
+	DisplayName                 string            `yaml:"display_name,omitempty"`
+	AvailabilityDomain          string            `yaml:"availability_domain,omitempty"`
+	DefinedTagFilters           []string          `yaml:"defined_tag_filters,omitempty"`
+	CompartmentTagFilters       map[string]string `yaml:"compartment_tag_filters,omitempty"`
+}
+
+// LoadScope reads a scope from a YAML file. Unknown fields are rejected.
+func LoadScope(filename string) (*Scope, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	scope := &Scope{}
+	if err := yaml.UnmarshalStrict(b, scope); err != nil {
+		return nil, fmt.Errorf("error parsing scope file %s: %s", filename, err)
+	}
+	return scope, nil
+}
+
+// Apply sets the fields of conf the scope describes.
+func (s *Scope) Apply(conf *SDConfig) {
+	if s.CompartmentID != "" {
+		conf.CompartmentID = s.CompartmentID
+	}
+	if s.RootCompartmentID != "" {
+		conf.RootCompartmentID = s.RootCompartmentID
+	}
+	if s.RootChildNames != nil {
+		conf.RootChildNames = s.RootChildNames
+	}
+	if s.IncludeRootCompartment != nil {
+		conf.IncludeRootCompartment = *s.IncludeRootCompartment
+	}
+	if s.IncludeInactiveCompartments != nil {
+		conf.IncludeInactiveCompartments = *s.IncludeInactiveCompartments
+	}
+	if s.SearchQuery != "" {
+		conf.SearchQuery = s.SearchQuery
+	}
+	if s.DisplayName != "" {
+		conf.DisplayName = s.DisplayName
+	}
+	if s.AvailabilityDomain != "" {
+		conf.AvailabilityDomain = s.AvailabilityDomain
+	}
+	if s.DefinedTagFilters != nil {
+		conf.DefinedTagFilters = s.DefinedTagFilters
+	}
+	if s.CompartmentTagFilters != nil {
+		conf.CompartmentTagFilters = s.CompartmentTagFilters
+	}
+}
@@ -0,0 +1,42 @@
+package oci
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestLoadScope(t *testing.T) {
+	scope, err := LoadScope("testdata/scope.yml")
+	testutil.Ok(t, err)
+
+	conf := DefaultSDConfig
+	conf.CompartmentID = ""
+	conf.Port = 9100
+	scope.Apply(&conf)
+	testutil.Equals(t, "ocid1.compartment.oc1..prod", conf.RootCompartmentID)
+	testutil.Equals(t, []string{"prod"}, conf.RootChildNames)
+	testutil.Equals(t, false, conf.IncludeRootCompartment)
+	testutil.Equals(t, false, conf.IncludeInactiveCompartments)
+	testutil.Equals(t, "web", conf.DisplayName)
+	testutil.Equals(t, "Uocm:PHX-AD-1", conf.AvailabilityDomain)
+	testutil.Equals(t, []string{"Operations.CostCenter=1234", "Operations.Team=*"}, conf.DefinedTagFilters)
+	testutil.Equals(t, map[string]string{"env": "prod"}, conf.CompartmentTagFilters)
+	// Settings outside the scope are kept.
+	testutil.Equals(t, 9100, conf.Port)
+	testutil.Ok(t, conf.Validate())
+}
+
+func TestLoadScopeUnknownField(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ocidiscover")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "scope.yml")
+	testutil.Ok(t, ioutil.WriteFile(filename, []byte("root_compartment: ocid1.compartment.oc1..prod\n"), 0644))
+
+	_, err = LoadScope(filename)
+	testutil.NotOk(t, err, "expected unknown fields to be rejected")
+}
@@ -0,0 +1,84 @@
+package oci
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+)
+
+// Stream refreshes the targets right away and then every refresh interval,
+// like Run, until ctx is done or the discovery is closed. The targets of every
+// successful refresh are sent on the first channel returned, the errors of
+// failed ones on the second. Both channels are closed once Stream stops, and
+// both have to be drained, as each result is waited for to be received.
+func (d *Discovery) Stream(ctx context.Context) (<-chan []*targetgroup.Group, <-chan error) {
+	results := make(chan []*targetgroup.Group)
+	errs := make(chan error)
+	closed := d.closing()
+
+	go func() {
+		defer close(results)
+		defer close(errs)
+
+		// report hands the outcome of a refresh to the caller, and reports
+		// whether to go on.
+		report := func(tgs []*targetgroup.Group, err error) bool {
+			if err != nil {
+				select {
+				case errs <- err:
+					return true
+				case <-ctx.Done():
+				case <-closed:
+				}
+				return false
+			}
+			select {
+			case results <- tgs:
+				return true
+			case <-ctx.Done():
+			case <-closed:
+			}
+			return false
+		}
+		refresh := func() bool {
+			tgs, err := d.refreshContext(ctx)
+			if err == nil {
+				d.cacheTargets(tgs)
+			}
+			return report(tgs, err)
+		}
+
+		cont := true
+		d.sendCachedTargets(func(tgs []*targetgroup.Group) {
+			cont = report(tgs, nil)
+		})
+		if !cont || !refresh() {
+			return
+		}
+
+		interval := d.refreshInterval()
+		ticker := time.NewTicker(interval)
+		defer func() {
+			ticker.Stop()
+		}()
+		for {
+			select {
+			case <-ticker.C:
+				if i := d.refreshInterval(); i != interval {
+					ticker.Stop()
+					interval = i
+					ticker = time.NewTicker(interval)
+				}
+				if !refresh() {
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-closed:
+				return
+			}
+		}
+	}()
+	return results, errs
+}
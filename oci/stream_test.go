@@ -0,0 +1,90 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+// toggledOciClientWrapper fails listing instances while fail is set.
+type toggledOciClientWrapper struct {
+	testOciClientWrapper
+	mtx  sync.Mutex
+	fail bool
+}
+
+func (w *toggledOciClientWrapper) setFail(fail bool) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.fail = fail
+}
+
+func (w *toggledOciClientWrapper) ListInstances(ctx context.Context, compartmentID *string, filter instanceFilter) (*instanceResponse, error) {
+	w.mtx.Lock()
+	fail := w.fail
+	w.mtx.Unlock()
+	if fail {
+		return nil, errors.New("list instances failed")
+	}
+	return w.testOciClientWrapper.ListInstances(ctx, compartmentID, filter)
+}
+
+func TestStream(t *testing.T) {
+	clientWrapper := &toggledOciClientWrapper{}
+	discovery := Discovery{
+		settings: settings{
+			compartmentID:    testCompartmentID,
+			interval:         10 * time.Millisecond,
+			port:             testInstancePort,
+			logger:           log.NewNopLogger(),
+			ociClientWrapper: clientWrapper,
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	results, errs := discovery.Stream(ctx)
+
+	// next returns the outcome of the next refresh.
+	next := func() ([]*targetgroup.Group, error) {
+		select {
+		case tgs := <-results:
+			return tgs, nil
+		case err := <-errs:
+			return nil, err
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a refresh")
+		}
+		return nil, nil
+	}
+
+	tgs, err := next()
+	testutil.Ok(t, err)
+	checkTarget(t, tgs)
+	tgs, err = next()
+	testutil.Ok(t, err)
+	checkTarget(t, tgs)
+
+	// A refresh may be running already when the client starts failing.
+	clientWrapper.setFail(true)
+	for err == nil {
+		_, err = next()
+	}
+	testutil.Equals(t, "error retrieving targets from oci: list instances failed", err.Error())
+	clientWrapper.setFail(false)
+	for err != nil {
+		tgs, err = next()
+	}
+	checkTarget(t, tgs)
+
+	// Both channels are closed once the context is canceled.
+	cancel()
+	for range results {
+	}
+	for range errs {
+	}
+}
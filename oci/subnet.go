@@ -0,0 +1,40 @@
+package oci
+
+import (
+	"context"
+	"sync"
+
+	"github.com/oracle/oci-go-sdk/core"
+)
+
+// subnetCache holds whether subnets are public by subnet id. Whether a subnet
+// allows public IPs can't be changed once it is created, so entries never
+// expire.
+type subnetCache struct {
+	mtx    sync.Mutex
+	public map[string]bool
+}
+
+// subnetPublic reports whether the subnet allows public IPs on its VNICs,
+// looking it up on first use.
+func (o remoteOciClientWrapper) subnetPublic(ctx context.Context, subnetID string) (bool, error) {
+	o.subnets.mtx.Lock()
+	public, ok := o.subnets.public[subnetID]
+	o.subnets.mtx.Unlock()
+	if ok {
+		return public, nil
+	}
+	response, err := o.ociVirtualNetworkClient.GetSubnet(ctx, core.GetSubnetRequest{SubnetId: &subnetID})
+	if err != nil {
+		return false, err
+	}
+	public = response.ProhibitPublicIpOnVnic == nil || !*response.ProhibitPublicIpOnVnic
+
+	o.subnets.mtx.Lock()
+	defer o.subnets.mtx.Unlock()
+	if o.subnets.public == nil {
+		o.subnets.public = map[string]bool{}
+	}
+	o.subnets.public[subnetID] = public
+	return public, nil
+}